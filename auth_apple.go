@@ -0,0 +1,304 @@
+package middleauth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/jose.v1/jws"
+
+	"golang.org/x/oauth2"
+)
+
+// AppleIssuer is the issuer of Sign in with Apple
+const AppleIssuer = "https://appleid.apple.com"
+
+// Apple endpoints
+const (
+	AppleAuthURL  = AppleIssuer + "/auth/authorize"
+	AppleTokenURL = AppleIssuer + "/auth/token"
+)
+
+// appleKeysURL is the JWKS endpoint of Apple
+var appleKeysURL = AppleIssuer + "/auth/keys"
+
+// AppleClientSecretExpires is the lifetime of the generated client
+// secret. Apple allows at most 6 months.
+const AppleClientSecretExpires = 24 * time.Hour
+
+// appleClientSecretRenew is the time before expiration
+// to generate a new client secret.
+const appleClientSecretRenew = time.Hour
+
+func init() {
+	// Apple only accepts the client credentials in POST body
+	oauth2.RegisterBrokenAuthHeaderProvider(AppleTokenURL)
+}
+
+// AppleConfig provides OAuth2 config for Sign in with Apple. The
+// ClientID is the Services ID. The ClientSecret is left empty, and
+// should be generated by AppleClientSecret for the code exchange.
+func AppleConfig(provider AuthProvider, redirectURL string) *oauth2.Config {
+	return &oauth2.Config{
+		RedirectURL: redirectURL,
+		ClientID:    provider.ClientID,
+		Scopes: []string{
+			"name",
+			"email",
+		},
+		Endpoint: oauth2.Endpoint{
+			AuthURL:  AppleAuthURL,
+			TokenURL: AppleTokenURL,
+		},
+	}
+}
+
+// NewAppleClientSecret creates AppleClientSecret of the provider.
+//
+// The team id and key id are read from the provider params "team_id"
+// and "key_id". The ClientSecret of the provider is the .p8 private key
+// of the key id, either in PEM format or as the path to the key file.
+func NewAppleClientSecret(provider AuthProvider) (secret *AppleClientSecret, err error) {
+	keyPEM := []byte(provider.ClientSecret)
+	if !strings.HasPrefix(strings.TrimSpace(provider.ClientSecret), "-----BEGIN") {
+		if keyPEM, err = ioutil.ReadFile(provider.ClientSecret); err != nil {
+			err = fmt.Errorf("failed to read private key: %s", err.Error())
+			return
+		}
+	}
+	key, err := parseECPrivateKey(keyPEM)
+	if err != nil {
+		return
+	}
+	secret = &AppleClientSecret{
+		TeamID:   provider.Param("team_id"),
+		KeyID:    provider.Param("key_id"),
+		ClientID: provider.ClientID,
+		Key:      key,
+	}
+	return
+}
+
+// AppleClientSecret generates the client secret for Apple, which
+// is an ES256 JWT signed with the private key of the developer
+// account. The secret is cached and renewed before it expires.
+type AppleClientSecret struct {
+	TeamID   string
+	KeyID    string
+	ClientID string
+	Key      *ecdsa.PrivateKey
+
+	mu      sync.Mutex
+	secret  string
+	expires time.Time
+}
+
+// Get returns the client secret
+func (s *AppleClientSecret) Get() (secret string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if s.secret != "" && now.Add(appleClientSecretRenew).Before(s.expires) {
+		return s.secret, nil
+	}
+
+	claims := jws.Claims{}
+	claims.SetIssuer(s.TeamID)
+	claims.SetSubject(s.ClientID)
+	claims.SetAudience(AppleIssuer)
+	claims.SetIssuedAt(now)
+	claims.SetExpiration(now.Add(AppleClientSecretExpires))
+
+	signed, err := signJWT(SigningMethodES256, s.Key, s.KeyID, claims)
+	if err != nil {
+		err = fmt.Errorf("failed to sign client secret: %s", err.Error())
+		return
+	}
+	s.secret, s.expires = signed, now.Add(AppleClientSecretExpires)
+	return s.secret, nil
+}
+
+// parseECPrivateKey parses the PEM encoded ECDSA private key
+// in PKCS #8 or SEC 1 format.
+func parseECPrivateKey(keyPEM []byte) (key *ecdsa.PrivateKey, err error) {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		err = fmt.Errorf("no PEM encoded private key found")
+		return
+	}
+	if parsed, pkcs8Err := x509.ParsePKCS8PrivateKey(block.Bytes); pkcs8Err == nil {
+		var ok bool
+		if key, ok = parsed.(*ecdsa.PrivateKey); !ok {
+			err = fmt.Errorf("private key is not an ECDSA key")
+		}
+		return
+	}
+	if key, err = x509.ParseECPrivateKey(block.Bytes); err != nil {
+		err = fmt.Errorf("failed to parse private key: %s", err.Error())
+	}
+	return
+}
+
+// AppleCallbackDecoder implements CallbackReqDecoder for the
+// form_post callback of Sign in with Apple. The client secret is
+// generated for the code exchange.
+//
+// Apple only sends the name of the user on the first login in the
+// "user" form field. The name is kept in the context for
+// AppleAuthUserFactory.
+func AppleCallbackDecoder(conf *oauth2.Config, secret *AppleClientSecret, states StateStore) CallbackReqDecoder {
+	return func(w http.ResponseWriter, r *http.Request) (ctxNext context.Context, client *http.Client, err error) {
+		exchangeConf := *conf
+		if exchangeConf.ClientSecret, err = secret.Get(); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error": err.Error(),
+			}).Error("failed to generate client secret")
+			return
+		}
+		ctxNext, client, err = OAuth2CallbackDecoder(
+			&exchangeConf,
+			states,
+			WithNonce(),
+			WithFormPost(),
+		)(w, r)
+		if err != nil {
+			return
+		}
+
+		/*
+			// NOTE: JSON structure of the "user" form field
+			{
+			  "name": {
+			    "firstName": "John",
+			    "lastName": "Appleseed"
+			  },
+			  "email": "email address"
+			}
+		*/
+		if rawUser := r.FormValue("user"); rawUser != "" {
+			var user struct {
+				Name struct {
+					FirstName string `json:"firstName"`
+					LastName  string `json:"lastName"`
+				} `json:"name"`
+			}
+			if jsonErr := json.Unmarshal([]byte(rawUser), &user); jsonErr != nil {
+				logrus.WithFields(logrus.Fields{
+					"error": jsonErr.Error(),
+				}).Warn("failed to decode user of apple callback")
+			} else {
+				name := strings.TrimSpace(user.Name.FirstName + " " + user.Name.LastName)
+				ctxNext = context.WithValue(ctxNext, appleUserNameKey, name)
+			}
+		}
+		return
+	}
+}
+
+// AppleAuthUserFactory generates an AuthUserDecoder that reads the user
+// identity from the verified ID token of Sign in with Apple.
+func AppleAuthUserFactory(provider AuthProvider) AuthUserDecoder {
+	keys := newRemoteKeySet(appleKeysURL)
+	keys.provider = provider.ID
+	return func(ctx context.Context, client *http.Client) (ctxNext context.Context, authIdentity *UserIdentity, err error) {
+
+		claims, err := verifyLoginIDToken(ctx, func(ctx context.Context, raw, nonce string) (claims jws.Claims, err error) {
+			if claims, err = keys.verify(ctx, raw); err != nil {
+				return
+			}
+			if iss, _ := claims.Issuer(); iss != AppleIssuer {
+				return nil, fmt.Errorf("unexpected issuer %#v", iss)
+			}
+			if err = checkIDTokenClaims(claims, provider.ClientID, nonce); err != nil {
+				return nil, err
+			}
+			return
+		})
+		if err != nil {
+			return
+		}
+
+		// read into
+		/*
+			// NOTE: JSON structure of ID token claims (partial)
+			{
+			  "iss": "https://appleid.apple.com",
+			  "aud": "services-id",
+			  "exp": 1311281970,
+			  "nonce": "login-nonce",
+			  "sub": "user-id",
+			  "email": "email address",
+			  "email_verified": "true",
+			  "is_private_email": "true"
+			}
+		*/
+		sub, _ := claims.Subject()
+		authIdentity = &UserIdentity{
+			Type:       "oidc",
+			Provider:   provider.ID,
+			ProviderID: sub,
+		}
+		authIdentity.Name, _ = ctx.Value(appleUserNameKey).(string)
+		authIdentity.PrimaryEmail, _ = claims.Get("email").(string)
+		authIdentity.Verified = claimBool(claims.Get("email_verified"))
+
+		ctxNext = ctx
+		return
+	}
+}
+
+// AppleProviderType creates a ProviderType for Sign in with Apple.
+// See NewAppleClientSecret for the provider params.
+func AppleProviderType() ProviderType {
+	return ProviderType{
+		Name:   "Apple",
+		Params: []string{"team_id", "key_id"},
+		AuthURLFactory: func(setup ProviderSetup) AuthURLFactory {
+			return OAuth2AuthURLFactory(
+				AppleConfig(setup.Provider, setup.CallbackURL),
+				setup.States,
+				WithNonce(),
+				WithFormPost(),
+			)
+		},
+		CallbackReqDecoder: func(setup ProviderSetup) CallbackReqDecoder {
+			secret, err := NewAppleClientSecret(setup.Provider)
+			if err != nil {
+				logrus.WithFields(logrus.Fields{
+					"error":       err.Error(),
+					"provider.id": setup.Provider.ID,
+				}).Error("failed to load apple private key")
+				return func(w http.ResponseWriter, r *http.Request) (ctxNext context.Context, client *http.Client, _ error) {
+					return nil, nil, err
+				}
+			}
+			return AppleCallbackDecoder(
+				AppleConfig(setup.Provider, setup.CallbackURL),
+				secret,
+				setup.States,
+			)
+		},
+		AuthUserDecoder: func(setup ProviderSetup) AuthUserDecoder {
+			return AppleAuthUserFactory(setup.Provider)
+		},
+		OAuth2Config: func(ctx context.Context, provider AuthProvider) (conf *oauth2.Config, err error) {
+			secret, err := NewAppleClientSecret(provider)
+			if err != nil {
+				return
+			}
+			conf = AppleConfig(provider, "")
+			conf.ClientSecret, err = secret.Get()
+			return
+		},
+	}
+}
@@ -0,0 +1,215 @@
+package middleauth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/jose.v1/jws"
+)
+
+func genApplePrivateKey(t *testing.T) (key *ecdsa.PrivateKey, keyPEM string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	b, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	keyPEM = string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: b}))
+	return
+}
+
+func TestAppleClientSecret(t *testing.T) {
+	key, keyPEM := genApplePrivateKey(t)
+	secret, err := NewAppleClientSecret(AuthProvider{
+		ClientID:     "com.foobar.services",
+		ClientSecret: keyPEM,
+		Params: map[string]string{
+			"team_id": "dummy-team",
+			"key_id":  "dummy-key",
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	raw, err := secret.Get()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	token, err := parseCompactJWT(raw)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := token.verify(SigningMethodES256, &key.PublicKey); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	// Apple only accepts the R || S signature of RFC 7518
+	// section 3.4, not the ASN.1 encoded one.
+	segments := strings.Split(raw, ".")
+	sig, err := base64.RawURLEncoding.DecodeString(segments[2])
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if want, have := 64, len(sig); want != have {
+		t.Fatalf("expected signature of %d bytes, got %d", want, have)
+	}
+	digest := sha256.Sum256([]byte(segments[0] + "." + segments[1]))
+	r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+	if !ecdsa.Verify(&key.PublicKey, digest[:], r, s) {
+		t.Errorf("expected R || S signature to verify with the key")
+	}
+	if want, have := "dummy-key", token.kid; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+	claims := token.claims
+	if want, have := "dummy-team", claims.Get("iss"); want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+	if want, have := "com.foobar.services", claims.Get("sub"); want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+	if audiences, _ := claims.Audience(); len(audiences) != 1 || audiences[0] != AppleIssuer {
+		t.Errorf("expected %#v, got %#v", []string{AppleIssuer}, audiences)
+	}
+
+	// cached
+	if cached, _ := secret.Get(); cached != raw {
+		t.Errorf("expected cached secret %#v, got %#v", raw, cached)
+	}
+
+	// renew before expires
+	secret.expires = time.Now().Add(time.Minute)
+	if renewed, _ := secret.Get(); renewed == raw {
+		t.Errorf("expected renewed secret, got the cached one")
+	}
+}
+
+func TestApple_formPost(t *testing.T) {
+	signKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	_, keyPEM := genApplePrivateKey(t)
+
+	var nonce, clientSecret string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(JSONWebKeySet{
+			Keys: []JSONWebKey{
+				{
+					KeyType: "EC",
+					KeyID:   "apple-key",
+					Curve:   "P-256",
+					X:       base64.RawURLEncoding.EncodeToString(signKey.X.Bytes()),
+					Y:       base64.RawURLEncoding.EncodeToString(signKey.Y.Bytes()),
+				},
+			},
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if _, clientSecret, _ = r.BasicAuth(); clientSecret == "" {
+			clientSecret = r.FormValue("client_secret")
+		}
+		claims := jws.Claims{}
+		claims.SetIssuer(AppleIssuer)
+		claims.SetSubject("dummy-apple-user")
+		claims.SetAudience("com.foobar.services")
+		claims.SetExpiration(time.Now().Add(time.Minute))
+		claims.Set("nonce", nonce)
+		claims.Set("email", "dummy@privaterelay.appleid.com")
+		claims.Set("email_verified", "true")
+		idToken, _ := signJWT(SigningMethodES256, signKey, "apple-key", claims)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"access_token": "dummy-access-token",
+			"token_type":   "bearer",
+			"id_token":     string(idToken),
+		})
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	defaultKeysURL := appleKeysURL
+	appleKeysURL = ts.URL + "/keys"
+	defer func() { appleKeysURL = defaultKeysURL }()
+
+	provider := AuthProvider{
+		ID:           "apple",
+		ClientID:     "com.foobar.services",
+		ClientSecret: keyPEM,
+		Params: map[string]string{
+			"team_id": "dummy-team",
+			"key_id":  "dummy-key",
+		},
+	}
+	conf := AppleConfig(provider, "https://foobar.com/callback")
+	conf.Endpoint.TokenURL = ts.URL + "/token"
+	states := NewCookieStateStore("dummy-state", "dummy-key")
+	secret, err := NewAppleClientSecret(provider)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// login redirect
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "https://foobar.com/login", nil)
+	rawurl, err := OAuth2AuthURLFactory(conf, states, WithNonce(), WithFormPost())(w, r)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	authURL, _ := url.Parse(rawurl)
+	if want, have := "form_post", authURL.Query().Get("response_mode"); want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+	nonce = authURL.Query().Get("nonce")
+
+	// form_post callback
+	form := url.Values{}
+	form.Set("state", authURL.Query().Get("state"))
+	form.Set("code", "dummy-code")
+	form.Set("user", `{"name":{"firstName":"John","lastName":"Appleseed"},"email":"dummy@privaterelay.appleid.com"}`)
+	r, _ = http.NewRequest("POST", "https://foobar.com/callback", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for _, cookie := range w.Result().Cookies() {
+		r.AddCookie(cookie)
+	}
+	ctx, client, err := AppleCallbackDecoder(conf, secret, states)(httptest.NewRecorder(), r)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if want, _ := secret.Get(); want != clientSecret {
+		t.Errorf("expected client secret %#v, got %#v", want, clientSecret)
+	}
+
+	_, identity, err := AppleAuthUserFactory(provider)(ctx, client)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if want, have := "dummy-apple-user", identity.ProviderID; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+	if want, have := "John Appleseed", identity.Name; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+	if want, have := "dummy@privaterelay.appleid.com", identity.PrimaryEmail; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+	if want, have := true, identity.Verified; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+}
@@ -4,9 +4,6 @@ import (
 	"context"
 	"net/http"
 
-	"github.com/sirupsen/logrus"
-	"github.com/go-restit/lzjson"
-
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/facebook"
 )
@@ -26,17 +23,17 @@ func FacebookConfig(provider AuthProvider, redirectURL string) *oauth2.Config {
 
 // FacebookAuthUserFactory implements ProviderAuthUserFactory
 func FacebookAuthUserFactory(ctx context.Context, client *http.Client) (ctxNext context.Context, authIdentity *UserIdentity, err error) {
+	return facebookAuthUser(ctx, client, "facebook")
+}
 
-	resp, err := client.Get("https://graph.facebook.com/v2.9/me?fields=id,name,email")
+// facebookAuthUser reads the user identity of the Facebook provider of the id
+func facebookAuthUser(ctx context.Context, client *http.Client, providerID string) (ctxNext context.Context, authIdentity *UserIdentity, err error) {
+
+	result, err := getJSON(client, providerID, "https://graph.facebook.com/v2.9/me?fields=id,name,email")
 	if err != nil {
-		logrus.WithFields(logrus.Fields{
-			"error": err.Error(),
-		}).Error("failed to retrieve id, name and email")
 		return
 	}
 
-	result := lzjson.Decode(resp.Body)
-
 	// read into
 	/*
 		// NOTE: JSON structure of normal response body
@@ -46,11 +43,13 @@ func FacebookAuthUserFactory(ctx context.Context, client *http.Client) (ctxNext
 		  "email": "email address"
 		}
 	*/
+	// Facebook provides no signal of email verification,
+	// so Verified is left false.
 	authIdentity = &UserIdentity{
 		Name:         result.Get("name").String(),
 		PrimaryEmail: result.Get("email").String(),
 		Type:         "oauth2",
-		Provider:     "facebook",
+		Provider:     providerID,
 		ProviderID:   result.Get("id").String(),
 	}
 	ctxNext = ctx
@@ -0,0 +1,119 @@
+package middleauth
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/go-restit/lzjson"
+	"golang.org/x/oauth2"
+)
+
+// GenericParams are the provider parameters of the generic OAuth2
+// provider type "oauth2".
+//
+// The field params are dot separated paths to the value in the
+// userinfo JSON (e.g. "data.user.id"). Scopes are separated by
+// space or comma.
+var GenericParams = []string{
+	"auth_url",
+	"token_url",
+	"userinfo_url",
+	"scopes",
+	"id_field",
+	"name_field",
+	"email_field",
+	"email_verified_field",
+}
+
+// GenericConfig provides OAuth2 config for the generic OAuth2 login
+// with the endpoints and scopes in the provider params.
+func GenericConfig(provider AuthProvider, redirectURL string) *oauth2.Config {
+	return &oauth2.Config{
+		RedirectURL:  redirectURL,
+		ClientID:     provider.ClientID,
+		ClientSecret: provider.ClientSecret,
+		Scopes: strings.FieldsFunc(provider.Param("scopes"), func(r rune) bool {
+			return r == ' ' || r == ','
+		}),
+		Endpoint: oauth2.Endpoint{
+			AuthURL:  provider.Param("auth_url"),
+			TokenURL: provider.Param("token_url"),
+		},
+	}
+}
+
+// GenericAuthUserFactory generates an AuthUserDecoder that reads the
+// user identity from the userinfo_url of the provider. The fields are
+// mapped with the provider params id_field (default "id"), name_field
+// (default "name"), email_field (default "email") and
+// email_verified_field (no default, the email is considered not
+// verified if not set).
+func GenericAuthUserFactory(provider AuthProvider) AuthUserDecoder {
+	field := func(name, defaultPath string) string {
+		if path := provider.Param(name); path != "" {
+			return path
+		}
+		return defaultPath
+	}
+	idField := field("id_field", "id")
+	nameField := field("name_field", "name")
+	emailField := field("email_field", "email")
+	emailVerifiedField := field("email_verified_field", "")
+
+	return func(ctx context.Context, client *http.Client) (ctxNext context.Context, authIdentity *UserIdentity, err error) {
+
+		result, err := getJSON(client, provider.ID, provider.Param("userinfo_url"))
+		if err != nil {
+			return
+		}
+
+		authIdentity = &UserIdentity{
+			Name:         nodeString(nodePath(result, nameField)),
+			PrimaryEmail: nodeString(nodePath(result, emailField)),
+			Type:         "oauth2",
+			Provider:     provider.ID,
+			ProviderID:   nodeString(nodePath(result, idField)),
+		}
+		if emailVerifiedField != "" {
+			authIdentity.Verified = nodeBool(nodePath(result, emailVerifiedField))
+		}
+		if authIdentity.ProviderID == "" {
+			authIdentity = nil
+			err = fmt.Errorf("userinfo has no user id in field %#v", idField)
+			return
+		}
+		ctxNext = ctx
+		return
+	}
+}
+
+// nodePath gets the inner node of the dot separated path
+func nodePath(node lzjson.Node, path string) lzjson.Node {
+	for _, key := range strings.Split(path, ".") {
+		node = node.Get(key)
+	}
+	return node
+}
+
+// nodeString reads string JSON value that might be encoded as number
+func nodeString(node lzjson.Node) string {
+	if node.Type() == lzjson.TypeNumber {
+		return string(node.Raw())
+	}
+	return node.String()
+}
+
+// GenericProviderType creates a ProviderType for OAuth2 providers
+// defined entirely by the provider params (see GenericParams).
+func GenericProviderType() ProviderType {
+	providerType := OAuth2ProviderType(
+		"OAuth2",
+		GenericConfig,
+		GenericAuthUserFactory,
+		WithPKCE(),
+	)
+	providerType.Params = GenericParams
+	return providerType
+}
@@ -0,0 +1,141 @@
+package middleauth_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/yookoala/middleauth"
+)
+
+func TestGenericAuthUserFactory(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{
+			"user": {
+				"id": 12345,
+				"display_name": "dummy user",
+				"mail": "dummy@foobar.com",
+				"mail_confirmed": true
+			}
+		}`))
+	}))
+	defer ts.Close()
+
+	provider := middleauth.AuthProvider{
+		ID:   "corp",
+		Type: "oauth2",
+		Params: map[string]string{
+			"userinfo_url":         ts.URL,
+			"id_field":             "user.id",
+			"name_field":           "user.display_name",
+			"email_field":          "user.mail",
+			"email_verified_field": "user.mail_confirmed",
+		},
+	}
+	_, identity, err := middleauth.GenericAuthUserFactory(provider)(context.Background(), http.DefaultClient)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if want, have := "corp", identity.Provider; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+	if want, have := "12345", identity.ProviderID; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+	if want, have := "dummy user", identity.Name; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+	if want, have := "dummy@foobar.com", identity.PrimaryEmail; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+	if want, have := true, identity.Verified; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+
+	// default field mapping does not find the user id
+	provider.Params = map[string]string{"userinfo_url": ts.URL}
+	if _, _, err := middleauth.GenericAuthUserFactory(provider)(context.Background(), http.DefaultClient); err == nil {
+		t.Errorf("expected error, got nil")
+	}
+}
+
+func TestGenericConfig(t *testing.T) {
+	conf := middleauth.GenericConfig(middleauth.AuthProvider{
+		ClientID: "dummy-client",
+		Params: map[string]string{
+			"auth_url":  "https://sso.corp.com/auth",
+			"token_url": "https://sso.corp.com/token",
+			"scopes":    "openid, profile email",
+		},
+	}, "http://foobar.com/callback")
+	if want, have := "https://sso.corp.com/auth", conf.Endpoint.AuthURL; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+	if want, have := "https://sso.corp.com/token", conf.Endpoint.TokenURL; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+	if want, have := 3, len(conf.Scopes); want != have {
+		t.Fatalf("expected %d scopes, got %d", want, have)
+	}
+	if want, have := "profile", conf.Scopes[1]; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+}
+
+func TestGenericAuthUserFactory_providerError(t *testing.T) {
+	tests := []struct {
+		desc   string
+		status int
+		body   string
+	}{
+		{
+			desc:   "unauthorized",
+			status: http.StatusUnauthorized,
+			body:   `{"error": "invalid_token"}`,
+		},
+		{
+			desc:   "rate limited",
+			status: http.StatusTooManyRequests,
+			body:   strings.Repeat("slow down. ", 100),
+		},
+		{
+			desc:   "malformed JSON",
+			status: http.StatusOK,
+			body:   `<html>not json</html>`,
+		},
+	}
+
+	for _, test := range tests {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(test.status)
+			w.Write([]byte(test.body))
+		}))
+		provider := middleauth.AuthProvider{
+			ID:     "corp",
+			Params: map[string]string{"userinfo_url": ts.URL},
+		}
+		_, identity, err := middleauth.GenericAuthUserFactory(provider)(context.Background(), http.DefaultClient)
+		ts.Close()
+
+		if identity != nil {
+			t.Errorf("[%s] expected nil identity, got %#v", test.desc, identity)
+		}
+		perr, ok := err.(*middleauth.ProviderError)
+		if !ok {
+			t.Errorf("[%s] expected *middleauth.ProviderError, got %#v", test.desc, err)
+			continue
+		}
+		if want, have := "corp", perr.Provider; want != have {
+			t.Errorf("[%s] expected %#v, got %#v", test.desc, want, have)
+		}
+		if want, have := test.status, perr.StatusCode; want != have {
+			t.Errorf("[%s] expected %#v, got %#v", test.desc, want, have)
+		}
+		if perr.Body == "" || len(perr.Body) > 520 {
+			t.Errorf("[%s] unexpected body excerpt %#v", test.desc, perr.Body)
+		}
+	}
+}
@@ -3,11 +3,9 @@ package middleauth
 import (
 	"context"
 	"fmt"
-	"log"
 	"net/http"
 
 	"github.com/sirupsen/logrus"
-	"github.com/go-restit/lzjson"
 
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/github"
@@ -28,16 +26,19 @@ func GithubConfig(provider AuthProvider, redirectURL string) *oauth2.Config {
 
 // GithubAuthUserFactory implements ProviderAuthUserFactory
 func GithubAuthUserFactory(ctx context.Context, client *http.Client) (ctxNext context.Context, authIdentity *UserIdentity, err error) {
+	return githubAuthUser(ctx, client, "github")
+}
+
+// githubAuthUser reads the user identity of the Github provider of the id
+func githubAuthUser(ctx context.Context, client *http.Client, providerID string) (ctxNext context.Context, authIdentity *UserIdentity, err error) {
 
 	// read into
 	var primaryEmail string
+	var primaryVerified bool
 	var verifiedEmails []string
 
-	resp, err := client.Get("https://api.github.com/user")
+	userInfoResult, err := getJSON(client, providerID, "https://api.github.com/user")
 	if err != nil {
-		logrus.WithFields(logrus.Fields{
-			"error": err.Error(),
-		}).Error("failed to retrieve user")
 		return
 	}
 	/*
@@ -87,15 +88,10 @@ func GithubAuthUserFactory(ctx context.Context, client *http.Client) (ctxNext co
 		  }
 		}
 	*/
-	userInfoResult := lzjson.Decode(resp.Body)
 
 	// read other email(s) from email endpoint
-	// TODO: or redirect to error handling page
-	resp, err = client.Get("https://api.github.com/user/emails")
+	userEmailResult, err := getJSON(client, providerID, "https://api.github.com/user/emails")
 	if err != nil {
-		logrus.WithFields(logrus.Fields{
-			"error": err.Error(),
-		}).Error("failed to retrieve user emails")
 		return
 	}
 	/*
@@ -109,7 +105,6 @@ func GithubAuthUserFactory(ctx context.Context, client *http.Client) (ctxNext co
 		  }
 		]
 	*/
-	userEmailResult := lzjson.Decode(resp.Body)
 	emails := []struct {
 		Email    string `json:"email"`
 		Verified bool   `json:"verified"`
@@ -120,23 +115,25 @@ func GithubAuthUserFactory(ctx context.Context, client *http.Client) (ctxNext co
 		for _, email := range emails {
 			if email.Primary {
 				primaryEmail = email.Email
+				primaryVerified = email.Verified
 			} else if email.Verified {
 				verifiedEmails = append(verifiedEmails, email.Email)
 			}
 		}
 	} else {
-		log.Printf("unexpected error: %s", err.Error())
 		logrus.WithFields(logrus.Fields{
 			"error":       err.Error(),
 			"rawResponse": string(userEmailResult.Raw()),
 		}).Error("error reading results from github's user/emails endpoint")
+		err = nil
 	}
 
 	authIdentity = &UserIdentity{
 		Name:         userInfoResult.Get("name").String(),
 		PrimaryEmail: primaryEmail,
+		Verified:     primaryVerified,
 		Type:         "oauth2",
-		Provider:     "github",
+		Provider:     providerID,
 		ProviderID:   fmt.Sprintf("%d", userInfoResult.Get("id").Int()),
 		Emails:       verifiedEmails,
 	}
@@ -0,0 +1,69 @@
+package middleauth_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/yookoala/middleauth"
+)
+
+func TestGithubAuthUserFactory(t *testing.T) {
+	var emails string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/user", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"login": "octocat", "id": 1, "name": "monalisa octocat"}`))
+	})
+	mux.HandleFunc("/user/emails", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(emails))
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+	target, _ := url.Parse(ts.URL)
+	client := &http.Client{Transport: rewriteTransport{target}}
+
+	tests := []struct {
+		emails   string
+		email    string
+		verified bool
+	}{
+		{
+			emails:   `[{"email": "octocat@github.com", "verified": true, "primary": true}]`,
+			email:    "octocat@github.com",
+			verified: true,
+		},
+		{
+			emails:   `[{"email": "octocat@github.com", "verified": false, "primary": true}]`,
+			email:    "octocat@github.com",
+			verified: false,
+		},
+		{
+			// unexpected emails result is logged and ignored
+			emails:   `{"message": "unexpected"}`,
+			email:    "",
+			verified: false,
+		},
+	}
+
+	for _, test := range tests {
+		emails = test.emails
+		_, identity, err := middleauth.GithubAuthUserFactory(context.Background(), client)
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
+			continue
+		}
+		if want, have := "1", identity.ProviderID; want != have {
+			t.Errorf("expected %#v, got %#v", want, have)
+		}
+		if want, have := test.email, identity.PrimaryEmail; want != have {
+			t.Errorf("expected %#v, got %#v", want, have)
+		}
+		if want, have := test.verified, identity.Verified; want != have {
+			t.Errorf("expected %#v, got %#v", want, have)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package middleauth
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/go-restit/lzjson"
+	"github.com/sirupsen/logrus"
+
+	"golang.org/x/oauth2"
+)
+
+// GitlabDefaultBaseURL is the base URL of the gitlab.com
+const GitlabDefaultBaseURL = "https://gitlab.com"
+
+// gitlabBaseURL returns the base URL of the gitlab provider from
+// the provider param "base_url", or GitlabDefaultBaseURL if not set.
+func gitlabBaseURL(provider AuthProvider) string {
+	if baseURL := provider.Param("base_url"); baseURL != "" {
+		return strings.TrimRight(baseURL, "/")
+	}
+	return GitlabDefaultBaseURL
+}
+
+// GitlabConfig provides OAuth2 config for gitlab login. Self-hosted
+// GitLab can be used by setting the provider param "base_url".
+func GitlabConfig(provider AuthProvider, redirectURL string) *oauth2.Config {
+	baseURL := gitlabBaseURL(provider)
+	return &oauth2.Config{
+		RedirectURL:  redirectURL,
+		ClientID:     provider.ClientID,
+		ClientSecret: provider.ClientSecret,
+		Scopes: []string{
+			"read_user",
+		},
+		Endpoint: oauth2.Endpoint{
+			AuthURL:  baseURL + "/oauth/authorize",
+			TokenURL: baseURL + "/oauth/token",
+		},
+	}
+}
+
+// GitlabAuthUserFactory generates an AuthUserDecoder that reads
+// the user identity from the API of the provider's GitLab.
+func GitlabAuthUserFactory(provider AuthProvider) AuthUserDecoder {
+	apiURL := gitlabBaseURL(provider) + "/api/v4"
+	return func(ctx context.Context, client *http.Client) (ctxNext context.Context, authIdentity *UserIdentity, err error) {
+
+		userInfoResult, err := getJSON(client, provider.ID, apiURL+"/user")
+		if err != nil {
+			return
+		}
+		/*
+			// NOTE: JSON structure of normal response body (partial)
+			{
+			  "id": 1,
+			  "username": "john_smith",
+			  "name": "John Smith",
+			  "state": "active",
+			  "email": "john@example.com",
+			  "confirmed_at": "2012-05-23T09:05:22Z"
+			}
+		*/
+		if userInfoResult.Get("id").Type() != lzjson.TypeNumber {
+			err = &ProviderError{
+				Provider:   provider.ID,
+				URL:        apiURL + "/user",
+				StatusCode: http.StatusOK,
+				Body:       bodyExcerpt(userInfoResult.Raw()),
+				Err:        fmt.Errorf("user id is not a number"),
+			}
+			logrus.WithFields(logrus.Fields{
+				"error":       err.Error(),
+				"rawResponse": string(userInfoResult.Raw()),
+			}).Error("error reading results from gitlab's user endpoint")
+			return
+		}
+
+		// read other email(s) from email endpoint
+		userEmailResult, err := getJSON(client, provider.ID, apiURL+"/user/emails")
+		if err != nil {
+			return
+		}
+		/*
+			// NOTE: JSON structure of normal response body
+			// (secondary emails only, primary email not included)
+			[
+			  {
+			    "id": 1,
+			    "email": "email@example.com",
+			    "confirmed_at": "2021-03-26T19:07:56.248Z"
+			  },
+			  {
+			    "id": 3,
+			    "email": "email2@example.com",
+			    "confirmed_at": null
+			  }
+			]
+		*/
+		emails := []struct {
+			Email       string  `json:"email"`
+			ConfirmedAt *string `json:"confirmed_at"`
+		}{}
+		var verifiedEmails []string
+		if err = userEmailResult.Unmarshal(&emails); err == nil {
+			verifiedEmails = make([]string, 0, len(emails))
+			for _, email := range emails {
+				if email.ConfirmedAt != nil {
+					verifiedEmails = append(verifiedEmails, email.Email)
+				}
+			}
+		} else {
+			logrus.WithFields(logrus.Fields{
+				"error":       err.Error(),
+				"rawResponse": string(userEmailResult.Raw()),
+			}).Error("error reading results from gitlab's user/emails endpoint")
+			err = nil
+		}
+
+		authIdentity = &UserIdentity{
+			Name:         userInfoResult.Get("name").String(),
+			PrimaryEmail: userInfoResult.Get("email").String(),
+			Verified:     userInfoResult.Get("confirmed_at").String() != "",
+			Type:         "oauth2",
+			Provider:     provider.ID,
+			ProviderID:   nodeString(userInfoResult.Get("id")),
+			Emails:       verifiedEmails,
+		}
+		ctxNext = ctx
+		return
+	}
+}
+
+// GitlabProviderType creates a ProviderType for gitlab login.
+// The base URL is read from the provider param "base_url".
+func GitlabProviderType() ProviderType {
+	providerType := OAuth2ProviderType(
+		"GitLab",
+		GitlabConfig,
+		GitlabAuthUserFactory,
+		WithPKCE(),
+	)
+	providerType.Params = []string{"base_url"}
+	return providerType
+}
@@ -0,0 +1,129 @@
+package middleauth_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/yookoala/middleauth"
+)
+
+func TestGitlabConfig(t *testing.T) {
+	conf := middleauth.GitlabConfig(middleauth.AuthProvider{}, "http://foobar.com/callback")
+	if want, have := "https://gitlab.com/oauth/authorize", conf.Endpoint.AuthURL; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+
+	conf = middleauth.GitlabConfig(middleauth.AuthProvider{
+		Params: map[string]string{"base_url": "https://git.foobar.com/"},
+	}, "http://foobar.com/callback")
+	if want, have := "https://git.foobar.com/oauth/authorize", conf.Endpoint.AuthURL; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+	if want, have := "https://git.foobar.com/oauth/token", conf.Endpoint.TokenURL; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+}
+
+func TestGitlabAuthUserFactory(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v4/user", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{
+			"id": 1,
+			"username": "john_smith",
+			"name": "John Smith",
+			"email": "john@example.com",
+			"confirmed_at": "2012-05-23T09:05:22Z"
+		}`))
+	})
+	mux.HandleFunc("/api/v4/user/emails", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`[
+			{"id": 1, "email": "john2@example.com", "confirmed_at": "2021-03-26T19:07:56.248Z"},
+			{"id": 3, "email": "john3@example.com", "confirmed_at": null}
+		]`))
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	provider := middleauth.AuthProvider{
+		ID:     "corp-gitlab",
+		Type:   "gitlab",
+		Params: map[string]string{"base_url": ts.URL},
+	}
+	_, identity, err := middleauth.GitlabAuthUserFactory(provider)(context.Background(), http.DefaultClient)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if want, have := "corp-gitlab", identity.Provider; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+	if want, have := "1", identity.ProviderID; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+	if want, have := "John Smith", identity.Name; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+	if want, have := "john@example.com", identity.PrimaryEmail; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+	if want, have := true, identity.Verified; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+	if want, have := []string{"john2@example.com"}, identity.Emails; len(want) != len(have) || want[0] != have[0] {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+}
+
+func TestGitlabAuthUserFactory_providerError(t *testing.T) {
+	tests := []struct {
+		desc   string
+		status int
+		body   string
+	}{
+		{
+			desc:   "unauthorized",
+			status: http.StatusUnauthorized,
+			body:   `{"message": "401 Unauthorized"}`,
+		},
+		{
+			desc:   "id not a number",
+			status: http.StatusOK,
+			body:   `{"id": "john_smith"}`,
+		},
+	}
+
+	for _, test := range tests {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(test.status)
+			w.Write([]byte(test.body))
+		}))
+		provider := middleauth.AuthProvider{
+			ID:     "corp-gitlab",
+			Type:   "gitlab",
+			Params: map[string]string{"base_url": ts.URL},
+		}
+		_, identity, err := middleauth.GitlabAuthUserFactory(provider)(context.Background(), http.DefaultClient)
+		ts.Close()
+
+		if identity != nil {
+			t.Errorf("[%s] expected nil identity, got %#v", test.desc, identity)
+		}
+		perr, ok := err.(*middleauth.ProviderError)
+		if !ok {
+			t.Errorf("[%s] expected *middleauth.ProviderError, got %#v", test.desc, err)
+			continue
+		}
+		if want, have := "corp-gitlab", perr.Provider; want != have {
+			t.Errorf("[%s] expected %#v, got %#v", test.desc, want, have)
+		}
+		if want, have := test.status, perr.StatusCode; want != have {
+			t.Errorf("[%s] expected %#v, got %#v", test.desc, want, have)
+		}
+		if want, have := test.body, perr.Body; want != have {
+			t.Errorf("[%s] expected %#v, got %#v", test.desc, want, have)
+		}
+	}
+}
@@ -2,10 +2,9 @@ package middleauth
 
 import (
 	"context"
+	"fmt"
 	"net/http"
-
-	"github.com/sirupsen/logrus"
-	"github.com/go-restit/lzjson"
+	"strings"
 
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
@@ -27,33 +26,121 @@ func GoogleConfig(provider AuthProvider, redirectURL string) *oauth2.Config {
 
 // GoogleAuthUserFactory implements ProviderAuthUserFactory
 func GoogleAuthUserFactory(ctx context.Context, client *http.Client) (ctxNext context.Context, authIdentity *UserIdentity, err error) {
+	return GoogleHostedDomainAuthUserFactory()(ctx, client)
+}
+
+// GoogleHostedDomainAuthUserFactory generates an AuthUserDecoder
+// for google login that only accepts accounts of the given Google
+// Workspace domains, or all accounts if no domain is given. Other
+// accounts are rejected with ErrHostedDomainNotAllowed. Domains are
+// compared case-insensitively.
+//
+// The domain is checked against the hosted domain ("hd") of the user,
+// but not the email domain. Personal Google accounts can be created
+// with any email address, including those of the company domain.
+func GoogleHostedDomainAuthUserFactory(domains ...string) AuthUserDecoder {
+	return googleAuthUser("google", domains)
+}
+
+// googleAuthUser generates the AuthUserDecoder of the google
+// provider of the id. See GoogleHostedDomainAuthUserFactory.
+func googleAuthUser(providerID string, domains []string) AuthUserDecoder {
+	allowed := normalizeDomains(domains)
+	return func(ctx context.Context, client *http.Client) (ctxNext context.Context, authIdentity *UserIdentity, err error) {
 
-	resp, err := client.Get("https://www.googleapis.com/oauth2/v1/userinfo")
-	if err != nil {
-		logrus.WithFields(logrus.Fields{
-			"error": err.Error(),
-		}).Error("failed to retrieve id, name and email")
+		result, err := getJSON(client, providerID, "https://www.googleapis.com/oauth2/v1/userinfo")
+		if err != nil {
+			return
+		}
+
+		// read into
+		/*
+			// NOTE: JSON structure of normal response body
+			{
+			  "id": "numerical-user-id",
+			  "name": "user display name",
+			  "email": "email address",
+			  "verified_email": true,
+			  "hd": "hosted domain of Google Workspace account"
+			}
+		*/
+		if len(allowed) > 0 {
+			if hd := result.Get("hd").String(); !stringInSlice(strings.ToLower(hd), allowed) {
+				err = &LoginError{
+					Type:   ErrHostedDomainNotAllowed,
+					Action: "check hosted domain",
+					Err:    fmt.Errorf("hosted domain %#v is not allowed", hd),
+				}
+				return
+			}
+		}
+
+		authIdentity = &UserIdentity{
+			Name:         result.Get("name").String(),
+			PrimaryEmail: result.Get("email").String(),
+			Verified:     nodeBool(result.Get("verified_email")),
+			Type:         "oauth2",
+			Provider:     providerID,
+			ProviderID:   result.Get("id").String(),
+		}
+		ctxNext = ctx
 		return
 	}
+}
 
-	result := lzjson.Decode(resp.Body)
-
-	// read into
-	/*
-		// NOTE: JSON structure of normal response body
-		{
-		  "id": "numerical-user-id",
-		  "name": "user display name",
-		  "email": "email address"
+// normalizeDomains trims and lowercases the domains,
+// skipping the blank ones.
+func normalizeDomains(domains []string) (normalized []string) {
+	for _, domain := range domains {
+		if domain = strings.TrimSpace(domain); domain != "" {
+			normalized = append(normalized, strings.ToLower(domain))
 		}
-	*/
-	authIdentity = &UserIdentity{
-		Name:         result.Get("name").String(),
-		PrimaryEmail: result.Get("email").String(),
-		Type:         "oauth2",
-		Provider:     "google",
-		ProviderID:   result.Get("id").String(),
 	}
-	ctxNext = ctx
 	return
 }
+
+// googleHostedDomains returns the domains of the provider
+// param "hosted_domain", separated by comma.
+func googleHostedDomains(provider AuthProvider) []string {
+	return normalizeDomains(strings.Split(provider.Param("hosted_domain"), ","))
+}
+
+// GoogleProviderType creates a ProviderType for google login. Logins
+// can be restricted to Google Workspace domains with the provider param
+// "hosted_domain" (comma separated for multiple domains).
+func GoogleProviderType() ProviderType {
+	options := func(provider AuthProvider) []OAuth2Option {
+		opts := []OAuth2Option{WithPKCE()}
+		switch domains := googleHostedDomains(provider); len(domains) {
+		case 0:
+		case 1:
+			opts = append(opts, WithAuthURLParam("hd", domains[0]))
+		default:
+			// let user choose among Workspace accounts
+			opts = append(opts, WithAuthURLParam("hd", "*"))
+		}
+		return opts
+	}
+	return ProviderType{
+		Name:   "Google",
+		Params: []string{"hosted_domain"},
+		AuthURLFactory: func(setup ProviderSetup) AuthURLFactory {
+			return OAuth2AuthURLFactory(
+				GoogleConfig(setup.Provider, setup.CallbackURL),
+				setup.States,
+				options(setup.Provider)...,
+			)
+		},
+		CallbackReqDecoder: func(setup ProviderSetup) CallbackReqDecoder {
+			return OAuth2CallbackDecoder(
+				GoogleConfig(setup.Provider, setup.CallbackURL),
+				setup.States,
+				options(setup.Provider)...,
+			)
+		},
+		AuthUserDecoder: func(setup ProviderSetup) AuthUserDecoder {
+			return googleAuthUser(setup.Provider.ID, googleHostedDomains(setup.Provider))
+		},
+		OAuth2Config: staticOAuth2Config(GoogleConfig),
+	}
+}
@@ -0,0 +1,175 @@
+package middleauth_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/yookoala/middleauth"
+)
+
+// rewriteTransport sends all requests to the test server
+type rewriteTransport struct {
+	target *url.URL
+}
+
+func (rt rewriteTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	u := *r.URL
+	u.Scheme, u.Host = rt.target.Scheme, rt.target.Host
+	r = r.WithContext(r.Context())
+	r.URL = &u
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+func TestGoogleHostedDomainAuthUserFactory(t *testing.T) {
+	var userinfo string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(userinfo))
+	}))
+	defer ts.Close()
+	target, _ := url.Parse(ts.URL)
+	client := &http.Client{Transport: rewriteTransport{target}}
+
+	tests := []struct {
+		desc     string
+		domains  []string
+		userinfo string
+		allowed  bool
+		verified bool
+	}{
+		{
+			desc:     "no restriction",
+			userinfo: `{"id": "1", "email": "dummy@gmail.com", "verified_email": true}`,
+			allowed:  true,
+			verified: true,
+		},
+		{
+			desc:     "unverified email",
+			userinfo: `{"id": "1", "email": "dummy@gmail.com", "verified_email": false}`,
+			allowed:  true,
+			verified: false,
+		},
+		{
+			desc:     "blank domains as no restriction",
+			domains:  []string{"", " "},
+			userinfo: `{"id": "1", "email": "dummy@gmail.com", "verified_email": true}`,
+			allowed:  true,
+			verified: true,
+		},
+		{
+			desc:     "account of allowed domain",
+			domains:  []string{"foobar.com", "example.com"},
+			userinfo: `{"id": "1", "email": "dummy@example.com", "hd": "example.com"}`,
+			allowed:  true,
+		},
+		{
+			desc:     "account of allowed domain in mixed case",
+			domains:  []string{" Example.com"},
+			userinfo: `{"id": "1", "email": "dummy@example.com", "hd": "example.com"}`,
+			allowed:  true,
+		},
+		{
+			desc:     "account of other domain",
+			domains:  []string{"foobar.com"},
+			userinfo: `{"id": "1", "email": "dummy@example.com", "hd": "example.com"}`,
+		},
+		{
+			desc:     "personal account with email of allowed domain",
+			domains:  []string{"foobar.com"},
+			userinfo: `{"id": "1", "email": "dummy@foobar.com"}`,
+		},
+	}
+
+	for _, test := range tests {
+		userinfo = test.userinfo
+		_, identity, err := middleauth.GoogleHostedDomainAuthUserFactory(test.domains...)(context.Background(), client)
+		if test.allowed {
+			if err != nil {
+				t.Errorf("[%s] unexpected error: %s", test.desc, err)
+			} else if want, have := "1", identity.ProviderID; want != have {
+				t.Errorf("[%s] expected %#v, got %#v", test.desc, want, have)
+			}
+			if want, have := test.verified, identity.Verified; err == nil && want != have {
+				t.Errorf("[%s] expected %#v, got %#v", test.desc, want, have)
+			}
+			continue
+		}
+		if lerr, ok := err.(*middleauth.LoginError); !ok {
+			t.Errorf("[%s] expected *middleauth.LoginError, got %#v", test.desc, err)
+		} else if want, have := middleauth.ErrHostedDomainNotAllowed, lerr.Type; want != have {
+			t.Errorf("[%s] expected %#v, got %#v", test.desc, want, have)
+		}
+	}
+}
+
+func TestGoogleProviderType_hostedDomain(t *testing.T) {
+	tests := []struct {
+		hostedDomain string
+		hd           string
+	}{
+		{
+			hostedDomain: "",
+			hd:           "",
+		},
+		{
+			hostedDomain: "foobar.com",
+			hd:           "foobar.com",
+		},
+		{
+			hostedDomain: "foobar.com, example.com",
+			hd:           "*",
+		},
+	}
+
+	for _, test := range tests {
+		ctx, _ := middleauth.NewContext("http://foobar.com")
+		getAuthURL := middleauth.GoogleProviderType().AuthURLFactory(middleauth.ProviderSetup{
+			Provider: middleauth.AuthProvider{
+				ID:     "google",
+				Params: map[string]string{"hosted_domain": test.hostedDomain},
+			},
+			Context:     ctx,
+			CallbackURL: "http://foobar.com/login/google/callback",
+			States:      middleauth.NewCookieStateStore("dummy-state", "dummy-key"),
+		})
+
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", "http://foobar.com/login/google", nil)
+		rawurl, err := getAuthURL(w, r)
+		if err != nil {
+			t.Errorf("[%s] unexpected error: %s", test.hostedDomain, err)
+			continue
+		}
+		parsed, _ := url.Parse(rawurl)
+		if want, have := test.hd, parsed.Query().Get("hd"); want != have {
+			t.Errorf("[%s] expected %#v, got %#v", test.hostedDomain, want, have)
+		}
+	}
+}
+
+func TestGoogleProviderType_providerID(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id": "1", "email": "dummy@example.com", "hd": "example.com"}`))
+	}))
+	defer ts.Close()
+	target, _ := url.Parse(ts.URL)
+	client := &http.Client{Transport: rewriteTransport{target}}
+
+	getAuthUser := middleauth.GoogleProviderType().AuthUserDecoder(middleauth.ProviderSetup{
+		Provider: middleauth.AuthProvider{
+			ID:   "google-work",
+			Type: "google",
+		},
+	})
+	_, identity, err := getAuthUser(context.Background(), client)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if want, have := "google-work", identity.Provider; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+}
@@ -0,0 +1,179 @@
+package middleauth
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"golang.org/x/oauth2"
+	"gopkg.in/jose.v1/jws"
+)
+
+// MicrosoftDefaultAuthority is the login endpoint of the
+// Microsoft identity platform (Entra ID / Azure AD) in global cloud.
+const MicrosoftDefaultAuthority = "https://login.microsoftonline.com"
+
+// MicrosoftConsumersTenant is the tenant id of
+// personal Microsoft accounts.
+const MicrosoftConsumersTenant = "9188040d-6c67-4c5b-b112-36a304b66dad"
+
+// microsoftAuthority returns the authority URL and tenant of the provider.
+//
+// The tenant is read from the provider param "tenant". It can be the
+// tenant id or domain for single-tenant login, "common" for both work
+// and personal accounts of any tenant, "organizations" for work accounts
+// of any tenant, or "consumers" for personal accounts. Default "common".
+//
+// The authority is read from the provider param "authority", for
+// national clouds. Default is MicrosoftDefaultAuthority.
+func microsoftAuthority(provider AuthProvider) (authority, tenant string) {
+	if authority = strings.TrimRight(provider.Param("authority"), "/"); authority == "" {
+		authority = MicrosoftDefaultAuthority
+	}
+	if tenant = provider.Param("tenant"); tenant == "" {
+		tenant = "common"
+	}
+	return
+}
+
+// microsoftAllowedTenants returns the tenant ids of the
+// provider param "allowed_tenants", separated by comma.
+func microsoftAllowedTenants(provider AuthProvider) (tenants []string) {
+	for _, tenant := range strings.Split(provider.Param("allowed_tenants"), ",") {
+		if tenant = strings.TrimSpace(tenant); tenant != "" {
+			tenants = append(tenants, strings.ToLower(tenant))
+		}
+	}
+	return
+}
+
+// MicrosoftConfig provides OAuth2 config for Microsoft login
+func MicrosoftConfig(provider AuthProvider, redirectURL string) *oauth2.Config {
+	authority, tenant := microsoftAuthority(provider)
+	return &oauth2.Config{
+		RedirectURL:  redirectURL,
+		ClientID:     provider.ClientID,
+		ClientSecret: provider.ClientSecret,
+		Scopes: []string{
+			"openid",
+			"email",
+			"profile",
+		},
+		Endpoint: oauth2.Endpoint{
+			AuthURL:  authority + "/" + tenant + "/oauth2/v2.0/authorize",
+			TokenURL: authority + "/" + tenant + "/oauth2/v2.0/token",
+		},
+	}
+}
+
+// MicrosoftAuthUserFactory generates an AuthUserDecoder that reads the
+// user identity from the verified ID token of Microsoft login.
+//
+// The tenant of the user (tid claim) must match the single tenant
+// configured, or be one of the provider param "allowed_tenants" if set.
+// Otherwise the login fails with ErrOrganizationNotAllowed.
+func MicrosoftAuthUserFactory(provider AuthProvider) AuthUserDecoder {
+	authority, tenant := microsoftAuthority(provider)
+	keys := newRemoteKeySet(authority + "/" + tenant + "/discovery/v2.0/keys")
+	keys.provider = provider.ID
+	allowedTenants := microsoftAllowedTenants(provider)
+
+	// restrict to the tenant of single-tenant login
+	switch tenant {
+	case "common", "organizations":
+	case "consumers":
+		allowedTenants = append(allowedTenants, MicrosoftConsumersTenant)
+	default:
+		if !strings.Contains(tenant, ".") {
+			allowedTenants = append(allowedTenants, strings.ToLower(tenant))
+		}
+	}
+
+	return func(ctx context.Context, client *http.Client) (ctxNext context.Context, authIdentity *UserIdentity, err error) {
+
+		claims, err := verifyLoginIDToken(ctx, func(ctx context.Context, raw, nonce string) (claims jws.Claims, err error) {
+			if claims, err = keys.verify(ctx, raw); err != nil {
+				return
+			}
+			if err = checkIDTokenClaims(claims, provider.ClientID, nonce); err != nil {
+				return nil, err
+			}
+			// issuer of multi-tenant endpoints is specific to the user's tenant
+			tid, _ := claims.Get("tid").(string)
+			if iss, _ := claims.Issuer(); tid == "" || iss != authority+"/"+tid+"/v2.0" {
+				return nil, fmt.Errorf("unexpected issuer %#v", iss)
+			}
+			return
+		})
+		if err != nil {
+			return
+		}
+
+		// read into
+		/*
+			// NOTE: JSON structure of ID token claims (partial)
+			{
+			  "iss": "https://login.microsoftonline.com/{tid}/v2.0",
+			  "aud": "client-id",
+			  "exp": 1311281970,
+			  "nonce": "login-nonce",
+			  "tid": "tenant-id",
+			  "oid": "object-id-of-user-in-tenant",
+			  "sub": "pairwise-subject",
+			  "name": "user display name",
+			  "preferred_username": "user@contoso.com",
+			  "email": "email address"
+			}
+		*/
+		tid, _ := claims.Get("tid").(string)
+		if len(allowedTenants) > 0 && !stringInSlice(strings.ToLower(tid), allowedTenants) {
+			err = &LoginError{
+				Type:   ErrOrganizationNotAllowed,
+				Action: "check tenant",
+				Err:    fmt.Errorf("tenant %#v is not allowed", tid),
+			}
+			return
+		}
+
+		oid, _ := claims.Get("oid").(string)
+		if oid == "" {
+			err = &LoginError{
+				Type:   ErrNoProviderID,
+				Action: "read oid",
+				Err:    fmt.Errorf("oid not found in id_token"),
+			}
+			return
+		}
+		authIdentity = &UserIdentity{
+			Type:       "oidc",
+			Provider:   provider.ID,
+			ProviderID: oid,
+		}
+		authIdentity.Name, _ = claims.Get("name").(string)
+		if authIdentity.PrimaryEmail, _ = claims.Get("email").(string); authIdentity.PrimaryEmail == "" {
+			authIdentity.PrimaryEmail, _ = claims.Get("preferred_username").(string)
+		}
+
+		// Microsoft does not verify the email claim,
+		// so Verified is left false.
+
+		ctxNext = ctx
+		return
+	}
+}
+
+// MicrosoftProviderType creates a ProviderType for Microsoft login.
+// The tenant configuration is read from the provider params "tenant",
+// "allowed_tenants" and "authority".
+func MicrosoftProviderType() ProviderType {
+	providerType := OAuth2ProviderType(
+		"Microsoft",
+		MicrosoftConfig,
+		MicrosoftAuthUserFactory,
+		WithPKCE(),
+		WithNonce(),
+	)
+	providerType.Params = []string{"tenant", "allowed_tenants", "authority"}
+	return providerType
+}
@@ -0,0 +1,215 @@
+package middleauth_test
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/yookoala/middleauth"
+	"golang.org/x/oauth2"
+	"gopkg.in/jose.v1/jws"
+)
+
+func TestMicrosoftConfig(t *testing.T) {
+	conf := middleauth.MicrosoftConfig(middleauth.AuthProvider{}, "http://foobar.com/callback")
+	if want, have := "https://login.microsoftonline.com/common/oauth2/v2.0/authorize", conf.Endpoint.AuthURL; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+
+	conf = middleauth.MicrosoftConfig(middleauth.AuthProvider{
+		Params: map[string]string{"tenant": "organizations"},
+	}, "http://foobar.com/callback")
+	if want, have := "https://login.microsoftonline.com/organizations/oauth2/v2.0/token", conf.Endpoint.TokenURL; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+}
+
+func TestMicrosoftAuthUserFactory(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(middleauth.JSONWebKeySet{
+			Keys: []middleauth.JSONWebKey{
+				{
+					KeyType: "RSA",
+					KeyID:   "dummy-key",
+					N:       base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+					E:       base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+				},
+			},
+		})
+	}))
+	defer ts.Close()
+
+	signer := &testOIDCIssuer{}
+	idToken := func(tid string, modify func(jws.Claims)) string {
+		claims := jws.Claims{
+			"iss":   ts.URL + "/" + tid + "/v2.0",
+			"aud":   "dummy-client",
+			"exp":   time.Now().Add(time.Minute).Unix(),
+			"nonce": "dummy-nonce",
+			"tid":   tid,
+			"oid":   "dummy-oid",
+			"sub":   "dummy-subject",
+			"name":  "dummy user",
+			"email": "dummy@foobar.com",
+		}
+		if modify != nil {
+			modify(claims)
+		}
+		return signer.sign(t, "dummy-key", key, claims)
+	}
+	loginContext := func(raw string) context.Context {
+		ctx := middleauth.WithLoginState(context.Background(), &middleauth.LoginState{Nonce: "dummy-nonce"})
+		token := (&oauth2.Token{AccessToken: "dummy-access-token"}).WithExtra(map[string]interface{}{
+			"id_token": raw,
+		})
+		return middleauth.WithOAuth2Token(ctx, token)
+	}
+
+	tests := []struct {
+		desc    string
+		params  map[string]string
+		raw     string
+		errType middleauth.LoginErrorType
+	}{
+		{
+			desc: "multi-tenant",
+			raw:  idToken("tenant-a", nil),
+		},
+		{
+			desc:   "allowed tenant",
+			params: map[string]string{"tenant": "organizations", "allowed_tenants": "tenant-a, tenant-b"},
+			raw:    idToken("tenant-b", nil),
+		},
+		{
+			desc:    "tenant not in allowlist",
+			params:  map[string]string{"tenant": "organizations", "allowed_tenants": "tenant-a, tenant-b"},
+			raw:     idToken("tenant-c", nil),
+			errType: middleauth.ErrOrganizationNotAllowed,
+		},
+		{
+			desc:   "single tenant",
+			params: map[string]string{"tenant": "tenant-a"},
+			raw:    idToken("tenant-a", nil),
+		},
+		{
+			desc:    "other tenant of single-tenant login",
+			params:  map[string]string{"tenant": "tenant-a"},
+			raw:     idToken("tenant-b", nil),
+			errType: middleauth.ErrOrganizationNotAllowed,
+		},
+		{
+			desc: "issuer of other tenant",
+			raw: idToken("tenant-a", func(c jws.Claims) {
+				c.Set("iss", ts.URL+"/tenant-b/v2.0")
+			}),
+			errType: middleauth.ErrInvalidIDToken,
+		},
+		{
+			desc: "wrong nonce",
+			raw: idToken("tenant-a", func(c jws.Claims) {
+				c.Set("nonce", "other-nonce")
+			}),
+			errType: middleauth.ErrInvalidIDToken,
+		},
+		{
+			desc: "no oid",
+			raw: idToken("tenant-a", func(c jws.Claims) {
+				c.Del("oid")
+			}),
+			errType: middleauth.ErrNoProviderID,
+		},
+	}
+
+	for _, test := range tests {
+		params := map[string]string{"authority": ts.URL}
+		for name, value := range test.params {
+			params[name] = value
+		}
+		provider := middleauth.AuthProvider{
+			ID:       "microsoft",
+			ClientID: "dummy-client",
+			Params:   params,
+		}
+		_, identity, err := middleauth.MicrosoftAuthUserFactory(provider)(loginContext(test.raw), http.DefaultClient)
+		if test.errType != middleauth.ErrUnknown {
+			if lerr, ok := err.(*middleauth.LoginError); !ok {
+				t.Errorf("[%s] expected *middleauth.LoginError, got %#v", test.desc, err)
+			} else if want, have := test.errType, lerr.Type; want != have {
+				t.Errorf("[%s] expected %#v, got %#v", test.desc, want, have)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("[%s] unexpected error: %s", test.desc, err)
+			continue
+		}
+		if want, have := "dummy-oid", identity.ProviderID; want != have {
+			t.Errorf("[%s] expected %#v, got %#v", test.desc, want, have)
+		}
+		if want, have := "dummy@foobar.com", identity.PrimaryEmail; want != have {
+			t.Errorf("[%s] expected %#v, got %#v", test.desc, want, have)
+		}
+	}
+}
+
+func TestMicrosoftAuthUserFactory_providerError(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("maintenance"))
+	}))
+	defer ts.Close()
+
+	raw := (&testOIDCIssuer{}).sign(t, "dummy-key", key, jws.Claims{
+		"iss": ts.URL + "/tenant-a/v2.0",
+		"aud": "dummy-client",
+		"exp": time.Now().Add(time.Minute).Unix(),
+		"tid": "tenant-a",
+		"oid": "dummy-oid",
+	})
+	token := (&oauth2.Token{AccessToken: "dummy-access-token"}).WithExtra(map[string]interface{}{
+		"id_token": raw,
+	})
+	provider := middleauth.AuthProvider{
+		ID:       "corp-microsoft",
+		Type:     "microsoft",
+		ClientID: "dummy-client",
+		Params:   map[string]string{"authority": ts.URL},
+	}
+	_, identity, err := middleauth.MicrosoftAuthUserFactory(provider)(
+		middleauth.WithOAuth2Token(context.Background(), token),
+		http.DefaultClient,
+	)
+
+	if identity != nil {
+		t.Errorf("expected nil identity, got %#v", identity)
+	}
+	perr, ok := err.(*middleauth.ProviderError)
+	if !ok {
+		t.Fatalf("expected *middleauth.ProviderError, got %#v", err)
+	}
+	if want, have := "corp-microsoft", perr.Provider; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+	if want, have := http.StatusServiceUnavailable, perr.StatusCode; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+	if want, have := "maintenance", perr.Body; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+}
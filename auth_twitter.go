@@ -4,44 +4,9 @@ import (
 	"context"
 	"net/http"
 
-	"github.com/sirupsen/logrus"
-	"github.com/go-restit/lzjson"
 	"github.com/mrjones/oauth"
 )
 
-// TokenStore is the interface for token storage facility
-// for temporary token storage and mapping in OAuth1.0a
-type TokenStore interface {
-	Save(token *oauth.RequestToken)
-	Consume(tokenKey string) (token *oauth.RequestToken)
-}
-
-// NewTokenStore creates a simple local implementation of token store
-func NewTokenStore() TokenStore {
-	return tokenStore(make(map[string]*oauth.RequestToken, 1024))
-}
-
-// tokenStore stores OAuth1.0a request token
-// temporarily to a map of the token field
-type tokenStore map[string]*oauth.RequestToken
-
-// Save stores a copy of token in a map by token key
-func (tokens tokenStore) Save(token *oauth.RequestToken) {
-	tokens[token.Token] = token
-}
-
-// Consume remove a token, if exists, from the token store
-// and return the just removed token.
-func (tokens tokenStore) Consume(tokenKey string) (token *oauth.RequestToken) {
-	// TODO: add mutex lock mechanism
-	// TODO: make this a distributed storage
-	token, ok := tokens[tokenKey]
-	if ok {
-		delete(tokens, tokenKey)
-	}
-	return
-}
-
 // TwitterConsumer provides OAuth config for twitter login
 func TwitterConsumer(provider AuthProvider) *oauth.Consumer {
 	return oauth.NewConsumer(
@@ -57,18 +22,18 @@ func TwitterConsumer(provider AuthProvider) *oauth.Consumer {
 
 // TwitterAuthUserFactory implements ProviderAuthUserFactory
 func TwitterAuthUserFactory(ctx context.Context, client *http.Client) (ctxNext context.Context, authIdentity *UserIdentity, err error) {
-	resp, err := client.Get(
+	return twitterAuthUser(ctx, client, "twitter")
+}
+
+// twitterAuthUser reads the user identity of the Twitter provider of the id
+func twitterAuthUser(ctx context.Context, client *http.Client, providerID string) (ctxNext context.Context, authIdentity *UserIdentity, err error) {
+	result, err := getJSON(client, providerID,
 		"https://api.twitter.com/1.1/account/verify_credentials.json?include_email=true&skip_status")
 	if err != nil {
-		logrus.WithFields(logrus.Fields{
-			"error": err.Error(),
-		}).Error("failed to retrieve verified credentials")
 		return
 	}
-	defer resp.Body.Close()
 
 	// read into
-	result := lzjson.Decode(resp.Body)
 	/*
 		// NOTE: JSON structure of normal response body
 		{
@@ -114,13 +79,14 @@ func TwitterAuthUserFactory(ctx context.Context, client *http.Client) (ctxNext c
 		}
 	*/
 
-	// TODO: detect read  / decode error
-	// TODO: check if the email has been verified or not
+	// Twitter only returns the email if it is verified
+	email := result.Get("email").String()
 	authIdentity = &UserIdentity{
 		Name:         result.Get("name").String(),
-		PrimaryEmail: result.Get("email").String(),
+		PrimaryEmail: email,
+		Verified:     email != "",
 		Type:         "oauth1.0a",
-		Provider:     "twitter",
+		Provider:     providerID,
 		ProviderID:   result.Get("id_str").String(),
 	}
 	ctxNext = ctx
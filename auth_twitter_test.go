@@ -0,0 +1,60 @@
+package middleauth_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/yookoala/middleauth"
+)
+
+func TestTwitterAuthUserFactory(t *testing.T) {
+	var credentials string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(credentials))
+	}))
+	defer ts.Close()
+	target, _ := url.Parse(ts.URL)
+	client := &http.Client{Transport: rewriteTransport{target}}
+
+	tests := []struct {
+		desc        string
+		credentials string
+		email       string
+		verified    bool
+	}{
+		{
+			desc:        "verified email",
+			credentials: `{"id": 38895958, "id_str": "38895958", "name": "Sean Cook", "email": "sean.cook@email.com"}`,
+			email:       "sean.cook@email.com",
+			verified:    true,
+		},
+		{
+			desc:        "no verified email",
+			credentials: `{"id": 38895958, "id_str": "38895958", "name": "Sean Cook"}`,
+			email:       "",
+			verified:    false,
+		},
+	}
+
+	for _, test := range tests {
+		credentials = test.credentials
+		_, identity, err := middleauth.TwitterAuthUserFactory(context.Background(), client)
+		if err != nil {
+			t.Errorf("[%s] unexpected error: %s", test.desc, err)
+			continue
+		}
+		if want, have := "38895958", identity.ProviderID; want != have {
+			t.Errorf("[%s] expected %#v, got %#v", test.desc, want, have)
+		}
+		if want, have := test.email, identity.PrimaryEmail; want != have {
+			t.Errorf("[%s] expected %#v, got %#v", test.desc, want, have)
+		}
+		if want, have := test.verified, identity.Verified; want != have {
+			t.Errorf("[%s] expected %#v, got %#v", test.desc, want, have)
+		}
+	}
+}
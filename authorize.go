@@ -0,0 +1,143 @@
+package middleauth
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/go-midway/midway"
+)
+
+// AuthzOption configures the responses of the authorization
+// middlewares (e.g. RequireUser).
+type AuthzOption func(opts *authzOptions)
+
+// authzOptions contains the authorization middleware options
+type authzOptions struct {
+	unauthorized http.Handler
+	forbidden    http.Handler
+}
+
+// WithUnauthorized sets the handler to respond to requests without
+// a session user. Defaults to LoginRedirect of the Context.
+func WithUnauthorized(handler http.Handler) AuthzOption {
+	return func(opts *authzOptions) {
+		opts.unauthorized = handler
+	}
+}
+
+// WithForbidden sets the handler to respond to requests of a session
+// user that is not allowed. Defaults to Forbidden.
+func WithForbidden(handler http.Handler) AuthzOption {
+	return func(opts *authzOptions) {
+		opts.forbidden = handler
+	}
+}
+
+// LoginRedirect creates a handler that redirects browsers to the
+// auth URL of the context, with the requested URL as "return_to".
+// API clients, which do not accept HTML, get 401 Unauthorized.
+//
+// The requested URL is built on the PublicURL. The request path is
+// taken as is if it is within the PublicURL path, or is joined to the
+// PublicURL path if not (i.e. behind a proxy that strips the prefix).
+func LoginRedirect(ctx *Context) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !acceptsHTML(r) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte("unauthorized"))
+			return
+		}
+		returnTo := *ctx.PublicURL
+		returnTo.Path = publicPath(ctx.PublicURL.Path, r.URL.Path)
+		returnTo.RawPath = ""
+		returnTo.RawQuery = r.URL.RawQuery
+		returnTo.Fragment = ""
+
+		authURL := ctx.AuthURL()
+		q := url.Values{}
+		q.Add("return_to", returnTo.String())
+		authURL.RawQuery = q.Encode()
+		http.Redirect(w, r, authURL.String(), http.StatusFound)
+	})
+}
+
+// publicPath returns the public path of the request path. The base
+// path is prepended unless the request path is already within it.
+func publicPath(basePath, reqPath string) string {
+	basePath = strings.TrimRight(basePath, "/")
+	reqPath = ensureLeadingSlash(reqPath)
+	if reqPath == basePath {
+		return basePath + "/"
+	}
+	if strings.HasPrefix(reqPath, basePath+"/") {
+		return reqPath
+	}
+	return basePath + reqPath
+}
+
+// Forbidden responds with 403 Forbidden
+func Forbidden(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusForbidden)
+	w.Write([]byte("forbidden"))
+}
+
+// acceptsHTML tells if the request is from a browser
+// that expects a HTML page
+func acceptsHTML(r *http.Request) bool {
+	if r.Header.Get("X-Requested-With") == "XMLHttpRequest" {
+		return false
+	}
+	return strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+// RequireUserFunc creates a middleware that only allows requests of
+// a session user (see SessionMiddleware) with allow(user) returning
+// true. Requests without a user are passed to the unauthorized handler,
+// and those of a user not allowed to the forbidden handler.
+func RequireUserFunc(ctx *Context, allow func(user *User) bool, opts ...AuthzOption) midway.Middleware {
+	options := &authzOptions{
+		unauthorized: LoginRedirect(ctx),
+		forbidden:    http.HandlerFunc(Forbidden),
+	}
+	for _, opt := range opts {
+		opt(options)
+	}
+	return func(inner http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user := GetUser(r.Context())
+			if user == nil {
+				options.unauthorized.ServeHTTP(w, r)
+				return
+			}
+			if allow != nil && !allow(user) {
+				options.forbidden.ServeHTTP(w, r)
+				return
+			}
+			inner.ServeHTTP(w, r)
+		})
+	}
+}
+
+// RequireUser creates a middleware that only allows requests
+// of a session user. See RequireUserFunc.
+func RequireUser(ctx *Context, opts ...AuthzOption) midway.Middleware {
+	return RequireUserFunc(ctx, nil, opts...)
+}
+
+// RequireAdmin creates a middleware that only allows requests
+// of a session user who is admin. See RequireUserFunc.
+func RequireAdmin(ctx *Context, opts ...AuthzOption) midway.Middleware {
+	return RequireUserFunc(ctx, func(user *User) bool {
+		return user.IsAdmin
+	}, opts...)
+}
+
+// RequireVerified creates a middleware that only allows requests
+// of a session user with verified primary email. See RequireUserFunc.
+func RequireVerified(ctx *Context, opts ...AuthzOption) midway.Middleware {
+	return RequireUserFunc(ctx, func(user *User) bool {
+		return user.Verified
+	}, opts...)
+}
@@ -0,0 +1,170 @@
+package middleauth_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/go-midway/midway"
+	"github.com/yookoala/middleauth"
+)
+
+func TestRequireUser(t *testing.T) {
+	ctx, _ := middleauth.NewContext("http://foobar.com/")
+	ctx.AuthPath = "/login"
+
+	inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	})
+	withUser := func(user *middleauth.User) midway.Middleware {
+		return func(inner http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				inner.ServeHTTP(w, r.WithContext(middleauth.WithUser(r.Context(), user)))
+			})
+		}
+	}
+
+	tests := []struct {
+		desc     string
+		mware    midway.Middleware
+		user     *middleauth.User
+		accept   string
+		code     int
+		location string
+	}{
+		{
+			desc:     "browser without user",
+			mware:    middleauth.RequireUser(ctx),
+			accept:   "text/html,application/xhtml+xml",
+			code:     http.StatusFound,
+			location: "http://foobar.com/login?return_to=http%3A%2F%2Ffoobar.com%2Fdashboard%3Ftab%3D1",
+		},
+		{
+			desc:   "api client without user",
+			mware:  middleauth.RequireUser(ctx),
+			accept: "application/json",
+			code:   http.StatusUnauthorized,
+		},
+		{
+			desc:  "user",
+			mware: middleauth.RequireUser(ctx),
+			user:  &middleauth.User{ID: "user-1"},
+			code:  http.StatusOK,
+		},
+		{
+			desc:   "admin without user",
+			mware:  middleauth.RequireAdmin(ctx),
+			accept: "application/json",
+			code:   http.StatusUnauthorized,
+		},
+		{
+			desc:  "admin with non-admin user",
+			mware: middleauth.RequireAdmin(ctx),
+			user:  &middleauth.User{ID: "user-1"},
+			code:  http.StatusForbidden,
+		},
+		{
+			desc:  "admin with admin user",
+			mware: middleauth.RequireAdmin(ctx),
+			user:  &middleauth.User{ID: "user-1", IsAdmin: true},
+			code:  http.StatusOK,
+		},
+		{
+			desc:  "verified with unverified user",
+			mware: middleauth.RequireVerified(ctx),
+			user:  &middleauth.User{ID: "user-1"},
+			code:  http.StatusForbidden,
+		},
+		{
+			desc:  "verified with verified user",
+			mware: middleauth.RequireVerified(ctx),
+			user:  &middleauth.User{ID: "user-1", Verified: true},
+			code:  http.StatusOK,
+		},
+		{
+			desc: "composed with custom responders",
+			mware: midway.Chain(
+				middleauth.RequireVerified(ctx),
+				middleauth.RequireAdmin(ctx, middleauth.WithForbidden(
+					http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+						w.WriteHeader(http.StatusNotFound)
+					}),
+				)),
+			),
+			user: &middleauth.User{ID: "user-1", Verified: true},
+			code: http.StatusNotFound,
+		},
+	}
+
+	for _, test := range tests {
+		handler := withUser(test.user)(test.mware(inner))
+		r := httptest.NewRequest("GET", "/dashboard?tab=1", nil)
+		if test.accept != "" {
+			r.Header.Set("Accept", test.accept)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		if want, have := test.code, w.Code; want != have {
+			t.Errorf("[%s] expected %#v, got %#v", test.desc, want, have)
+		}
+		if want, have := test.location, w.Header().Get("Location"); want != have {
+			t.Errorf("[%s] expected %#v, got %#v", test.desc, want, have)
+		}
+	}
+}
+
+func TestLoginRedirect_publicURLPath(t *testing.T) {
+	ctx, _ := middleauth.NewContext("https://foobar.com/app/")
+	ctx.AuthPath = "/login"
+
+	tests := []struct {
+		desc     string
+		path     string
+		returnTo string
+	}{
+		{
+			desc:     "path prefix stripped by proxy",
+			path:     "/dashboard?tab=1",
+			returnTo: "https://foobar.com/app/dashboard?tab=1",
+		},
+		{
+			desc:     "path prefix not stripped",
+			path:     "/app/dashboard?tab=1",
+			returnTo: "https://foobar.com/app/dashboard?tab=1",
+		},
+		{
+			desc:     "path of public url",
+			path:     "/app",
+			returnTo: "https://foobar.com/app/",
+		},
+		{
+			desc:     "path with the prefix as substring",
+			path:     "/application",
+			returnTo: "https://foobar.com/app/application",
+		},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", test.path, nil)
+		r.Header.Set("Accept", "text/html")
+		w := httptest.NewRecorder()
+		middleauth.LoginRedirect(ctx).ServeHTTP(w, r)
+
+		location, err := url.Parse(w.Header().Get("Location"))
+		if err != nil {
+			t.Fatalf("[%s] unexpected error: %s", test.desc, err)
+		}
+		if want, have := "/app/login", location.Path; want != have {
+			t.Errorf("[%s] expected %#v, got %#v", test.desc, want, have)
+		}
+		returnTo := location.Query().Get("return_to")
+		if want, have := test.returnTo, returnTo; want != have {
+			t.Errorf("[%s] expected %#v, got %#v", test.desc, want, have)
+		}
+		if _, ok := ctx.ReturnURL(returnTo); !ok {
+			t.Errorf("[%s] expected %#v to be allowed", test.desc, returnTo)
+		}
+	}
+}
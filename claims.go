@@ -0,0 +1,40 @@
+package middleauth
+
+import (
+	"context"
+	"fmt"
+
+	"gopkg.in/jose.v1/jws"
+)
+
+// ClaimsEnricher adds custom claims, such as roles or tenant, to the
+// claims of session token of the confirmed user. The context is the
+// one passed to the CookieFactory.
+//
+// The registered claims (e.g. "sub", "exp") and the "id" claim are
+// set after the enrichers and cannot be overridden.
+type ClaimsEnricher func(ctx context.Context, claims jws.Claims, confirmedUser *User) error
+
+// AdminClaim is a ClaimsEnricher that adds the "is_admin"
+// claim of the user.
+func AdminClaim(ctx context.Context, claims jws.Claims, confirmedUser *User) error {
+	claims.Set("is_admin", confirmedUser.IsAdmin)
+	return nil
+}
+
+// UserFromClaims implements RetrieveUser. It reads the user from
+// the session claims in the context, as decoded by the JWT session
+// decoders, without looking up the user storage.
+//
+// Only ID, Name and IsAdmin (if the session is issued with
+// AdminClaim) are available in the user.
+func UserFromClaims(ctx context.Context, id string) (*User, error) {
+	claims := GetSessionClaims(ctx)
+	if claims == nil {
+		return nil, fmt.Errorf("no session claims found in context")
+	}
+	user := &User{ID: id}
+	user.Name, _ = claims.Get("name").(string)
+	user.IsAdmin = claimBool(claims.Get("is_admin"))
+	return user, nil
+}
@@ -1,8 +1,13 @@
 package middleauth
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
+	"os"
 	"strings"
+
+	"github.com/sirupsen/logrus"
 )
 
 // AuthProvider defines a login provider in details
@@ -10,57 +15,197 @@ type AuthProvider struct {
 
 	// ID is the unique identifier among providers that
 	// also used in the callback path.
-	ID string
+	ID string `json:"id"`
 
 	// Name is the human readable name
 	// for frontend display, such as the login page buttons.
-	Name string
+	Name string `json:"name,omitempty"`
+
+	// Type is the id of the ProviderType in the registry
+	// to build the login flow with. If empty, ID is used.
+	Type string `json:"type,omitempty"`
 
 	// ClientID is the OAuth client ID from the provider.
-	ClientID string
+	ClientID string `json:"client_id"`
 
 	// ClientID is the OAuth client secret from the provider.
-	ClientSecret string
+	ClientSecret string `json:"client_secret"`
+
+	// Params contains provider specific parameters, such as
+	// the issuer URL of an OpenID Connect provider.
+	Params map[string]string `json:"params,omitempty"`
+}
+
+// TypeID returns the id of ProviderType for the provider
+func (provider AuthProvider) TypeID() string {
+	if provider.Type == "" {
+		return provider.ID
+	}
+	return provider.Type
 }
 
-// EnvProviders gets login providers from environment
+// Param returns the provider specific parameter of the name
+func (provider AuthProvider) Param(name string) string {
+	return provider.Params[name]
+}
+
+// EnvProviders gets login providers of the types
+// in DefaultRegistry from environment
 func EnvProviders(getEnv func(string) string) (providers []AuthProvider) {
-	providers = make([]AuthProvider, 0, 4)
-	protoProviders := []AuthProvider{
-		{
-			ID:   "google",
-			Name: "Google",
-		},
-		{
-			ID:   "facebook",
-			Name: "Facebook",
-		},
-		{
-			ID:   "twitter",
-			Name: "Twitter",
-		},
-		{
-			ID:   "github",
-			Name: "Github",
-		},
+	return DefaultRegistry.EnvProviders(getEnv)
+}
+
+// EnvProviders gets login providers of the registered types from
+// environment. Providers of the type id are defined if both
+// OAUTH2_{ID}_CLIENT_ID and OAUTH2_{ID}_CLIENT_SECRET are found.
+// Parameters of the type are read from OAUTH2_{ID}_{PARAM}.
+//
+// Additional providers can be defined with a comma separated list
+// of ids in OAUTH2_PROVIDERS. Their type is read from OAUTH2_{ID}_TYPE
+// (default "oauth2") and name from OAUTH2_{ID}_NAME. Providers can also
+// be defined in a JSON file (see LoadProviders) at the path in
+// OAUTH2_PROVIDERS_FILE.
+func (reg *ProviderRegistry) EnvProviders(getEnv func(string) string) (providers []AuthProvider) {
+	ids := reg.IDs()
+	providers = make([]AuthProvider, 0, len(ids))
+	defined := make(map[string]bool)
+	add := func(provider AuthProvider) {
+		if defined[provider.ID] {
+			logrus.WithFields(logrus.Fields{
+				"provider.id": provider.ID,
+			}).Warn("provider already defined")
+			return
+		}
+		defined[provider.ID] = true
+		providers = append(providers, provider)
 	}
 
-	// read client id and key from environment
-	var clientIDKey, clientSecretKey string
-	for _, provider := range protoProviders {
-		clientIDKey = fmt.Sprintf("OAUTH2_%s_CLIENT_ID", strings.ToUpper(provider.ID))
-		clientSecretKey = fmt.Sprintf("OAUTH2_%s_CLIENT_SECRET", strings.ToUpper(provider.ID))
-		if clientID, clientSecret := getEnv(clientIDKey), getEnv(clientSecretKey); clientID != "" && clientSecret != "" {
-			provider.ClientID, provider.ClientSecret = clientID, clientSecret
-			providers = append(
-				providers,
-				provider,
-			)
+	// providers of the registered type ids
+	for _, id := range ids {
+		if provider, ok := reg.envProvider(getEnv, id, ""); ok {
+			add(provider)
+		}
+	}
+
+	// providers listed in OAUTH2_PROVIDERS
+	for _, id := range strings.Split(getEnv("OAUTH2_PROVIDERS"), ",") {
+		if id = strings.TrimSpace(id); id == "" {
+			continue
+		}
+		typeID := getEnv(envKey(id, "TYPE"))
+		if typeID == "" {
+			typeID = "oauth2"
+		}
+		if provider, ok := reg.envProvider(getEnv, id, typeID); ok {
+			add(provider)
+		}
+	}
+
+	// providers in OAUTH2_PROVIDERS_FILE
+	if filename := getEnv("OAUTH2_PROVIDERS_FILE"); filename != "" {
+		fileProviders, err := reg.fileProviders(filename)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error":    err.Error(),
+				"filename": filename,
+			}).Error("failed to load providers file")
+		}
+		for _, provider := range fileProviders {
+			add(provider)
 		}
 	}
 	return
 }
 
+// envProvider reads the provider of the given id and type id
+// from environment. If typeID is empty, id is the type id.
+func (reg *ProviderRegistry) envProvider(getEnv func(string) string, id, typeID string) (provider AuthProvider, ok bool) {
+	providerType, found := reg.Find(id)
+	if typeID != "" {
+		providerType, found = reg.Find(typeID)
+	}
+	if !found {
+		logrus.WithFields(logrus.Fields{
+			"provider.id":   id,
+			"provider.type": typeID,
+		}).Warn("provider type not registered")
+		return
+	}
+
+	clientID, clientSecret := getEnv(envKey(id, "CLIENT_ID")), getEnv(envKey(id, "CLIENT_SECRET"))
+	if clientID == "" || clientSecret == "" {
+		return
+	}
+	provider = AuthProvider{
+		ID:           id,
+		Name:         getEnv(envKey(id, "NAME")),
+		Type:         typeID,
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+	}
+	if provider.Name == "" {
+		provider.Name = providerType.Name
+	}
+	for _, param := range providerType.Params {
+		if value := getEnv(envKey(id, param)); value != "" {
+			if provider.Params == nil {
+				provider.Params = make(map[string]string)
+			}
+			provider.Params[param] = value
+		}
+	}
+	ok = true
+	return
+}
+
+// fileProviders loads the providers of registered types from file
+func (reg *ProviderRegistry) fileProviders(filename string) (providers []AuthProvider, err error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	if providers, err = LoadProviders(file); err != nil {
+		return
+	}
+	providers = reg.Providers(providers)
+	return
+}
+
+// LoadProviders decodes a JSON array of provider definitions.
+// For example:
+//
+//	[
+//	  {
+//	    "id": "corp",
+//	    "name": "Corp Login",
+//	    "type": "oauth2",
+//	    "client_id": "some-client-id",
+//	    "client_secret": "some-client-secret",
+//	    "params": {
+//	      "auth_url": "https://sso.corp.com/oauth2/authorize",
+//	      "token_url": "https://sso.corp.com/oauth2/token",
+//	      "userinfo_url": "https://sso.corp.com/oauth2/userinfo",
+//	      "scopes": "profile email",
+//	      "id_field": "user.id"
+//	    }
+//	  }
+//	]
+func LoadProviders(r io.Reader) (providers []AuthProvider, err error) {
+	err = json.NewDecoder(r).Decode(&providers)
+	return
+}
+
+// envKey returns the environment variable name
+// of the given provider id and parameter name
+func envKey(id, name string) string {
+	return fmt.Sprintf(
+		"OAUTH2_%s_%s",
+		strings.ToUpper(strings.Replace(id, "-", "_", -1)),
+		strings.ToUpper(name),
+	)
+}
+
 // FindProvider find provider of given ID, or return nil
 func FindProvider(id string, providers []AuthProvider) *AuthProvider {
 	for _, provider := range providers {
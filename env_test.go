@@ -2,6 +2,8 @@ package middleauth_test
 
 import (
 	"fmt"
+	"io/ioutil"
+	"os"
 	"strings"
 	"testing"
 
@@ -91,6 +93,14 @@ func TestEnvProviders(t *testing.T) {
 			getEnv: genGetEnv("github"),
 			ids:    []string{"github"},
 		},
+		{
+			getEnv: genGetEnv("gitlab"),
+			ids:    []string{"gitlab"},
+		},
+		{
+			getEnv: genGetEnv("microsoft"),
+			ids:    []string{"microsoft"},
+		},
 		{
 			getEnv: chainGetEnv(genGetEnv("google"), genGetEnv("github")),
 			ids:    []string{"google", "github"},
@@ -139,3 +149,89 @@ func TestFindProvider(t *testing.T) {
 		t.Errorf("expected nil, got %#v", found)
 	}
 }
+
+func TestEnvProviders_generic(t *testing.T) {
+	file, err := ioutil.TempFile("", "providers-*.json")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.Remove(file.Name())
+	fmt.Fprint(file, `[
+		{
+			"id": "file-corp",
+			"type": "oauth2",
+			"client_id": "file-client",
+			"client_secret": "file-secret",
+			"params": {"auth_url": "https://file.corp.com/auth"}
+		},
+		{"id": "unknown", "type": "unknown"},
+		{"id": "env-corp", "type": "oauth2"}
+	]`)
+	file.Close()
+
+	env := map[string]string{
+		"OAUTH2_PROVIDERS":               "env-corp, dummy",
+		"OAUTH2_PROVIDERS_FILE":          file.Name(),
+		"OAUTH2_ENV_CORP_NAME":           "Corp Login",
+		"OAUTH2_ENV_CORP_CLIENT_ID":      "env-client",
+		"OAUTH2_ENV_CORP_CLIENT_SECRET":  "env-secret",
+		"OAUTH2_ENV_CORP_AUTH_URL":       "https://env.corp.com/auth",
+		"OAUTH2_ENV_CORP_USERINFO_URL":   "https://env.corp.com/userinfo",
+		"OAUTH2_ENV_CORP_EMAIL_FIELD":    "user.email",
+		"OAUTH2_DUMMY_TYPE":              "unknown",
+		"OAUTH2_DUMMY_CLIENT_ID":         "dummy-client",
+		"OAUTH2_DUMMY_CLIENT_SECRET":     "dummy-secret",
+		"OAUTH2_FILE_CORP_CLIENT_ID":     "not-used",
+		"OAUTH2_FILE_CORP_CLIENT_SECRET": "not-used",
+	}
+	providers := middleauth.EnvProviders(func(key string) string {
+		return env[key]
+	})
+	if want, have := []string{"env-corp", "file-corp"}, mapProviderID(providers); strings.Join(want, ",") != strings.Join(have, ",") {
+		t.Fatalf("expected %#v, got %#v", want, have)
+	}
+
+	envCorp := providers[0]
+	if want, have := "oauth2", envCorp.TypeID(); want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+	if want, have := "Corp Login", envCorp.Name; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+	if want, have := "env-client", envCorp.ClientID; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+	if want, have := "user.email", envCorp.Param("email_field"); want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+
+	fileCorp := providers[1]
+	if want, have := "OAuth2", fileCorp.Name; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+	if want, have := "file-client", fileCorp.ClientID; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+	if want, have := "https://file.corp.com/auth", fileCorp.Param("auth_url"); want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+}
+
+func TestEnvProviders_gitlabBaseURL(t *testing.T) {
+	getEnv := chainGetEnv(
+		genGetEnv("gitlab"),
+		func(key string) string {
+			if key == "OAUTH2_GITLAB_BASE_URL" {
+				return "https://git.foobar.com"
+			}
+			return ""
+		},
+	)
+	provider := middleauth.FindProvider("gitlab", middleauth.EnvProviders(getEnv))
+	if provider == nil {
+		t.Fatalf("expected gitlab provider, got nil")
+	}
+	if want, have := "https://git.foobar.com", provider.Param("base_url"); want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+}
@@ -1,5 +1,7 @@
 module github.com/yookoala/middleauth
 
+go 1.13
+
 require (
 	cloud.google.com/go v0.34.0 // indirect
 	github.com/go-midway/midway v0.0.0-20181023072100-30ef7f5359b7
@@ -3,11 +3,11 @@ package middleauth
 import (
 	"context"
 	"fmt"
+	"html/template"
 	"net/http"
 	"net/url"
 	"path"
 	"strings"
-	"text/template"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -26,6 +26,37 @@ type Context struct {
 	// access all paths within this context
 	PublicURL *url.URL
 
+	// StateStore stores the login state in between the
+	// login redirect and the provider callback. Cookies of
+	// CookieStateStore are named by the provider id.
+	//
+	// If nil, LoginHandler will use a CookieStateStore signed
+	// with a random key generated on start. Login attempts then
+	// fail across restarts, or if the callback is served by
+	// another instance. Set a CookieStateStore with a configured
+	// key for such deployments.
+	StateStore StateStore
+
+	// TokenStore stores the OAuth1.0a request token in
+	// between the login redirect and the provider callback.
+	// If nil, LoginHandler will use an in-memory TokenStore.
+	TokenStore TokenStore
+
+	// SessionStore stores the server-side sessions of
+	// StoreSession. If set, LogoutHandler revokes the
+	// session of the cookie in the store.
+	SessionStore SessionStore
+
+	// ProviderTokenStore stores the OAuth2 tokens of the
+	// providers saved by SaveProviderToken, for API calls
+	// of ClientForUser.
+	ProviderTokenStore ProviderTokenStore
+
+	// Registry contains the provider types for LoginHandler
+	// to build login flows with. If nil, DefaultRegistry
+	// will be used.
+	Registry *ProviderRegistry
+
 	// Paths for doing login
 
 	AuthPath    string
@@ -48,6 +79,14 @@ func NewContext(rawPublicURL string) (ctx *Context, err error) {
 	return
 }
 
+// registry returns the provider registry of the context
+func (ctx Context) registry() *ProviderRegistry {
+	if ctx.Registry == nil {
+		return DefaultRegistry
+	}
+	return ctx.Registry
+}
+
 // AuthURL returns the full auth endpoint URL
 func (ctx Context) AuthURL(parts ...string) *url.URL {
 	u := *ctx.PublicURL
@@ -96,15 +135,119 @@ func (ctx Context) ErrURL(parts ...string) *url.URL {
 	return &u
 }
 
+// ReturnURL resolves the given return-to URL against the public URL.
+// Only URLs of the same scheme and host as the public URL, and
+// with path within the public URL path, are allowed. Returns false
+// if the URL is not allowed.
+func (ctx Context) ReturnURL(rawurl string) (u *url.URL, ok bool) {
+	if rawurl == "" {
+		return
+	}
+	ref, err := url.Parse(rawurl)
+	if err != nil || ref.User != nil {
+		return
+	}
+	u = ctx.PublicURL.ResolveReference(ref)
+	if u.Scheme != ctx.PublicURL.Scheme || u.Host != ctx.PublicURL.Host {
+		return nil, false
+	}
+	if u.Path != ctx.PublicURL.Path && !strings.HasPrefix(ensureLeadingSlash(u.Path), ensureTrailingSlash(ensureLeadingSlash(ctx.PublicURL.Path))) {
+		return nil, false
+	}
+	u.Fragment = ""
+	return u, true
+}
+
 // AuthURLFactory manufactures redirectURLs to authentication endpoint
 // with the correct callback path back to the application site.
-type AuthURLFactory func(r *http.Request) (redirectURL string, err error)
+//
+// The ResponseWriter is provided for binding the login attempt
+// to the browser (e.g. by setting a cookie). The factory should
+// not write any response body.
+type AuthURLFactory func(w http.ResponseWriter, r *http.Request) (redirectURL string, err error)
+
+// OAuth2Option configures the login flow of OAuth2AuthURLFactory
+// and OAuth2CallbackDecoder. The same options should be provided
+// to both of them.
+type OAuth2Option func(flow *oauth2Flow)
+
+// oauth2Flow contains the options of an OAuth2 login flow
+type oauth2Flow struct {
+	pkce       bool
+	nonce      bool
+	formPost   bool
+	authParams []oauth2.AuthCodeOption
+}
+
+func newOAuth2Flow(opts []OAuth2Option) (flow *oauth2Flow) {
+	flow = &oauth2Flow{}
+	for _, opt := range opts {
+		opt(flow)
+	}
+	return
+}
+
+// WithFormPost requests the provider to send the callback parameters
+// in a POST body (response_mode=form_post) instead of the query.
+func WithFormPost() OAuth2Option {
+	return func(flow *oauth2Flow) {
+		flow.formPost = true
+	}
+}
+
+// WithAuthURLParam adds the key-value parameter to the
+// authentication URL, such as "hd" of Google login.
+func WithAuthURLParam(key, value string) OAuth2Option {
+	return func(flow *oauth2Flow) {
+		flow.authParams = append(flow.authParams, oauth2.SetAuthURLParam(key, value))
+	}
+}
 
 // OAuth2AuthURLFactory generates factory of authentication URL
-// to the oauth2 config
-func OAuth2AuthURLFactory(conf *oauth2.Config) AuthURLFactory {
-	return func(r *http.Request) (url string, err error) {
-		url = conf.AuthCodeURL("state", oauth2.AccessTypeOffline)
+// to the oauth2 config. A random state is generated for each
+// login attempt and saved to the given StateStore.
+func OAuth2AuthURLFactory(conf *oauth2.Config, states StateStore, opts ...OAuth2Option) AuthURLFactory {
+	flow := newOAuth2Flow(opts)
+	return func(w http.ResponseWriter, r *http.Request) (url string, err error) {
+		state, err := NewLoginState(r)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error": err.Error(),
+			}).Error("error generating login state.")
+			return
+		}
+
+		authCodeOpts := []oauth2.AuthCodeOption{oauth2.AccessTypeOffline}
+		authCodeOpts = append(authCodeOpts, flow.authParams...)
+		if flow.pkce {
+			if state.CodeVerifier, err = newCodeVerifier(); err != nil {
+				logrus.WithFields(logrus.Fields{
+					"error": err.Error(),
+				}).Error("error generating PKCE code verifier.")
+				return
+			}
+			authCodeOpts = append(authCodeOpts, codeChallengeOptions(state.CodeVerifier)...)
+		}
+		if flow.nonce {
+			if state.Nonce, err = randomString(32); err != nil {
+				logrus.WithFields(logrus.Fields{
+					"error": err.Error(),
+				}).Error("error generating nonce.")
+				return
+			}
+			authCodeOpts = append(authCodeOpts, oauth2.SetAuthURLParam("nonce", state.Nonce))
+		}
+		if flow.formPost {
+			authCodeOpts = append(authCodeOpts, oauth2.SetAuthURLParam("response_mode", "form_post"))
+		}
+
+		if err = states.Save(w, r, state); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error": err.Error(),
+			}).Error("error saving login state.")
+			return
+		}
+		url = conf.AuthCodeURL(state.State, authCodeOpts...)
 		return
 	}
 }
@@ -115,9 +258,19 @@ type OAuth1aConsumer interface {
 }
 
 // OAuth1aAuthURLFactory generates factory of authentication URL
-// to the oauth1a consumer and callback URL
-func OAuth1aAuthURLFactory(c OAuth1aConsumer, callbackURL string, tokens TokenStore) AuthURLFactory {
-	return func(r *http.Request) (url string, err error) {
+// to the oauth1a consumer and callback URL. The request token is
+// saved to the given TokenStore, and bound to the browser as the
+// login state in the given StateStore.
+func OAuth1aAuthURLFactory(c OAuth1aConsumer, callbackURL string, tokens TokenStore, states StateStore) AuthURLFactory {
+	return func(w http.ResponseWriter, r *http.Request) (url string, err error) {
+		state, err := NewLoginState(r)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error": err.Error(),
+			}).Error("error generating login state.")
+			return
+		}
+
 		requestToken, url, err := c.GetRequestTokenAndUrl(callbackURL)
 		if err != nil {
 			logrus.WithFields(logrus.Fields{
@@ -125,6 +278,17 @@ func OAuth1aAuthURLFactory(c OAuth1aConsumer, callbackURL string, tokens TokenSt
 			}).Error("error retrieving access token.")
 			return
 		}
+
+		// the request token is the OAuth1.0a counterpart
+		// of the OAuth2 state parameter
+		state.State = requestToken.Token
+		if err = states.Save(w, r, state); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error": err.Error(),
+			}).Error("error saving login state.")
+			url = ""
+			return
+		}
 		tokens.Save(requestToken)
 		return
 	}
@@ -134,7 +298,7 @@ func OAuth1aAuthURLFactory(c OAuth1aConsumer, callbackURL string, tokens TokenSt
 // authentication endpoint with proper parameters
 func RedirectHandler(getAuthURL AuthURLFactory, errURL string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		url, err := getAuthURL(r)
+		url, err := getAuthURL(w, r)
 		if err != nil {
 			// TODO: redirect to the errURL with status messages
 			http.Redirect(w, r, errURL, http.StatusTemporaryRedirect)
@@ -150,48 +314,184 @@ func RedirectHandler(getAuthURL AuthURLFactory, errURL string) http.HandlerFunc
 // 1. A context for follow up callback to use;
 // 2. The http Client for API calls based on the token; and
 // 3. Error, if any step prodcued one.
-type CallbackReqDecoder func(r *http.Request) (ctxNext context.Context, client *http.Client, err error)
+//
+// The ResponseWriter is provided for clearing the login state
+// bound to the browser once it is used. The decoder should not
+// write any response body.
+type CallbackReqDecoder func(w http.ResponseWriter, r *http.Request) (ctxNext context.Context, client *http.Client, err error)
+
+// OAuth2CallbackDecoder implements CallbackReqDecoder. The state
+// parameter of the callback is verified against the login state
+// in the given StateStore before the code exchange. The verified
+// login state is cleared so that it cannot be replayed.
+func OAuth2CallbackDecoder(conf *oauth2.Config, states StateStore, opts ...OAuth2Option) CallbackReqDecoder {
+	flow := newOAuth2Flow(opts)
+	return func(w http.ResponseWriter, r *http.Request) (ctxNext context.Context, client *http.Client, err error) {
+
+		state, err := states.Load(r)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error": err.Error(),
+			}).Error("failed to load login state")
+			err = &LoginError{
+				Type:   ErrInvalidState,
+				Action: "load login state",
+				Err:    err,
+			}
+			return
+		}
+		// parameters can be in query or, with form_post
+		// response mode, in the POST body
+		if !state.Verify(r.FormValue("state")) {
+			err = &LoginError{
+				Type:   ErrInvalidState,
+				Action: "verify login state",
+				Err:    fmt.Errorf("state parameter is missing or mismatch"),
+			}
+			return
+		}
+		clearLoginState(w, r, states)
+
+		var exchangeOpts []oauth2.AuthCodeOption
+		if state.CodeVerifier != "" {
+			exchangeOpts = append(exchangeOpts, codeVerifierOption(state.CodeVerifier))
+		} else if flow.pkce {
+			err = &LoginError{
+				Type:   ErrInvalidState,
+				Action: "verify login state",
+				Err:    fmt.Errorf("PKCE code verifier not found"),
+			}
+			return
+		}
+		if flow.nonce && state.Nonce == "" {
+			err = &LoginError{
+				Type:   ErrInvalidState,
+				Action: "verify login state",
+				Err:    fmt.Errorf("nonce not found"),
+			}
+			return
+		}
 
-// OAuth2CallbackDecoder implements CallbackReqDecoder
-func OAuth2CallbackDecoder(conf *oauth2.Config) CallbackReqDecoder {
-	return func(r *http.Request) (ctxNext context.Context, client *http.Client, err error) {
-		code := r.URL.Query().Get("code")
-		token, err := conf.Exchange(oauth2.NoContext, code)
+		// error response of the authorization, such as
+		// the user declined the login at the provider
+		if code := r.FormValue("error"); code != "" {
+			err = &OAuth2Error{
+				Code:        code,
+				Description: r.FormValue("error_description"),
+				URI:         r.FormValue("error_uri"),
+			}
+			return
+		}
+
+		code := r.FormValue("code")
+		if code == "" {
+			err = &OAuth2Error{
+				Code:        "invalid_request",
+				Description: "authorization code is missing",
+			}
+			return
+		}
+		token, err := conf.Exchange(r.Context(), code, exchangeOpts...)
 		if err != nil {
 			logrus.WithFields(logrus.Fields{
 				"error": err.Error(),
 			}).Error("code exchange failed")
 			return
 		}
-		client = conf.Client(r.Context(), token)
+		ctxNext = WithOAuth2Token(WithLoginState(r.Context(), state), token)
+		client = conf.Client(ctxNext, token)
 		return
 	}
 }
 
+// clearLoginState clears the login state of the request
+// from the StateStore. Failure is logged but not returned,
+// as the login state is already verified.
+func clearLoginState(w http.ResponseWriter, r *http.Request, states StateStore) {
+	if err := states.Clear(w, r); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("failed to clear login state")
+	}
+}
+
+// WithOAuth2Token add an *oauth2.Token to a given context
+func WithOAuth2Token(parent context.Context, token *oauth2.Token) context.Context {
+	return context.WithValue(parent, oauth2TokenKey, token)
+}
+
+// GetOAuth2Token gets an *oauth2.Token, if exists, from a context
+func GetOAuth2Token(ctx context.Context) (token *oauth2.Token) {
+	tokenRaw := ctx.Value(oauth2TokenKey)
+	token, _ = tokenRaw.(*oauth2.Token)
+	return
+}
+
 // OAuth1aCallbackDecoder generates ProviderClientFactory of the given
-// consumer
-func OAuth1aCallbackDecoder(c *oauth.Consumer, tokens TokenStore) CallbackReqDecoder {
-	return func(r *http.Request) (ctxNext context.Context, client *http.Client, err error) {
+// consumer. The oauth_token parameter of the callback is verified
+// against the login state in the given StateStore before the request
+// token is consumed. The verified login state is cleared so that it
+// cannot be replayed.
+func OAuth1aCallbackDecoder(c *oauth.Consumer, tokens TokenStore, states StateStore) CallbackReqDecoder {
+	return func(w http.ResponseWriter, r *http.Request) (ctxNext context.Context, client *http.Client, err error) {
 
 		values := r.URL.Query()
 		verificationCode := values.Get("oauth_verifier")
 		tokenKey := values.Get("oauth_token")
 
-		// TODO: add mutex lock mechanism to ensure read, write
-		// or have global token storage for distributed access
+		state, err := states.Load(r)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error": err.Error(),
+			}).Error("failed to load login state")
+			err = &LoginError{
+				Type:   ErrInvalidState,
+				Action: "load login state",
+				Err:    err,
+			}
+			return
+		}
+
+		// the user declined the authorization at the provider
+		if denied := values.Get("denied"); denied != "" {
+			if state.Verify(denied) {
+				tokens.Consume(denied)
+				clearLoginState(w, r, states)
+			}
+			err = &LoginError{
+				Type:   ErrAccessDenied,
+				Action: "authorize request token",
+				Err:    fmt.Errorf("user denied the authorization"),
+			}
+			return
+		}
+
+		if !state.Verify(tokenKey) {
+			err = &LoginError{
+				Type:   ErrInvalidState,
+				Action: "verify login state",
+				Err:    fmt.Errorf("oauth_token parameter is missing or mismatch"),
+			}
+			return
+		}
+		clearLoginState(w, r, states)
+
 		token := tokens.Consume(tokenKey)
 		if token == nil {
-			err = fmt.Errorf("relevant request token not found")
+			err = &LoginError{
+				Type:   ErrInvalidState,
+				Action: "consume request token",
+				Err:    fmt.Errorf("relevant request token not found"),
+			}
+			return
 		}
 
 		accessToken, err := c.AuthorizeToken(token, verificationCode)
 		if err != nil {
-			if err != nil {
-				logrus.WithFields(logrus.Fields{
-					"error": err.Error(),
-				}).Error("failed to retrieve access token")
-				return
-			}
+			logrus.WithFields(logrus.Fields{
+				"error": err.Error(),
+			}).Error("failed to retrieve access token")
+			return
 		}
 
 		client, err = c.MakeHttpClient(accessToken)
@@ -202,6 +502,7 @@ func OAuth1aCallbackDecoder(c *oauth.Consumer, tokens TokenStore) CallbackReqDec
 			return
 		}
 
+		ctxNext = WithLoginState(r.Context(), state)
 		return
 	}
 }
@@ -260,18 +561,17 @@ func (cbh *CallbackHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	errURL := cbh.ctx.ErrURL()
 
 	// get an *http.Client for the API call
-	ctx, client, err := cbh.getClient(r)
+	ctx, client, err := cbh.getClient(w, r)
 	if err != nil {
 		logrus.WithFields(logrus.Fields{
 			"error": err.Error(),
 		}).Error("failed to create API client")
 
-		q := url.Values{}
-		q.Add("error", "internal_server_error")
-		q.Add("error_description", "failed to create API client")
-		q.Add("error_details", err.Error())
-		errURL.RawQuery = q.Encode()
-		http.Redirect(w, r, errURL.String(), http.StatusTemporaryRedirect)
+		redirectError(w, r, errURL,
+			errorCode(err, "internal_server_error"),
+			errorDescription(err, "failed to create API client"),
+			err,
+		)
 		return
 	}
 
@@ -282,12 +582,11 @@ func (cbh *CallbackHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			"error": err.Error(),
 		}).Error("failed retrieve authenticating user info from OAuth2 provider")
 
-		q := url.Values{}
-		q.Add("error", "login_error")
-		q.Add("error_description", "failed retrieve authenticating user info from OAuth2 provider")
-		q.Add("error_details", err.Error())
-		errURL.RawQuery = q.Encode()
-		http.Redirect(w, r, errURL.String(), http.StatusTemporaryRedirect)
+		redirectError(w, r, errURL,
+			errorCode(err, "login_error"),
+			errorDescription(err, "failed retrieve authenticating user info from OAuth2 provider"),
+			err,
+		)
 		return
 	}
 
@@ -299,12 +598,11 @@ func (cbh *CallbackHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			"error": err.Error(),
 		}).Error("failed to find or create authenticating user")
 
-		q := url.Values{}
-		q.Add("error", "login_error")
-		q.Add("error_description", "failed to find or create authenticating user")
-		q.Add("error_details", err.Error())
-		errURL.RawQuery = q.Encode()
-		http.Redirect(w, r, errURL.String(), http.StatusTemporaryRedirect)
+		redirectError(w, r, errURL,
+			errorCode(err, "login_error"),
+			errorDescription(err, "failed to find or create authenticating user"),
+			err,
+		)
 		return
 	}
 
@@ -331,28 +629,129 @@ func (cbh *CallbackHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			"error": err.Error(),
 		}).Error("failed to generate session cookie")
 
-		q := url.Values{}
-		q.Add("error", "internal_server_error")
-		q.Add("error_description", "failed to generate session cookie")
-		q.Add("error_details", err.Error())
-		errURL.RawQuery = q.Encode()
-		http.Redirect(w, r, errURL.String(), http.StatusTemporaryRedirect)
+		redirectError(w, r, errURL,
+			errorCode(err, "internal_server_error"),
+			errorDescription(err, "failed to generate session cookie"),
+			err,
+		)
 		return
 	}
 
 	// set the session cookie, then redirect user temporarily
-	// temporary redirect user to success url
-	//
-	// TODO: implement custom redirect / success messages to success url
+	// to the return-to url of the login, if allowed, or to the
+	// success url.
+	redirectURL := cbh.ctx.SuccessURL()
+	if state := GetLoginState(ctx); state != nil {
+		if returnURL, ok := cbh.ctx.ReturnURL(state.ReturnTo); ok {
+			redirectURL = returnURL
+		} else if state.ReturnTo != "" {
+			logrus.WithFields(logrus.Fields{
+				"return_to": state.ReturnTo,
+			}).Warn("return-to url not allowed")
+		}
+	}
 	http.SetCookie(w, cookie)
 	http.Redirect(
 		w, r,
-		cbh.ctx.SuccessURL().String(),
-		http.StatusTemporaryRedirect,
+		redirectURL.String(),
+		callbackRedirectStatus(r),
 	)
 }
 
-// LogoutHandler makes a cookie of a given name expires
+// callbackRedirectStatus returns the status code to redirect
+// from the callback request. Callbacks of form_post response mode
+// are POST requests, which should be followed by a GET.
+func callbackRedirectStatus(r *http.Request) int {
+	if r.Method == http.MethodPost {
+		return http.StatusSeeOther
+	}
+	return http.StatusTemporaryRedirect
+}
+
+// errorCode returns the error code for the error URL of
+// a given error. Returns fallback for errors without a
+// specific code.
+func errorCode(err error, fallback string) string {
+	if _, ok := err.(*ProviderError); ok {
+		return "provider_error"
+	}
+	if oerr, ok := err.(*OAuth2Error); ok {
+		return oerr.Code
+	}
+	if lerr, ok := err.(*LoginError); ok {
+		switch lerr.Type {
+		case ErrInvalidState:
+			return "invalid_state"
+		case ErrInvalidIDToken:
+			return "invalid_id_token"
+		case ErrOrganizationNotAllowed:
+			return "organization_not_allowed"
+		case ErrHostedDomainNotAllowed:
+			return "hosted_domain_not_allowed"
+		case ErrAccessDenied:
+			return "access_denied"
+		}
+	}
+	return fallback
+}
+
+// errorDescription returns the description for the error URL
+// of a given error. Returns fallback for errors without a
+// specific description.
+func errorDescription(err error, fallback string) string {
+	if _, ok := err.(*ProviderError); ok {
+		return "unexpected response from the login provider"
+	}
+	if oerr, ok := err.(*OAuth2Error); ok {
+		switch {
+		case oerr.Description != "":
+			return oerr.Description
+		case oerr.Code == "access_denied":
+			return "the login is cancelled"
+		}
+		return "the login provider returned an error"
+	}
+	if lerr, ok := err.(*LoginError); ok {
+		switch lerr.Type {
+		case ErrOrganizationNotAllowed:
+			return "the account does not belong to the organizations allowed"
+		case ErrHostedDomainNotAllowed:
+			return "please login with an account of the allowed domain"
+		case ErrAccessDenied:
+			return "the login is cancelled"
+		}
+	}
+	return fallback
+}
+
+// errorDetails returns the details for the error URL of a given
+// error. The URL and response body of ProviderError are left out,
+// as they may contain tokens and should only be logged on server.
+func errorDetails(err error) string {
+	if perr, ok := err.(*ProviderError); ok {
+		return fmt.Sprintf("provider %s returned status %d", perr.Provider, perr.StatusCode)
+	}
+	return err.Error()
+}
+
+// redirectError redirects the user to the given error URL
+// with the error code, description and details as query.
+// The error URI of OAuth2Error is passed on as "error_uri".
+func redirectError(w http.ResponseWriter, r *http.Request, errURL *url.URL, code, description string, err error) {
+	q := url.Values{}
+	q.Add("error", code)
+	q.Add("error_description", description)
+	q.Add("error_details", errorDetails(err))
+	if oerr, ok := err.(*OAuth2Error); ok && oerr.URI != "" {
+		q.Add("error_uri", oerr.URI)
+	}
+	errURL.RawQuery = q.Encode()
+	http.Redirect(w, r, errURL.String(), callbackRedirectStatus(r))
+}
+
+// LogoutHandler makes a cookie of a given name expires. If the
+// context has a SessionStore, the session of the cookie is also
+// revoked.
 func LogoutHandler(ctx *Context) http.HandlerFunc {
 	redirectURL := ctx.SuccessURL().String()
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -363,13 +762,23 @@ func LogoutHandler(ctx *Context) http.HandlerFunc {
 			// TODO: figure how we should handle this.
 			return
 		}
+		if ctx.SessionStore != nil {
+			if err := ctx.SessionStore.DeleteSession(r.Context(), cookie.Value); err != nil {
+				logrus.WithFields(logrus.Fields{
+					"error": err.Error(),
+				}).Error("failed to revoke session")
+			}
+		}
 		cookie.Expires = time.Now().Add(-1 * time.Hour) // expires immediately
 		http.SetCookie(w, cookie)
 		http.Redirect(w, r, redirectURL, http.StatusTemporaryRedirect)
 	}
 }
 
-// LoginHandler return a mux to handle all login related routes
+// LoginHandler return a mux to handle all login related routes.
+// Login flow of each provider is built by the ProviderType registered
+// in the context's Registry (or DefaultRegistry if nil). Providers of
+// unknown type are ignored.
 func LoginHandler(
 	userStorageCallback UserStorageCallback,
 	cookieFactory CookieFactory,
@@ -384,94 +793,48 @@ func LoginHandler(
 	// Note: publicURL must be full URL without path or any trailing slash
 
 	mux := http.NewServeMux()
-	tokenStore := NewTokenStore()
-
-	if provider := FindProvider("google", providers); provider != nil {
-		mux.Handle(loginPath+"google", RedirectHandler(
-			OAuth2AuthURLFactory(GoogleConfig(
-				*provider,
-				ctx.LoginURL("google/callback").String(),
-			)),
-			errURL,
-		))
-		mux.Handle(
-			loginPath+"google/callback",
-			NewCallbackHandler(
-				OAuth2CallbackDecoder(GoogleConfig(
-					*provider,
-					ctx.LoginURL("google/callback").String(),
-				)),
-				GoogleAuthUserFactory,
-				userStorageCallback,
-				cookieFactory,
-				ctx,
-			),
-		)
+	tokenStore := ctx.TokenStore
+	if tokenStore == nil {
+		tokenStore = NewTokenStore()
 	}
-
-	if provider := FindProvider("facebook", providers); provider != nil {
-		mux.Handle(loginPath+"facebook", RedirectHandler(
-			OAuth2AuthURLFactory(FacebookConfig(
-				*provider,
-				ctx.LoginURL("facebook/callback").String(),
-			)),
-			errURL,
-		))
-		mux.Handle(
-			loginPath+"facebook/callback",
-			NewCallbackHandler(
-				OAuth2CallbackDecoder(FacebookConfig(
-					*provider,
-					ctx.LoginURL("facebook/callback").String(),
-				)),
-				FacebookAuthUserFactory,
-				userStorageCallback,
-				cookieFactory,
-				ctx,
-			),
-		)
-	}
-
-	if provider := FindProvider("github", providers); provider != nil {
-		mux.Handle(loginPath+"github", RedirectHandler(
-			OAuth2AuthURLFactory(GithubConfig(
-				*provider,
-				ctx.LoginURL("github/callback").String(),
-			)),
-			errURL,
-		))
-		mux.Handle(
-			loginPath+"github/callback",
-			NewCallbackHandler(
-				OAuth2CallbackDecoder(GithubConfig(
-					*provider,
-					ctx.LoginURL("github/callback").String(),
-				)),
-				GithubAuthUserFactory,
-				userStorageCallback,
-				cookieFactory,
-				ctx,
-			),
-		)
+	stateStore := ctx.StateStore
+	if stateStore == nil {
+		var err error
+		if stateStore, err = defaultStateStore(ctx); err != nil {
+			// logins cannot be secured without the state
+			logrus.WithFields(logrus.Fields{
+				"error": err.Error(),
+			}).Error("failed to create login state store")
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusInternalServerError)
+				fmt.Fprint(w, "internal server error")
+			})
+		}
 	}
 
-	if provider := FindProvider("twitter", providers); provider != nil {
-		mux.Handle(loginPath+"twitter", RedirectHandler(
-			OAuth1aAuthURLFactory(
-				TwitterConsumer(*provider),
-				ctx.LoginURL("twitter/callback").String(),
-				tokenStore,
-			),
+	registry := ctx.registry()
+	for _, provider := range registry.Providers(providers) {
+		providerType, _ := registry.Find(provider.TypeID())
+		states := stateStore
+		if store, ok := stateStore.(*CookieStateStore); ok {
+			states = store.forProvider(provider.ID)
+		}
+		setup := ProviderSetup{
+			Provider:    provider,
+			Context:     ctx,
+			CallbackURL: ctx.LoginURL(provider.ID + "/callback").String(),
+			States:      states,
+			Tokens:      tokenStore,
+		}
+		mux.Handle(loginPath+provider.ID, RedirectHandler(
+			providerType.AuthURLFactory(setup),
 			errURL,
 		))
 		mux.Handle(
-			loginPath+"twitter/callback",
+			loginPath+provider.ID+"/callback",
 			NewCallbackHandler(
-				OAuth1aCallbackDecoder(
-					TwitterConsumer(*provider),
-					tokenStore,
-				),
-				TwitterAuthUserFactory,
+				providerType.CallbackReqDecoder(setup),
+				providerType.AuthUserDecoder(setup),
 				userStorageCallback,
 				cookieFactory,
 				ctx,
@@ -482,6 +845,24 @@ func LoginHandler(
 	return mux
 }
 
+// defaultStateStore creates a CookieStateStore for the context
+// signed with a random key. Login attempts will not survive
+// restarts and cannot be shared among multiple instances.
+// See Context.StateStore.
+func defaultStateStore(ctx *Context) (StateStore, error) {
+	key, err := randomString(32)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate state key: %s", err.Error())
+	}
+	store := NewCookieStateStore(ctx.CookieName+"-state", key)
+	store.Secure = ctx.PublicURL.Scheme == "https"
+	if store.Secure {
+		// allow the cross-site POST of form_post callbacks
+		store.SameSite = http.SameSiteNoneMode
+	}
+	return store, nil
+}
+
 const loginPageDefaultCSS = `
 {{ define "defaultCSS" }}
 #page-login {
@@ -557,8 +938,9 @@ const loginPageHTML = `
 {{ if .Actions }}
   <div class="actions">
 	{{ $loginPath := .LoginPath }}
+	{{ $returnTo := .ReturnTo }}
     {{ range $action := .Actions }}
-      <a class="btn btn-login-{{ $action.ID }}" href="{{ $loginPath }}{{ $action.ID }}">{{ $action.Name }}</a>
+      <a class="btn btn-login-{{ $action.ID }}" href="{{ $loginPath }}{{ $action.ID }}{{ if $returnTo }}?next={{ urlquery $returnTo }}{{ end }}">{{ $action.Name }}</a>
     {{ end }}
   </div>
 {{ else }}
@@ -598,6 +980,9 @@ const errorPageHTML = `
 <main>
 <div class="error-box">
 	<h1>{{ .Title }}</h1>
+	{{ if .Cancelled }}
+		<p class="message">You have cancelled the login. No account information is shared.</p>
+	{{ end }}
 	{{ if .Description }}
 		<div class="field field-description">
 			<div class="name">Description</div>
@@ -616,6 +1001,9 @@ const errorPageHTML = `
 			<div class="value">{{ .URI }}</div>
 		</div>
 	{{ end }}
+	{{ if .RetryURL }}
+		<p class="actions"><a href="{{ .RetryURL }}">{{ if .Cancelled }}Login again{{ else }}Try again{{ end }}</a></p>
+	{{ end }}
 </div>
 </main>
 </body>
@@ -630,6 +1018,10 @@ type LoginPageContent struct {
 	Stylesheets     []string
 	Actions         []AuthProvider
 	NoticeNoAction  string
+
+	// ReturnTo is passed to the login links
+	// as the "next" parameter, if not empty.
+	ReturnTo string
 }
 
 // LoginPageContentCallback returns LoginPageContent for a given
@@ -678,14 +1070,16 @@ func CommonHandler(
 		ctx,
 	))
 
-	// handle login page
+	// handle login page with the supported providers
+	actions := ctx.registry().Providers(providers)
 	mux.Handle(ctx.AuthPath, LoginPageHandler(
 		func(r *http.Request) LoginPageContent {
 			return LoginPageContent{
 				PageHeaderTitle: "Login | Example Server",
 				PageTitle:       "Login to Example Server",
 				LoginPath:       loginPath,
-				Actions:         providers,
+				Actions:         actions,
+				ReturnTo:        ReturnToParam(r),
 			}
 		},
 	))
@@ -697,6 +1091,9 @@ func CommonHandler(
 
 // ErrHandler handles the error arrose from internal storage and entity
 // and not from the provider's login. Display the login error.
+//
+// The "access_denied" error, which means the user cancelled the login
+// at the provider, is displayed as a login cancelled page.
 func ErrHandler(ctx *Context) http.HandlerFunc {
 	tpl := template.New("login")
 	tpl = template.Must(tpl.Parse(errorPageHTML))
@@ -708,14 +1105,26 @@ func ErrHandler(ctx *Context) http.HandlerFunc {
 			Description string
 			Details     string
 			URI         string
+			Cancelled   bool
+			RetryURL    string
 		}{
 			Title:       strings.Title(strings.Replace(r.FormValue("error"), "_", " ", -1)),
 			Type:        r.FormValue("error"),
 			Description: r.FormValue("error_description"),
 			Details:     r.FormValue("error_details"),
 			URI:         r.FormValue("error_uri"),
+			RetryURL:    ctx.AuthURL().String(),
+		}
+		if errReport.Type == "access_denied" {
+			errReport.Title = "Login Cancelled"
+			errReport.Cancelled = true
+			errReport.Details = ""
+		}
+		if errReport.Title == "" {
+			errReport.Title = "Error"
 		}
 
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
 		err := tpl.Execute(w, errReport)
 		if err != nil {
 			logrus.Error(err)
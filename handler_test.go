@@ -2,10 +2,14 @@ package middleauth_test
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strings"
 	"testing"
 
 	"github.com/gofrs/uuid"
@@ -160,6 +164,7 @@ func TestContext_urlMethods(t *testing.T) {
 
 func TestOAuth2AuthURLFactory(t *testing.T) {
 
+	states := middleauth.NewCookieStateStore("dummy-state", "dummy-key")
 	factory := middleauth.OAuth2AuthURLFactory(&oauth2.Config{
 		RedirectURL:  "http://foobar.com/redirect",
 		ClientID:     "foobar-client-id",
@@ -173,10 +178,11 @@ func TestOAuth2AuthURLFactory(t *testing.T) {
 			AuthURL:  "http://dummy-oauth2-provider.com/auth",
 			TokenURL: "http://dummy-oauth2-provider.com/token",
 		},
-	})
+	}, states)
 
+	w := httptest.NewRecorder()
 	r, _ := http.NewRequest("GET", "http://foobar.com/login", nil)
-	rawurl, err := factory(r)
+	rawurl, err := factory(w, r)
 	if err != nil {
 		t.Errorf("unexpected error: %s", err)
 	}
@@ -203,11 +209,209 @@ func TestOAuth2AuthURLFactory(t *testing.T) {
 	if want, have := "scope-1 scope-2", q.Get("scope"); want != have {
 		t.Errorf("wanted %#v, got %#v", want, have)
 	}
-	if want, have := "state", q.Get("state"); want != have {
+
+	// the state should be random and bound to the browser
+	if q.Get("state") == "" || q.Get("state") == "state" {
+		t.Errorf("expected random state, got %#v", q.Get("state"))
+	}
+	r, _ = http.NewRequest("GET", "http://foobar.com/callback", nil)
+	for _, cookie := range w.Result().Cookies() {
+		r.AddCookie(cookie)
+	}
+	state, err := states.Load(r)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	} else if state == nil {
+		t.Errorf("expected login state, got nil")
+	} else if want, have := q.Get("state"), state.State; want != have {
 		t.Errorf("wanted %#v, got %#v", want, have)
 	}
 }
 
+func TestOAuth2CallbackDecoder(t *testing.T) {
+
+	// dummy token endpoint
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"access_token":"dummy-access-token","token_type":"bearer"}`)
+	}))
+	defer ts.Close()
+
+	conf := &oauth2.Config{
+		RedirectURL:  "http://foobar.com/redirect",
+		ClientID:     "foobar-client-id",
+		ClientSecret: "foobar-secret",
+		Endpoint: oauth2.Endpoint{
+			AuthURL:  ts.URL + "/auth",
+			TokenURL: ts.URL + "/token",
+		},
+	}
+	states := middleauth.NewCookieStateStore("dummy-state", "dummy-key")
+
+	// start login to get the state and cookie
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "http://foobar.com/login", nil)
+	rawurl, err := middleauth.OAuth2AuthURLFactory(conf, states)(w, r)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	parsed, _ := url.Parse(rawurl)
+	state := parsed.Query().Get("state")
+	cookies := w.Result().Cookies()
+
+	tests := []struct {
+		desc    string
+		query   string
+		cookies []*http.Cookie
+		errType middleauth.LoginErrorType
+	}{
+		{
+			desc:    "matching state",
+			query:   "code=dummy-code&state=" + url.QueryEscape(state),
+			cookies: cookies,
+		},
+		{
+			desc:    "missing state parameter",
+			query:   "code=dummy-code",
+			cookies: cookies,
+			errType: middleauth.ErrInvalidState,
+		},
+		{
+			desc:    "mismatch state parameter",
+			query:   "code=dummy-code&state=not-the-state",
+			cookies: cookies,
+			errType: middleauth.ErrInvalidState,
+		},
+		{
+			desc:    "missing state cookie",
+			query:   "code=dummy-code&state=" + url.QueryEscape(state),
+			errType: middleauth.ErrInvalidState,
+		},
+		{
+			desc:  "tampered state cookie",
+			query: "code=dummy-code&state=" + url.QueryEscape(state),
+			cookies: []*http.Cookie{
+				{Name: "dummy-state", Value: "not-a-valid-token"},
+			},
+			errType: middleauth.ErrInvalidState,
+		},
+	}
+
+	decoder := middleauth.OAuth2CallbackDecoder(conf, states)
+	for _, test := range tests {
+		r, _ := http.NewRequest("GET", "http://foobar.com/callback?"+test.query, nil)
+		for _, cookie := range test.cookies {
+			r.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		_, client, err := decoder(w, r)
+		if test.errType == middleauth.ErrUnknown {
+			if err != nil {
+				t.Errorf("[%s] unexpected error: %s", test.desc, err)
+			} else if client == nil {
+				t.Errorf("[%s] expected client, got nil", test.desc)
+			}
+			if cleared := w.Result().Cookies(); len(cleared) != 1 || cleared[0].Name != "dummy-state" || cleared[0].MaxAge >= 0 {
+				t.Errorf("[%s] expected state cookie to be cleared, got %#v", test.desc, cleared)
+			}
+			continue
+		}
+		if lerr, ok := err.(*middleauth.LoginError); !ok {
+			t.Errorf("[%s] expected *middleauth.LoginError, got %#v", test.desc, err)
+		} else if want, have := test.errType, lerr.Type; want != have {
+			t.Errorf("[%s] expected %#v, got %#v", test.desc, want, have)
+		}
+	}
+}
+
+func TestOAuth2CallbackDecoder_errorResponse(t *testing.T) {
+
+	// dummy token endpoint, which should not be called
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unexpected code exchange")
+	}))
+	defer ts.Close()
+
+	conf := &oauth2.Config{
+		RedirectURL: "http://foobar.com/redirect",
+		ClientID:    "foobar-client-id",
+		Endpoint: oauth2.Endpoint{
+			AuthURL:  ts.URL + "/auth",
+			TokenURL: ts.URL + "/token",
+		},
+	}
+	states := middleauth.NewCookieStateStore("dummy-state", "dummy-key")
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "http://foobar.com/login", nil)
+	rawurl, err := middleauth.OAuth2AuthURLFactory(conf, states)(w, r)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	parsed, _ := url.Parse(rawurl)
+	state := parsed.Query().Get("state")
+	cookies := w.Result().Cookies()
+
+	tests := []struct {
+		desc  string
+		query string
+		want  middleauth.OAuth2Error
+	}{
+		{
+			desc:  "access denied",
+			query: "error=access_denied&state=" + url.QueryEscape(state),
+			want: middleauth.OAuth2Error{
+				Code: "access_denied",
+			},
+		},
+		{
+			desc: "error with description and uri",
+			query: "error=invalid_scope&error_description=" + url.QueryEscape("scope is invalid") +
+				"&error_uri=" + url.QueryEscape("https://provider.com/errors/invalid_scope") +
+				"&state=" + url.QueryEscape(state),
+			want: middleauth.OAuth2Error{
+				Code:        "invalid_scope",
+				Description: "scope is invalid",
+				URI:         "https://provider.com/errors/invalid_scope",
+			},
+		},
+		{
+			desc:  "missing code",
+			query: "state=" + url.QueryEscape(state),
+			want: middleauth.OAuth2Error{
+				Code:        "invalid_request",
+				Description: "authorization code is missing",
+			},
+		},
+	}
+
+	decoder := middleauth.OAuth2CallbackDecoder(conf, states)
+	for _, test := range tests {
+		r, _ := http.NewRequest("GET", "http://foobar.com/callback?"+test.query, nil)
+		for _, cookie := range cookies {
+			r.AddCookie(cookie)
+		}
+		_, _, err := decoder(httptest.NewRecorder(), r)
+		if oerr, ok := err.(*middleauth.OAuth2Error); !ok {
+			t.Errorf("[%s] expected *middleauth.OAuth2Error, got %#v", test.desc, err)
+		} else if want, have := test.want, *oerr; want != have {
+			t.Errorf("[%s] expected %#v, got %#v", test.desc, want, have)
+		}
+	}
+
+	// error response with mismatch state is not trusted
+	r, _ = http.NewRequest("GET", "http://foobar.com/callback?error=access_denied&state=not-the-state", nil)
+	for _, cookie := range cookies {
+		r.AddCookie(cookie)
+	}
+	_, _, err = decoder(httptest.NewRecorder(), r)
+	if lerr, ok := err.(*middleauth.LoginError); !ok {
+		t.Errorf("expected *middleauth.LoginError, got %#v", err)
+	} else if want, have := middleauth.ErrInvalidState, lerr.Type; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+}
+
 type testOAuth1aConsumer struct {
 	callbackURL string
 }
@@ -230,14 +434,17 @@ func TestOAuth1aAuthURLFactory(t *testing.T) {
 
 	dummyConsumer := &testOAuth1aConsumer{}
 	tokenStore := middleauth.NewTokenStore()
+	states := middleauth.NewCookieStateStore("dummy-state", "dummy-key")
 	factory := middleauth.OAuth1aAuthURLFactory(
 		dummyConsumer,
 		"https://foobar.com/callback",
 		tokenStore,
+		states,
 	)
 
-	r, _ := http.NewRequest("GET", "http://foobar.com/login", nil)
-	rawurl, err := factory(r)
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "http://foobar.com/login?next=/some/page", nil)
+	rawurl, err := factory(w, r)
 	if err != nil {
 		t.Errorf("unexpected error: %s", err)
 	}
@@ -254,6 +461,176 @@ func TestOAuth1aAuthURLFactory(t *testing.T) {
 	} else if want, have := "dummy-secret", storedToken.Secret; want != have {
 		t.Errorf("expected %#v, got %#v", want, have)
 	}
+
+	// the request token should be bound to the browser
+	r, _ = http.NewRequest("GET", "http://foobar.com/callback", nil)
+	for _, cookie := range w.Result().Cookies() {
+		r.AddCookie(cookie)
+	}
+	state, err := states.Load(r)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	} else if state == nil {
+		t.Errorf("expected login state, got nil")
+	} else if want, have := "dummy-token", state.State; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	} else if want, have := "/some/page", state.ReturnTo; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+}
+
+// testOAuth1aServer creates a stand-in OAuth1.0a provider. Every
+// request token issued has a different key.
+func testOAuth1aServer(t *testing.T) *httptest.Server {
+	var count int
+	mux := http.NewServeMux()
+	mux.HandleFunc("/request_token", func(w http.ResponseWriter, r *http.Request) {
+		count++
+		fmt.Fprintf(w, "oauth_token=request-token-%d&oauth_token_secret=request-secret&oauth_callback_confirmed=true", count)
+	})
+	mux.HandleFunc("/access_token", func(w http.ResponseWriter, r *http.Request) {
+		if auth := r.Header.Get("Authorization"); !strings.Contains(auth, `oauth_verifier="dummy-verifier"`) {
+			t.Errorf("expected oauth_verifier in authorization header, got %#v", auth)
+		}
+		fmt.Fprint(w, "oauth_token=access-token&oauth_token_secret=access-secret")
+	})
+	mux.HandleFunc("/api", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Header.Get("Authorization"))
+	})
+	return httptest.NewServer(mux)
+}
+
+func TestOAuth1aCallbackDecoder(t *testing.T) {
+
+	ts := testOAuth1aServer(t)
+	defer ts.Close()
+
+	consumer := oauth.NewConsumer(
+		"dummy-consumer-key",
+		"dummy-consumer-secret",
+		oauth.ServiceProvider{
+			RequestTokenUrl:   ts.URL + "/request_token",
+			AuthorizeTokenUrl: ts.URL + "/authorize",
+			AccessTokenUrl:    ts.URL + "/access_token",
+		},
+	)
+	tokens := middleauth.NewTokenStore()
+	states := middleauth.NewCookieStateStore("dummy-state", "dummy-key")
+	factory := middleauth.OAuth1aAuthURLFactory(consumer, "http://foobar.com/callback", tokens, states)
+	decoder := middleauth.OAuth1aCallbackDecoder(consumer, tokens, states)
+
+	// start login to get the request token and cookie
+	login := func() (tokenKey string, cookies []*http.Cookie) {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", "http://foobar.com/login", nil)
+		rawurl, err := factory(w, r)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		parsed, _ := url.Parse(rawurl)
+		return parsed.Query().Get("oauth_token"), w.Result().Cookies()
+	}
+
+	tests := []struct {
+		desc    string
+		query   func(tokenKey string) string
+		cookies bool
+		errType middleauth.LoginErrorType
+	}{
+		{
+			desc: "matching oauth_token",
+			query: func(tokenKey string) string {
+				return "oauth_verifier=dummy-verifier&oauth_token=" + url.QueryEscape(tokenKey)
+			},
+			cookies: true,
+		},
+		{
+			desc: "missing oauth_token",
+			query: func(tokenKey string) string {
+				return "oauth_verifier=dummy-verifier"
+			},
+			cookies: true,
+			errType: middleauth.ErrInvalidState,
+		},
+		{
+			desc: "mismatch oauth_token",
+			query: func(tokenKey string) string {
+				return "oauth_verifier=dummy-verifier&oauth_token=request-token-0"
+			},
+			cookies: true,
+			errType: middleauth.ErrInvalidState,
+		},
+		{
+			desc: "missing state cookie",
+			query: func(tokenKey string) string {
+				return "oauth_verifier=dummy-verifier&oauth_token=" + url.QueryEscape(tokenKey)
+			},
+			errType: middleauth.ErrInvalidState,
+		},
+		{
+			desc: "denied",
+			query: func(tokenKey string) string {
+				return "denied=" + url.QueryEscape(tokenKey)
+			},
+			cookies: true,
+			errType: middleauth.ErrAccessDenied,
+		},
+	}
+
+	for _, test := range tests {
+		tokenKey, cookies := login()
+		r, _ := http.NewRequest("GET", "http://foobar.com/callback?"+test.query(tokenKey), nil)
+		if test.cookies {
+			for _, cookie := range cookies {
+				r.AddCookie(cookie)
+			}
+		}
+		_, client, err := decoder(httptest.NewRecorder(), r)
+		if test.errType == middleauth.ErrUnknown {
+			if err != nil {
+				t.Errorf("[%s] unexpected error: %s", test.desc, err)
+				continue
+			} else if client == nil {
+				t.Errorf("[%s] expected client, got nil", test.desc)
+				continue
+			}
+			resp, err := client.Get(ts.URL + "/api")
+			if err != nil {
+				t.Errorf("[%s] unexpected error: %s", test.desc, err)
+				continue
+			}
+			body, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if auth := string(body); !strings.Contains(auth, `oauth_token="access-token"`) {
+				t.Errorf("[%s] expected access token in authorization header, got %#v", test.desc, auth)
+			}
+
+			// request token can only be used once
+			_, _, err = decoder(httptest.NewRecorder(), r)
+			if lerr, ok := err.(*middleauth.LoginError); !ok {
+				t.Errorf("[%s] expected *middleauth.LoginError, got %#v", test.desc, err)
+			} else if want, have := middleauth.ErrInvalidState, lerr.Type; want != have {
+				t.Errorf("[%s] expected %#v, got %#v", test.desc, want, have)
+			}
+			continue
+		}
+		if lerr, ok := err.(*middleauth.LoginError); !ok {
+			t.Errorf("[%s] expected *middleauth.LoginError, got %#v", test.desc, err)
+		} else if want, have := test.errType, lerr.Type; want != have {
+			t.Errorf("[%s] expected %#v, got %#v", test.desc, want, have)
+		}
+	}
+
+	// denied request token is removed
+	tokenKey, cookies := login()
+	r, _ := http.NewRequest("GET", "http://foobar.com/callback?denied="+url.QueryEscape(tokenKey), nil)
+	for _, cookie := range cookies {
+		r.AddCookie(cookie)
+	}
+	decoder(httptest.NewRecorder(), r)
+	if token := tokens.Consume(tokenKey); token != nil {
+		t.Errorf("expected nil, got %#v", token)
+	}
 }
 
 func TestCallbackHandler(t *testing.T) {
@@ -261,7 +638,7 @@ func TestCallbackHandler(t *testing.T) {
 	flags := make(map[string]bool)
 	stages := []string{"getClient", "getAuthUser", "findOrCreateUser", "genSessionCookie"}
 
-	getClient := middleauth.CallbackReqDecoder(func(r *http.Request) (ctxNext context.Context, client *http.Client, err error) {
+	getClient := middleauth.CallbackReqDecoder(func(w http.ResponseWriter, r *http.Request) (ctxNext context.Context, client *http.Client, err error) {
 		ctxNext = r.Context()
 		// TODO: need mock client
 		flags["getClient"] = true
@@ -325,17 +702,147 @@ func TestCallbackHandler(t *testing.T) {
 	}
 }
 
+func TestCallbackHandler_errorResponse(t *testing.T) {
+
+	getClient := middleauth.CallbackReqDecoder(func(w http.ResponseWriter, r *http.Request) (ctxNext context.Context, client *http.Client, err error) {
+		err = &middleauth.OAuth2Error{
+			Code:        "access_denied",
+			Description: "user cancelled",
+			URI:         "https://provider.com/errors/access_denied",
+		}
+		return
+	})
+	getAuthUser := middleauth.AuthUserDecoder(func(ctx context.Context, client *http.Client) (ctxNext context.Context, authUser *middleauth.UserIdentity, err error) {
+		t.Errorf("unexpected call to getAuthUser")
+		return
+	})
+
+	ctx, _ := middleauth.NewContext("http://foobar.com/")
+	ctx.ErrPath = "error"
+	handler := middleauth.NewCallbackHandler(getClient, getAuthUser, nil, nil, ctx)
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "http://foobar.com/oauth2/dummy-provider/callback?error=access_denied", nil)
+	handler.ServeHTTP(w, r)
+
+	parsed, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if want, have := "/error", parsed.Path; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+	q := parsed.Query()
+	if want, have := "access_denied", q.Get("error"); want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+	if want, have := "user cancelled", q.Get("error_description"); want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+	if want, have := "https://provider.com/errors/access_denied", q.Get("error_uri"); want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+}
+
+func TestErrHandler(t *testing.T) {
+
+	ctx, _ := middleauth.NewContext("http://foobar.com/")
+	ctx.AuthPath = "login"
+	handler := middleauth.ErrHandler(ctx)
+
+	tests := []struct {
+		desc     string
+		query    url.Values
+		contains []string
+		excludes []string
+	}{
+		{
+			desc: "login cancelled",
+			query: url.Values{
+				"error":         {"access_denied"},
+				"error_details": {"oauth2 error: access_denied"},
+			},
+			contains: []string{
+				"Login Cancelled",
+				"You have cancelled the login.",
+				`href="http://foobar.com/login"`,
+			},
+			excludes: []string{
+				"oauth2 error: access_denied",
+			},
+		},
+		{
+			desc: "provider error",
+			query: url.Values{
+				"error":             {"invalid_scope"},
+				"error_description": {"scope is invalid"},
+				"error_uri":         {"https://provider.com/errors/invalid_scope"},
+			},
+			contains: []string{
+				"Invalid Scope",
+				"scope is invalid",
+				"https://provider.com/errors/invalid_scope",
+			},
+			excludes: []string{
+				"You have cancelled the login.",
+				`href="https://provider.com/errors/invalid_scope"`,
+			},
+		},
+		{
+			desc: "escaped values",
+			query: url.Values{
+				"error":             {"invalid_request"},
+				"error_description": {"<script>alert(1)</script>"},
+				"error_uri":         {`"><script>alert(2)</script>`},
+			},
+			contains: []string{
+				"&lt;script&gt;alert(1)&lt;/script&gt;",
+				"&#34;&gt;&lt;script&gt;alert(2)&lt;/script&gt;",
+			},
+			excludes: []string{
+				"<script>",
+				`href="javascript:`,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", "http://foobar.com/error?"+test.query.Encode(), nil)
+		handler(w, r)
+		body := w.Body.String()
+		for _, want := range test.contains {
+			if !strings.Contains(body, want) {
+				t.Errorf("[%s] expected body to contain %#v, got %s", test.desc, want, body)
+			}
+		}
+		for _, unwanted := range test.excludes {
+			if strings.Contains(body, unwanted) {
+				t.Errorf("[%s] expected body not to contain %#v, got %s", test.desc, unwanted, body)
+			}
+		}
+	}
+}
+
 func TestCallbackHandler_Errors(t *testing.T) {
 
-	getClient := middleauth.CallbackReqDecoder(func(r *http.Request) (ctxNext context.Context, client *http.Client, err error) {
+	getClient := middleauth.CallbackReqDecoder(func(w http.ResponseWriter, r *http.Request) (ctxNext context.Context, client *http.Client, err error) {
 		ctxNext = r.Context()
 		// TODO: need mock client
 		return
 	})
-	getClientError := middleauth.CallbackReqDecoder(func(r *http.Request) (ctxNext context.Context, client *http.Client, err error) {
+	getClientError := middleauth.CallbackReqDecoder(func(w http.ResponseWriter, r *http.Request) (ctxNext context.Context, client *http.Client, err error) {
 		err = fmt.Errorf("getClient")
 		return
 	})
+	getClientStateError := middleauth.CallbackReqDecoder(func(w http.ResponseWriter, r *http.Request) (ctxNext context.Context, client *http.Client, err error) {
+		err = &middleauth.LoginError{Type: middleauth.ErrInvalidState}
+		return
+	})
+	getClientDeniedError := middleauth.CallbackReqDecoder(func(w http.ResponseWriter, r *http.Request) (ctxNext context.Context, client *http.Client, err error) {
+		err = &middleauth.LoginError{Type: middleauth.ErrAccessDenied}
+		return
+	})
 
 	getAuthUser := middleauth.AuthUserDecoder(func(ctx context.Context, client *http.Client) (ctxNext context.Context, authUser *middleauth.UserIdentity, err error) {
 		ctxNext = ctx
@@ -354,6 +861,21 @@ func TestCallbackHandler_Errors(t *testing.T) {
 		err = fmt.Errorf("getAuthUser")
 		return
 	})
+	getAuthUserProviderError := middleauth.AuthUserDecoder(func(ctx context.Context, client *http.Client) (ctxNext context.Context, authUser *middleauth.UserIdentity, err error) {
+		ctxNext = ctx
+		err = &middleauth.ProviderError{
+			Provider:   "dummy",
+			URL:        "https://dummy.com/user",
+			StatusCode: http.StatusUnauthorized,
+			Body:       "unauthorized",
+		}
+		return
+	})
+	getAuthUserDomainError := middleauth.AuthUserDecoder(func(ctx context.Context, client *http.Client) (ctxNext context.Context, authUser *middleauth.UserIdentity, err error) {
+		ctxNext = ctx
+		err = &middleauth.LoginError{Type: middleauth.ErrHostedDomainNotAllowed}
+		return
+	})
 
 	findOrCreateUser := middleauth.UserStorageCallback(func(ctx context.Context, authIdentity *middleauth.UserIdentity) (ctxNext context.Context, confirmedUser *middleauth.User, err error) {
 		ctxNext = ctx
@@ -386,8 +908,9 @@ func TestCallbackHandler_Errors(t *testing.T) {
 	ctx.ErrPath = "error"
 
 	tests := []struct {
-		Handler  http.Handler
-		ExptdErr string
+		Handler   http.Handler
+		ExptdErr  string
+		ExptdCode string
 	}{
 		{
 			Handler: middleauth.NewCallbackHandler(
@@ -397,7 +920,30 @@ func TestCallbackHandler_Errors(t *testing.T) {
 				genSessionCookie,
 				ctx,
 			),
-			ExptdErr: "getClient",
+			ExptdErr:  "getClient",
+			ExptdCode: "internal_server_error",
+		},
+		{
+			Handler: middleauth.NewCallbackHandler(
+				getClientStateError,
+				getAuthUser,
+				findOrCreateUser,
+				genSessionCookie,
+				ctx,
+			),
+			ExptdErr:  "login error: invalid login state",
+			ExptdCode: "invalid_state",
+		},
+		{
+			Handler: middleauth.NewCallbackHandler(
+				getClientDeniedError,
+				getAuthUser,
+				findOrCreateUser,
+				genSessionCookie,
+				ctx,
+			),
+			ExptdErr:  "login error: access denied",
+			ExptdCode: "access_denied",
 		},
 		{
 			Handler: middleauth.NewCallbackHandler(
@@ -407,7 +953,30 @@ func TestCallbackHandler_Errors(t *testing.T) {
 				genSessionCookie,
 				ctx,
 			),
-			ExptdErr: "getAuthUser",
+			ExptdErr:  "getAuthUser",
+			ExptdCode: "login_error",
+		},
+		{
+			Handler: middleauth.NewCallbackHandler(
+				getClient,
+				getAuthUserDomainError,
+				findOrCreateUser,
+				genSessionCookie,
+				ctx,
+			),
+			ExptdErr:  "login error: hosted domain not allowed",
+			ExptdCode: "hosted_domain_not_allowed",
+		},
+		{
+			Handler: middleauth.NewCallbackHandler(
+				getClient,
+				getAuthUserProviderError,
+				findOrCreateUser,
+				genSessionCookie,
+				ctx,
+			),
+			ExptdErr:  "provider dummy returned status 401",
+			ExptdCode: "provider_error",
 		},
 		{
 			Handler: middleauth.NewCallbackHandler(
@@ -417,7 +986,8 @@ func TestCallbackHandler_Errors(t *testing.T) {
 				genSessionCookie,
 				ctx,
 			),
-			ExptdErr: "findOrCreateUser",
+			ExptdErr:  "findOrCreateUser",
+			ExptdCode: "login_error",
 		},
 		{
 			Handler: middleauth.NewCallbackHandler(
@@ -427,7 +997,8 @@ func TestCallbackHandler_Errors(t *testing.T) {
 				genSessionCookieError,
 				ctx,
 			),
-			ExptdErr: "genSessionCookie",
+			ExptdErr:  "genSessionCookie",
+			ExptdCode: "internal_server_error",
 		},
 	}
 
@@ -453,6 +1024,245 @@ func TestCallbackHandler_Errors(t *testing.T) {
 			t.Errorf("wanted %#v, got %#v", want, have)
 		} else if parsed.Query().Get("error_description") == "" {
 			t.Error("unexpected empty message field.")
+		} else if want, have := test.ExptdCode, parsed.Query().Get("error"); want != have {
+			t.Errorf("wanted %#v, got %#v", want, have)
+		}
+	}
+}
+
+func TestOAuth2_withPKCE(t *testing.T) {
+
+	// dummy token endpoint that checks the code verifier
+	// against the code challenge sent on redirect
+	var challenge string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+		if base64.RawURLEncoding.EncodeToString(sum[:]) != challenge {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error":"invalid_grant"}`)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"access_token":"dummy-access-token","token_type":"bearer"}`)
+	}))
+	defer ts.Close()
+
+	conf := &oauth2.Config{
+		RedirectURL:  "http://foobar.com/redirect",
+		ClientID:     "foobar-client-id",
+		ClientSecret: "foobar-secret",
+		Endpoint: oauth2.Endpoint{
+			AuthURL:  ts.URL + "/auth",
+			TokenURL: ts.URL + "/token",
+		},
+	}
+	states := middleauth.NewCookieStateStore("dummy-state", "dummy-key")
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "http://foobar.com/login", nil)
+	rawurl, err := middleauth.OAuth2AuthURLFactory(conf, states, middleauth.WithPKCE())(w, r)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	parsed, _ := url.Parse(rawurl)
+	q := parsed.Query()
+	if want, have := "S256", q.Get("code_challenge_method"); want != have {
+		t.Errorf("wanted %#v, got %#v", want, have)
+	}
+	if challenge = q.Get("code_challenge"); challenge == "" {
+		t.Errorf("expected code_challenge, got empty string")
+	}
+
+	// callback with the login state
+	r, _ = http.NewRequest("GET", "http://foobar.com/callback?code=dummy-code&state="+url.QueryEscape(q.Get("state")), nil)
+	for _, cookie := range w.Result().Cookies() {
+		r.AddCookie(cookie)
+	}
+	if _, _, err := middleauth.OAuth2CallbackDecoder(conf, states, middleauth.WithPKCE())(httptest.NewRecorder(), r); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	// callback with a login state started without PKCE
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("GET", "http://foobar.com/login", nil)
+	rawurl, _ = middleauth.OAuth2AuthURLFactory(conf, states)(w, r)
+	parsed, _ = url.Parse(rawurl)
+	if want, have := "", parsed.Query().Get("code_challenge"); want != have {
+		t.Errorf("wanted %#v, got %#v", want, have)
+	}
+	r, _ = http.NewRequest("GET", "http://foobar.com/callback?code=dummy-code&state="+url.QueryEscape(parsed.Query().Get("state")), nil)
+	for _, cookie := range w.Result().Cookies() {
+		r.AddCookie(cookie)
+	}
+	_, _, err = middleauth.OAuth2CallbackDecoder(conf, states, middleauth.WithPKCE())(httptest.NewRecorder(), r)
+	if lerr, ok := err.(*middleauth.LoginError); !ok {
+		t.Errorf("expected *middleauth.LoginError, got %#v", err)
+	} else if want, have := middleauth.ErrInvalidState, lerr.Type; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+}
+
+func TestContext_ReturnURL(t *testing.T) {
+	tests := []struct {
+		publicURL string
+		returnTo  string
+		expected  string
+	}{
+		{
+			publicURL: "https://foobar.com",
+			returnTo:  "/hello/world?foo=bar",
+			expected:  "https://foobar.com/hello/world?foo=bar",
+		},
+		{
+			publicURL: "https://foobar.com",
+			returnTo:  "https://foobar.com/hello#fragment",
+			expected:  "https://foobar.com/hello",
+		},
+		{
+			publicURL: "https://foobar.com/app",
+			returnTo:  "/app/hello",
+			expected:  "https://foobar.com/app/hello",
+		},
+		{
+			publicURL: "https://foobar.com/app",
+			returnTo:  "/app",
+			expected:  "https://foobar.com/app",
+		},
+		{
+			publicURL: "https://foobar.com/app",
+			returnTo:  "/application",
+		},
+		{
+			publicURL: "https://foobar.com/app",
+			returnTo:  "/app/../other",
+		},
+		{
+			publicURL: "https://foobar.com",
+			returnTo:  "https://evil.com/hello",
+		},
+		{
+			publicURL: "https://foobar.com",
+			returnTo:  "//evil.com/hello",
+		},
+		{
+			publicURL: "https://foobar.com",
+			returnTo:  "http://foobar.com/hello",
+		},
+		{
+			publicURL: "https://foobar.com",
+			returnTo:  "https://user@foobar.com/hello",
+		},
+		{
+			publicURL: "https://foobar.com",
+			returnTo:  "javascript:alert(1)",
+		},
+		{
+			publicURL: "https://foobar.com",
+			returnTo:  "",
+		},
+	}
+
+	for _, test := range tests {
+		ctx, _ := middleauth.NewContext(test.publicURL)
+		u, ok := ctx.ReturnURL(test.returnTo)
+		if test.expected == "" {
+			if ok {
+				t.Errorf("[%s] expected not allowed, got %s", test.returnTo, u)
+			}
+			continue
+		}
+		if !ok {
+			t.Errorf("[%s] expected allowed", test.returnTo)
+		} else if want, have := test.expected, u.String(); want != have {
+			t.Errorf("[%s] expected %#v, got %#v", test.returnTo, want, have)
+		}
+	}
+}
+
+func TestCallbackHandler_returnTo(t *testing.T) {
+
+	getAuthUser := middleauth.AuthUserDecoder(func(ctx context.Context, client *http.Client) (ctxNext context.Context, authUser *middleauth.UserIdentity, err error) {
+		ctxNext = ctx
+		authUser = &middleauth.UserIdentity{
+			Name:       "dummy user",
+			Provider:   "dummy provider",
+			ProviderID: "dummy-id",
+		}
+		return
+	})
+	findOrCreateUser := middleauth.UserStorageCallback(func(ctx context.Context, authIdentity *middleauth.UserIdentity) (ctxNext context.Context, confirmedUser *middleauth.User, err error) {
+		ctxNext = ctx
+		confirmedUser = &middleauth.User{
+			Name: authIdentity.Name,
+		}
+		return
+	})
+	genSessionCookie := middleauth.CookieFactory(func(ctx context.Context, in *http.Cookie, confirmedUser *middleauth.User) (out *http.Cookie, err error) {
+		out = &http.Cookie{
+			Name:  "hello-cookie",
+			Value: "dummy-session-cookie",
+		}
+		return
+	})
+
+	ctx, _ := middleauth.NewContext("http://foobar.com/")
+	ctx.SuccessPath = "success"
+	ctx.ErrPath = "error"
+
+	tests := []struct {
+		returnTo string
+		expected string
+	}{
+		{
+			returnTo: "/hello/world",
+			expected: "http://foobar.com/hello/world",
+		},
+		{
+			returnTo: "https://evil.com/hello/world",
+			expected: "http://foobar.com/success",
+		},
+		{
+			returnTo: "",
+			expected: "http://foobar.com/success",
+		},
+	}
+
+	for _, test := range tests {
+		getClient := middleauth.CallbackReqDecoder(func(w http.ResponseWriter, r *http.Request) (ctxNext context.Context, client *http.Client, err error) {
+			ctxNext = middleauth.WithLoginState(r.Context(), &middleauth.LoginState{
+				ReturnTo: test.returnTo,
+			})
+			return
+		})
+		handler := middleauth.NewCallbackHandler(
+			getClient,
+			getAuthUser,
+			findOrCreateUser,
+			genSessionCookie,
+			ctx,
+		)
+
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", "http://foobar.com/oauth2/dummy-provider", nil)
+		handler.ServeHTTP(w, r)
+		if want, have := test.expected, w.Header().Get("Location"); want != have {
+			t.Errorf("[%s] expected %#v, got %#v", test.returnTo, want, have)
+		}
+		if want, have := http.StatusTemporaryRedirect, w.Code; want != have {
+			t.Errorf("[%s] expected %#v, got %#v", test.returnTo, want, have)
+		}
+
+		// form_post callback should be redirected with GET
+		w = httptest.NewRecorder()
+		r, _ = http.NewRequest("POST", "http://foobar.com/oauth2/dummy-provider", nil)
+		handler.ServeHTTP(w, r)
+		if want, have := test.expected, w.Header().Get("Location"); want != have {
+			t.Errorf("[%s] expected %#v, got %#v", test.returnTo, want, have)
+		}
+		if want, have := http.StatusSeeOther, w.Code; want != have {
+			t.Errorf("[%s] expected %#v, got %#v", test.returnTo, want, have)
 		}
 	}
 }
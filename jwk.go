@@ -0,0 +1,410 @@
+package middleauth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
+	"gopkg.in/jose.v1/crypto"
+	"gopkg.in/jose.v1/jws"
+	"gopkg.in/jose.v1/jwt"
+)
+
+// JSONWebKey is a public key in JSON Web Key (RFC 7517) format
+type JSONWebKey struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid,omitempty"`
+	Use       string `json:"use,omitempty"`
+	Algorithm string `json:"alg,omitempty"`
+
+	// RSA public key parameters
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+
+	// EC and OKP public key parameters
+	Curve string `json:"crv,omitempty"`
+	X     string `json:"x,omitempty"`
+	Y     string `json:"y,omitempty"`
+}
+
+// JSONWebKeySet is a set of JSONWebKey
+type JSONWebKeySet struct {
+	Keys []JSONWebKey `json:"keys"`
+}
+
+// NewJSONWebKey encodes the public key of RSA, ECDSA or Ed25519
+// into JSONWebKey for the signing algorithm.
+func NewJSONWebKey(kid, alg string, pub interface{}) (key JSONWebKey, err error) {
+	key = JSONWebKey{
+		KeyID:     kid,
+		Use:       "sig",
+		Algorithm: alg,
+	}
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		key.KeyType = "RSA"
+		key.N = base64.RawURLEncoding.EncodeToString(k.N.Bytes())
+		key.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(k.E)).Bytes())
+	case *ecdsa.PublicKey:
+		key.KeyType = "EC"
+		key.Curve = k.Curve.Params().Name
+		size := (k.Curve.Params().BitSize + 7) / 8
+		key.X = base64.RawURLEncoding.EncodeToString(paddedBytes(k.X, size))
+		key.Y = base64.RawURLEncoding.EncodeToString(paddedBytes(k.Y, size))
+	case ed25519.PublicKey:
+		key.KeyType = "OKP"
+		key.Curve = "Ed25519"
+		key.X = base64.RawURLEncoding.EncodeToString(k)
+	default:
+		err = fmt.Errorf("unsupported public key type %T", pub)
+	}
+	return
+}
+
+// PublicKey decodes the key into *rsa.PublicKey, *ecdsa.PublicKey
+// or ed25519.PublicKey
+func (key JSONWebKey) PublicKey() (pub interface{}, err error) {
+	switch key.KeyType {
+	case "RSA":
+		n, err := decodeBigInt(key.N)
+		if err != nil {
+			return nil, fmt.Errorf("invalid RSA modulus: %s", err.Error())
+		}
+		e, err := decodeBigInt(key.E)
+		if err != nil {
+			return nil, fmt.Errorf("invalid RSA exponent: %s", err.Error())
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch key.Curve {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %#v", key.Curve)
+		}
+		x, err := decodeBigInt(key.X)
+		if err != nil {
+			return nil, fmt.Errorf("invalid EC x coordinate: %s", err.Error())
+		}
+		y, err := decodeBigInt(key.Y)
+		if err != nil {
+			return nil, fmt.Errorf("invalid EC y coordinate: %s", err.Error())
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "OKP":
+		if key.Curve != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %#v", key.Curve)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(key.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid Ed25519 public key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %#v", key.KeyType)
+}
+
+// supports reports if the key can be used for the signing algorithm
+func (key JSONWebKey) supports(alg string) bool {
+	if key.Algorithm != "" && key.Algorithm != alg {
+		return false
+	}
+	if key.Use != "" && key.Use != "sig" {
+		return false
+	}
+	switch alg[:2] {
+	case "RS", "PS":
+		return key.KeyType == "RSA"
+	case "ES":
+		return key.KeyType == "EC"
+	case "Ed":
+		return key.KeyType == "OKP"
+	}
+	return false
+}
+
+func decodeBigInt(str string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(str)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// asymmetricMethod returns the asymmetric signing method of
+// the given algorithm name, or nil if not supported.
+//
+// Symmetric algorithms and "none" are deliberately not supported
+// for tokens signed by a remote party.
+func asymmetricMethod(alg string) crypto.SigningMethod {
+	switch alg {
+	case "RS256", "RS384", "RS512",
+		"PS256", "PS384", "PS512":
+		return jws.GetSigningMethod(alg)
+	case "ES256":
+		return SigningMethodES256
+	case "ES384":
+		return SigningMethodES384
+	case "ES512":
+		return SigningMethodES512
+	case "EdDSA":
+		return SigningMethodEdDSA
+	}
+	return nil
+}
+
+// remoteKeySet fetches and caches a JSON Web Key Set from a URL
+type remoteKeySet struct {
+	url string
+
+	// provider is the id of the login provider of the key
+	// set, if any, for ProviderError of unexpected response
+	provider string
+
+	// cacheFor is the period fetched keys are kept
+	cacheFor time.Duration
+
+	// minRefresh is the minimal period between fetches for
+	// finding a key of unknown key id
+	minRefresh time.Duration
+
+	// timeout bounds each fetch of the key set
+	timeout time.Duration
+
+	mu        sync.Mutex
+	keys      []JSONWebKey
+	fetchedAt time.Time
+	failedAt  time.Time
+	fetching  *keySetFetch
+}
+
+// keySetFetch is a fetch of the key set in progress. Concurrent
+// finds wait for the same fetch instead of fetching again.
+type keySetFetch struct {
+	done chan struct{}
+	keys []JSONWebKey
+	err  error
+}
+
+func newRemoteKeySet(url string) *remoteKeySet {
+	return &remoteKeySet{
+		url:        url,
+		cacheFor:   time.Hour,
+		minRefresh: time.Minute,
+		timeout:    10 * time.Second,
+	}
+}
+
+// find returns keys of the given key id. If kid is empty, all
+// keys are returned. Keys are re-fetched if the cache is expired,
+// or if the kid is not found in cache.
+//
+// If the key set cannot be fetched, the expired keys in cache are
+// used until the key set server is back.
+func (ks *remoteKeySet) find(ctx context.Context, kid string) (keys []JSONWebKey, err error) {
+	ks.mu.Lock()
+	cached, fetchedAt, failedAt := ks.keys, ks.fetchedAt, ks.failedAt
+	ks.mu.Unlock()
+
+	expired := time.Since(fetchedAt) > ks.cacheFor
+	if keys = filterKeys(cached, kid); len(keys) > 0 {
+		// retry a failed fetch no more than once per minRefresh
+		if !expired || time.Since(failedAt) <= ks.minRefresh {
+			return
+		}
+	} else if !expired && time.Since(fetchedAt) <= ks.minRefresh {
+		return
+	}
+
+	// the cache is expired, or the key might be rotated. fetch again.
+	fetched, err := ks.refresh(ctx)
+	if err != nil {
+		if keys = filterKeys(cached, kid); len(keys) > 0 {
+			logrus.WithFields(logrus.Fields{
+				"error": err.Error(),
+				"url":   ks.url,
+			}).Warn("failed to refresh key set, using expired keys")
+			err = nil
+		}
+		return
+	}
+	keys = filterKeys(fetched, kid)
+	return
+}
+
+// refresh fetches the key set into the cache, or waits for the
+// fetch in progress. The fetch is shared by all waiting finds, so
+// it is not bound to the context of any of them but the timeout.
+// Each find stops waiting when its own context is done.
+func (ks *remoteKeySet) refresh(ctx context.Context) (keys []JSONWebKey, err error) {
+	ks.mu.Lock()
+	f := ks.fetching
+	if f == nil {
+		f = &keySetFetch{done: make(chan struct{})}
+		ks.fetching = f
+		go ks.fetchShared(f, contextClient(ctx))
+	}
+	ks.mu.Unlock()
+
+	select {
+	case <-f.done:
+		return f.keys, f.err
+	case <-ctx.Done():
+		return nil, &UnavailableError{Action: "fetch key set", Err: ctx.Err()}
+	}
+}
+
+// fetchShared runs the fetch of refresh and stores the result.
+// The lock is not held during the fetch.
+func (ks *remoteKeySet) fetchShared(f *keySetFetch, client *http.Client) {
+	ctx, cancel := context.WithTimeout(context.Background(), ks.timeout)
+	defer cancel()
+	f.keys, f.err = ks.fetch(ctx, client)
+
+	ks.mu.Lock()
+	if f.err == nil {
+		ks.keys, ks.fetchedAt = f.keys, time.Now()
+	} else {
+		ks.failedAt = time.Now()
+	}
+	ks.fetching = nil
+	ks.mu.Unlock()
+	close(f.done)
+}
+
+// fetch requests the key set with the client
+func (ks *remoteKeySet) fetch(ctx context.Context, client *http.Client) (keys []JSONWebKey, err error) {
+	req, err := http.NewRequest("GET", ks.url, nil)
+	if err != nil {
+		return
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, &UnavailableError{Action: "fetch key set", Err: err}
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, providerResponseLimit))
+	var keySet JSONWebKeySet
+	switch {
+	case err != nil:
+	case resp.StatusCode != http.StatusOK:
+		err = fmt.Errorf("unexpected status %d", resp.StatusCode)
+	default:
+		if err = json.Unmarshal(b, &keySet); err == nil {
+			keys = keySet.Keys
+			return
+		}
+	}
+	if ks.provider != "" {
+		perr := &ProviderError{
+			Provider:   ks.provider,
+			URL:        ks.url,
+			StatusCode: resp.StatusCode,
+			Body:       bodyExcerpt(b),
+		}
+		if resp.StatusCode == http.StatusOK {
+			perr.Err = err
+		}
+		err = perr
+	}
+	return nil, &UnavailableError{Action: "fetch key set", Err: err}
+}
+
+func filterKeys(keys []JSONWebKey, kid string) (found []JSONWebKey) {
+	if kid == "" {
+		return keys
+	}
+	for _, key := range keys {
+		if key.KeyID == kid {
+			found = append(found, key)
+		}
+	}
+	return
+}
+
+// verify parses the raw JWT and verifies its signature with
+// the keys in the key set, then validates the time claims.
+func (ks *remoteKeySet) verify(ctx context.Context, raw string) (claims jws.Claims, err error) {
+	if claims, err = ks.verifySignature(ctx, raw); err != nil {
+		return
+	}
+	if _, ok := claims.Expiration(); !ok {
+		return nil, fmt.Errorf("token has no expiration")
+	}
+	if err = jwt.Claims(claims).Validate(time.Now(), 0, 0); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// verifySignature parses the raw JWT and verifies its signature
+// with the keys in the key set, without validating the claims.
+func (ks *remoteKeySet) verifySignature(ctx context.Context, raw string) (claims jws.Claims, err error) {
+	token, err := parseCompactJWT(raw)
+	if err != nil {
+		return
+	}
+
+	method := asymmetricMethod(token.alg)
+	if method == nil {
+		return nil, fmt.Errorf("unsupported signing algorithm %#v", token.alg)
+	}
+
+	keys, err := ks.find(ctx, token.kid)
+	if err != nil {
+		return
+	}
+
+	err = fmt.Errorf("no key found to verify the token (kid=%#v)", token.kid)
+	for _, key := range keys {
+		if !key.supports(token.alg) {
+			continue
+		}
+		pub, keyErr := key.PublicKey()
+		if keyErr != nil {
+			continue
+		}
+		if err = token.verify(method, pub); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return
+	}
+
+	claims = token.claims
+	return
+}
+
+// defaultHTTPClient is the *http.Client for requests to the
+// providers if none is provided in the context. Requests are
+// bounded by timeout so a hung provider cannot block forever.
+var defaultHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+// contextClient returns the *http.Client in context,
+// as used by the oauth2 package, or defaultHTTPClient.
+func contextClient(ctx context.Context) *http.Client {
+	if client, ok := ctx.Value(oauth2.HTTPClient).(*http.Client); ok && client != nil {
+		return client
+	}
+	return defaultHTTPClient
+}
@@ -0,0 +1,134 @@
+package middleauth
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRemoteKeySet_slowServer(t *testing.T) {
+	var fetched int32
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetched, 1)
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer ts.Close()
+	defer close(release)
+
+	ks := newRemoteKeySet(ts.URL)
+	ks.timeout = 100 * time.Millisecond
+
+	// concurrent finds share the fetch, which is bounded by timeout
+	var wg sync.WaitGroup
+	errs := make([]error, 3)
+	start := time.Now()
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = ks.find(context.Background(), "key-1")
+		}(i)
+	}
+	wg.Wait()
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("expected the fetch to time out, took %s", elapsed)
+	}
+	for i, err := range errs {
+		if _, ok := err.(*UnavailableError); !ok {
+			t.Errorf("[%d] expected *UnavailableError, got %#v", i, err)
+		}
+	}
+	if have := atomic.LoadInt32(&fetched); have > 3 {
+		t.Errorf("expected at most 3 fetches, got %d", have)
+	}
+
+	// a find of cancelled context does not wait for the
+	// fetch in progress or the lock
+	ks.timeout = time.Minute
+	go ks.find(context.Background(), "key-1")
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	done := make(chan error, 1)
+	go func() {
+		_, err := ks.find(ctx, "key-1")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if _, ok := err.(*UnavailableError); !ok {
+			t.Errorf("expected *UnavailableError, got %#v", err)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("expected find to return while another fetch is in progress")
+	}
+}
+
+func TestRemoteKeySet_cancelledFetcher(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+		w.Write([]byte(`{"keys": [{"kty": "EC", "kid": "key-1"}]}`))
+	}))
+	defer ts.Close()
+
+	ks := newRemoteKeySet(ts.URL)
+
+	// the request starting the fetch goes away
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := ks.find(ctx, "key-1"); err == nil {
+		t.Errorf("expected error, got nil")
+	}
+
+	// other requests still get the keys of the shared fetch
+	keys, err := ks.find(context.Background(), "key-1")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if want, have := 1, len(keys); want != have {
+		t.Errorf("expected %d keys, got %d", want, have)
+	}
+}
+
+func TestRemoteKeySet_staleKeys(t *testing.T) {
+	var fetched int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetched, 1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer ts.Close()
+
+	ks := newRemoteKeySet(ts.URL)
+	ks.keys = []JSONWebKey{{KeyType: "EC", KeyID: "key-1"}}
+	ks.fetchedAt = time.Now().Add(-2 * ks.cacheFor)
+
+	// expired keys are used if the key set cannot be fetched
+	for i := 0; i < 2; i++ {
+		keys, err := ks.find(context.Background(), "key-1")
+		if err != nil {
+			t.Fatalf("[%d] unexpected error: %s", i, err)
+		}
+		if want, have := 1, len(keys); want != have {
+			t.Errorf("[%d] expected %d keys, got %d", i, want, have)
+		}
+	}
+	if want, have := int32(1), atomic.LoadInt32(&fetched); want != have {
+		t.Errorf("expected key set fetched %d time(s), got %d", want, have)
+	}
+
+	// keys not in cache are still unavailable
+	if _, err := ks.find(context.Background(), "key-2"); err == nil {
+		t.Errorf("expected error, got nil")
+	} else if _, ok := err.(*UnavailableError); !ok {
+		t.Errorf("expected *UnavailableError, got %#v", err)
+	}
+}
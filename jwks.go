@@ -0,0 +1,92 @@
+package middleauth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/sirupsen/logrus"
+)
+
+// JWKSPath is the conventional path to serve the JSON Web Key Set
+const JWKSPath = "/.well-known/jwks.json"
+
+// JSONWebKeySet returns the public keys of the key set for token
+// verification. HMAC keys are secrets and are never included.
+func (ks *KeySet) JSONWebKeySet() (keySet JSONWebKeySet) {
+	keySet.Keys = []JSONWebKey{}
+	for _, key := range ks.Keys() {
+		if key.Method == nil || asymmetricMethod(key.Method.Alg()) == nil {
+			continue
+		}
+		jwk, err := NewJSONWebKey(key.ID, key.Method.Alg(), key.Public)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error": err.Error(),
+				"kid":   key.ID,
+			}).Warn("failed to encode public key")
+			continue
+		}
+		keySet.Keys = append(keySet.Keys, jwk)
+	}
+	return
+}
+
+// JWKSHandler serves the public keys of the key set as JSON Web Key
+// Set, usually at JWKSPath, for other services to verify the session
+// tokens signed by the key set.
+func JWKSHandler(keys *KeySet) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		if err := json.NewEncoder(w).Encode(keys.JSONWebKeySet()); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error": err.Error(),
+			}).Error("failed to encode key set")
+		}
+	})
+}
+
+// JWKSSessionDecoder return a SessionDecoder that decodes a JWT cookie
+// session verified by the JSON Web Key Set at the given URL, and
+// return the user found. The key set is fetched on demand and cached.
+//
+// Only asymmetric signing algorithms are accepted. See JWTOption
+// for the claims validated.
+func JWKSSessionDecoder(cookieName, jwksURL string, opts ...JWTOption) SessionDecoder {
+	return JWKSTokenDecoder(CookieToken(cookieName), jwksURL, opts...)
+}
+
+// JWKSTokenDecoder return a SessionDecoder that decodes the JWT session
+// token read from the request (e.g. BearerToken), verified by the JSON
+// Web Key Set at the given URL, and return the user found.
+func JWKSTokenDecoder(sessionToken SessionToken, jwksURL string, opts ...JWTOption) SessionDecoder {
+	options := newJWTOptions(opts)
+	keys := newRemoteKeySet(jwksURL)
+	return func(r *http.Request) (ctxNext context.Context, userID string, err error) {
+
+		tokenStr, err := sessionToken(r)
+		if err != nil {
+			return
+		}
+
+		claims, err := keys.verifySignature(r.Context(), tokenStr)
+		if isUnavailable(err) {
+			return
+		}
+		if err == nil {
+			err = options.validate(claims)
+		}
+		if err != nil {
+			err = fmt.Errorf("token reading error (%s)", err.Error())
+			return
+		}
+		return sessionContext(r, tokenStr, claims)
+	}
+}
@@ -0,0 +1,127 @@
+package middleauth_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/yookoala/middleauth"
+	"gopkg.in/jose.v1/crypto"
+)
+
+func TestJWKSHandler(t *testing.T) {
+	rsaKey, _ := middleauth.ParseSigningKey("rsa-key", genKeyPEM(t, "rsa"))
+	ecKey, _ := middleauth.ParseSigningKey("ec-key", genKeyPEM(t, "ec"))
+	edKey, _ := middleauth.ParseSigningKey("ed-key", genKeyPEM(t, "ed25519"))
+	hmacKey := middleauth.NewHMACKey("hmac-key", "some-secret", crypto.SigningMethodHS256)
+	ks, err := middleauth.NewKeySet(edKey, rsaKey, ecKey, hmacKey)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "http://foobar.com"+middleauth.JWKSPath, nil)
+	middleauth.JWKSHandler(ks).ServeHTTP(w, r)
+	if want, have := "application/json", w.Header().Get("Content-Type"); want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+
+	var keySet middleauth.JSONWebKeySet
+	if err := json.NewDecoder(w.Body).Decode(&keySet); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	kids := []string{}
+	for _, key := range keySet.Keys {
+		kids = append(kids, key.KeyID)
+
+		// the keys should decode to the public keys
+		pub, err := key.PublicKey()
+		if err != nil {
+			t.Errorf("[%s] unexpected error: %s", key.KeyID, err)
+			continue
+		}
+		jwk, _ := middleauth.NewJSONWebKey(key.KeyID, key.Algorithm, pub)
+		if want, have := key, jwk; want != have {
+			t.Errorf("[%s] expected %#v, got %#v", key.KeyID, want, have)
+		}
+	}
+	if want, have := `["ed-key","rsa-key","ec-key"]`, toJSON(kids); want != have {
+		t.Errorf("expected %s, got %s", want, have)
+	}
+	if len(keySet.Keys) > 0 {
+		key := keySet.Keys[0]
+		if want, have := "OKP/Ed25519/EdDSA/sig", key.KeyType+"/"+key.Curve+"/"+key.Algorithm+"/"+key.Use; want != have {
+			t.Errorf("expected %#v, got %#v", want, have)
+		}
+	}
+
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("POST", "http://foobar.com"+middleauth.JWKSPath, nil)
+	middleauth.JWKSHandler(ks).ServeHTTP(w, r)
+	if want, have := http.StatusMethodNotAllowed, w.Code; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+}
+
+func toJSON(v interface{}) string {
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+func TestJWKSSessionDecoder(t *testing.T) {
+	key1, _ := middleauth.ParseSigningKey("key-1", genKeyPEM(t, "ec"))
+	key2, _ := middleauth.ParseSigningKey("key-2", genKeyPEM(t, "ed25519"))
+	ks, _ := middleauth.NewKeySet(key1)
+
+	var fetched int
+	jwks := middleauth.JWKSHandler(ks)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetched++
+		jwks.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	issue := func(factory middleauth.CookieFactory, userID string) *http.Request {
+		cookie, err := factory(context.Background(), &http.Cookie{
+			Expires: time.Now().Add(time.Minute),
+		}, &middleauth.User{ID: userID})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		r, _ := http.NewRequest("GET", "http://downstream.com/", nil)
+		r.AddCookie(cookie)
+		return r
+	}
+
+	decoder := middleauth.JWKSSessionDecoder("session", ts.URL+middleauth.JWKSPath)
+	session := middleauth.JWTKeySetSession("session", ks)
+
+	// decode with fetched keys
+	for i := 0; i < 2; i++ {
+		_, userID, err := decoder(issue(session, "user-1"))
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
+		} else if want, have := "user-1", userID; want != have {
+			t.Errorf("expected %#v, got %#v", want, have)
+		}
+	}
+	if want, have := 1, fetched; want != have {
+		t.Errorf("expected key set fetched %d time(s), got %d", want, have)
+	}
+
+	// token signed by a rotated key is not found
+	// in the cache before the minimal refresh period
+	ks.Rotate(key2)
+	if _, _, err := decoder(issue(session, "user-2")); err == nil {
+		t.Errorf("expected error, got nil")
+	}
+
+	// symmetric tokens are never accepted
+	legacy := middleauth.JWTSession("session", "some-secret", crypto.SigningMethodHS256)
+	if _, _, err := decoder(issue(legacy, "user-1")); err == nil {
+		t.Errorf("expected error, got nil")
+	}
+}
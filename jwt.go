@@ -13,7 +13,10 @@ import (
 
 // DecodeTokenStr parses token string into JWT token
 func DecodeTokenStr(key, tokenStr string, method crypto.SigningMethod) (token jwt.JWT, err error) {
-	token, _ = jws.ParseJWT([]byte(tokenStr))
+	if token, err = jws.ParseJWT([]byte(tokenStr)); err != nil {
+		err = fmt.Errorf("error parsing token: %s", err.Error())
+		return
+	}
 	if err = token.Validate([]byte(key), method); err != nil {
 		err = fmt.Errorf("error validating token: %s", err.Error())
 		return
@@ -44,34 +47,171 @@ func authJWTCookie(cookie *http.Cookie, jwtKey string, method crypto.SigningMeth
 	return cookie
 }
 
+// JWTOption configures the claims issued by JWTSession and the
+// validation of JWTSessionDecoder.
+type JWTOption func(opts *jwtOptions)
+
+// jwtOptions contains the JWT claim options
+type jwtOptions struct {
+	issuer    string
+	audience  []string
+	clockSkew time.Duration
+	enrichers []ClaimsEnricher
+}
+
+func newJWTOptions(opts []JWTOption) (options *jwtOptions) {
+	options = &jwtOptions{
+		clockSkew: DefaultClockSkew,
+	}
+	for _, opt := range opts {
+		opt(options)
+	}
+	return
+}
+
+// DefaultClockSkew is the default leeway allowed in validating
+// the time claims of session tokens.
+const DefaultClockSkew = time.Minute
+
+// WithIssuer sets the "iss" claim of session tokens. Decoders will
+// only accept tokens of the issuer.
+func WithIssuer(issuer string) JWTOption {
+	return func(opts *jwtOptions) {
+		opts.issuer = issuer
+	}
+}
+
+// WithAudience sets the "aud" claim of session tokens. Decoders will
+// only accept tokens for any of the audiences.
+//
+// Without the option, the cookie domain, if any, is used as the
+// audience of session tokens and the audience is not validated.
+func WithAudience(audience ...string) JWTOption {
+	return func(opts *jwtOptions) {
+		opts.audience = audience
+	}
+}
+
+// WithClockSkew sets the leeway allowed in validating the time
+// claims of session tokens. Defaults to DefaultClockSkew.
+func WithClockSkew(d time.Duration) JWTOption {
+	return func(opts *jwtOptions) {
+		opts.clockSkew = d
+	}
+}
+
+// WithClaims adds the ClaimsEnricher to add custom claims
+// to session tokens. The enrichers are applied in order.
+func WithClaims(enrichers ...ClaimsEnricher) JWTOption {
+	return func(opts *jwtOptions) {
+		opts.enrichers = append(opts.enrichers, enrichers...)
+	}
+}
+
+// sessionClaims creates the claims of the session token
+// of the user in the cookie
+func (opts *jwtOptions) sessionClaims(ctx context.Context, cookie *http.Cookie, confirmedUser *User) (claims jws.Claims, err error) {
+	jti, err := randomString(16)
+	if err != nil {
+		return
+	}
+
+	// custom claims first, so the enrichers cannot
+	// override the claims below
+	now := time.Now()
+	claims = jws.Claims{}
+	if old := GetSessionClaims(ctx); isSessionRefresh(ctx) && old != nil {
+		// keep the claims, including auth_time, of
+		// the session being refreshed
+		for key, value := range old {
+			claims.Set(key, value)
+		}
+	} else {
+		for _, enrich := range opts.enrichers {
+			if err = enrich(ctx, claims, confirmedUser); err != nil {
+				err = fmt.Errorf("failed to add claims: %s", err.Error())
+				return
+			}
+		}
+		jwt.Claims(claims).SetTime("auth_time", now)
+	}
+
+	claims.Set("id", confirmedUser.ID)
+	claims.Set("name", confirmedUser.Name)
+	claims.SetSubject(confirmedUser.ID)
+	claims.SetIssuedAt(now)
+	claims.SetNotBefore(now)
+	claims.SetExpiration(cookie.Expires)
+	claims.SetJWTID(jti)
+	if opts.issuer != "" {
+		claims.SetIssuer(opts.issuer)
+	}
+	if len(opts.audience) > 0 {
+		claims.SetAudience(opts.audience...)
+	} else if cookie.Domain != "" {
+		claims.SetAudience(cookie.Domain)
+	}
+	return
+}
+
+// validate validates the claims of a session token
+func (opts *jwtOptions) validate(claims jws.Claims) error {
+	now := time.Now()
+	exp, ok := claims.Expiration()
+	if !ok {
+		return fmt.Errorf("token has no expiration")
+	}
+	if now.After(exp.Add(opts.clockSkew)) {
+		return fmt.Errorf("token is expired")
+	}
+	if nbf, ok := claims.NotBefore(); ok && now.Before(nbf.Add(-opts.clockSkew)) {
+		return fmt.Errorf("token is not yet valid")
+	}
+	if iat, ok := claims.IssuedAt(); ok && now.Before(iat.Add(-opts.clockSkew)) {
+		return fmt.Errorf("token is issued in the future")
+	}
+	if opts.issuer != "" {
+		if iss, _ := claims.Issuer(); iss != opts.issuer {
+			return fmt.Errorf("unexpected issuer %#v", iss)
+		}
+	}
+	if len(opts.audience) > 0 {
+		audiences, _ := claims.Audience()
+		if !anyInSlice(audiences, opts.audience) {
+			return fmt.Errorf("unexpected audience %#v", audiences)
+		}
+	}
+	return nil
+}
+
 // JWTSession produces a CookieFractory from given JWT key and signing method
-// to create a JWT based cookie
-func JWTSession(cookieName, jwtKey string, method crypto.SigningMethod) CookieFactory {
+// to create a JWT based cookie. See JWTOption for the claims issued.
+func JWTSession(cookieName, jwtKey string, method crypto.SigningMethod, opts ...JWTOption) CookieFactory {
+	options := newJWTOptions(opts)
 	return func(ctx context.Context, in *http.Cookie, confirmedUser *User) (cookie *http.Cookie, err error) {
 
 		cookie = in
 		cookie.Name = cookieName
 
 		// Create JWS claims with the user info
-		// TODO: need to have middleware for claims
-		claims := jws.Claims{}
-		claims.Set("id", confirmedUser.ID)
-		claims.Set("name", confirmedUser.Name)
-		claims.SetAudience(cookie.Domain)
-		claims.SetExpiration(cookie.Expires)
+		claims, err := options.sessionClaims(ctx, cookie, confirmedUser)
+		if err != nil {
+			return
+		}
 
 		// encode token and store in cookies
-		cookie.Value, _ = EncodeTokenStr(jwtKey, claims, method)
+		cookie.Value, err = EncodeTokenStr(jwtKey, claims, method)
 		return
 	}
 }
 
 // SessionExpires is a middleware for CookieFactory which apply
-// an expiration period to the cookie created.
+// an expiration period to the cookie created. The expiration of
+// sessions refreshed by SessionMiddleware is kept as is.
 func SessionExpires(d time.Duration) func(inner CookieFactory) CookieFactory {
 	return func(inner CookieFactory) CookieFactory {
 		return func(ctx context.Context, in *http.Cookie, confirmedUser *User) (cookie *http.Cookie, err error) {
-			if in == nil {
+			if in == nil || isSessionRefresh(ctx) {
 				return inner(ctx, in, confirmedUser)
 			}
 			cookie = in
@@ -82,33 +222,122 @@ func SessionExpires(d time.Duration) func(inner CookieFactory) CookieFactory {
 }
 
 // JWTSessionDecoder return a SessionDecoder that decodes a JWT cookie session
-// and return the user found.
-func JWTSessionDecoder(cookieName, jwtKey string, method crypto.SigningMethod) SessionDecoder {
-	return func(r *http.Request) (userID string, err error) {
+// and return the user found. See JWTOption for the claims validated.
+func JWTSessionDecoder(cookieName, jwtKey string, method crypto.SigningMethod, opts ...JWTOption) SessionDecoder {
+	return JWTTokenDecoder(CookieToken(cookieName), jwtKey, method, opts...)
+}
+
+// JWTTokenDecoder return a SessionDecoder that decodes the JWT session
+// token read from the request (e.g. BearerToken) and return the user
+// found. See JWTOption for the claims validated.
+func JWTTokenDecoder(sessionToken SessionToken, jwtKey string, method crypto.SigningMethod, opts ...JWTOption) SessionDecoder {
+	options := newJWTOptions(opts)
+	return func(r *http.Request) (ctxNext context.Context, userID string, err error) {
 
-		cookie, err := r.Cookie(cookieName)
+		tokenStr, err := sessionToken(r)
 		if err != nil {
 			return
 		}
 
-		token, err := DecodeTokenStr(jwtKey, cookie.Value, method)
+		token, err := parseCompactJWT(tokenStr)
+		if err == nil {
+			err = token.verify(method, []byte(jwtKey))
+		}
+		if err == nil {
+			err = options.validate(token.claims)
+		}
 		if err != nil {
 			err = fmt.Errorf("token reading error (%s)", err.Error())
 			return
 		}
+		return sessionContext(r, tokenStr, token.claims)
+	}
+}
+
+// JWTKeySetSession produces a CookieFactory that creates a JWT based
+// cookie signed by the active key of the KeySet.
+func JWTKeySetSession(cookieName string, keys *KeySet, opts ...JWTOption) CookieFactory {
+	options := newJWTOptions(opts)
+	return func(ctx context.Context, in *http.Cookie, confirmedUser *User) (cookie *http.Cookie, err error) {
+
+		cookie = in
+		cookie.Name = cookieName
+
+		// Create JWS claims with the user info
+		claims, err := options.sessionClaims(ctx, cookie, confirmedUser)
+		if err != nil {
+			return
+		}
+
+		// encode token and store in cookies
+		cookie.Value, err = keys.Sign(claims)
+		return
+	}
+}
+
+// JWTKeySetSessionDecoder return a SessionDecoder that decodes a JWT
+// cookie session verified by the KeySet and return the user found.
+func JWTKeySetSessionDecoder(cookieName string, keys *KeySet, opts ...JWTOption) SessionDecoder {
+	return JWTKeySetTokenDecoder(CookieToken(cookieName), keys, opts...)
+}
 
-		idRaw := token.Claims().Get("id")
-		if idRaw == nil {
-			err = fmt.Errorf("invalid user id in token (id is nil)")
+// JWTKeySetTokenDecoder return a SessionDecoder that decodes the JWT
+// session token read from the request (e.g. BearerToken), verified by
+// the KeySet, and return the user found.
+func JWTKeySetTokenDecoder(sessionToken SessionToken, keys *KeySet, opts ...JWTOption) SessionDecoder {
+	options := newJWTOptions(opts)
+	return func(r *http.Request) (ctxNext context.Context, userID string, err error) {
+
+		tokenStr, err := sessionToken(r)
+		if err != nil {
 			return
 		}
 
-		switch id := idRaw.(type) {
-		case string:
-			userID = id
-		default:
-			err = fmt.Errorf("invalid user id in token (id should be string)")
+		claims, err := keys.verifySignature(tokenStr)
+		if err == nil {
+			err = options.validate(claims)
+		}
+		if err != nil {
+			err = fmt.Errorf("token reading error (%s)", err.Error())
+			return
 		}
+		return sessionContext(r, tokenStr, claims)
+	}
+}
+
+// sessionContext reads the user id from the claims of session token,
+// and add the claims and the token to the request context.
+func sessionContext(r *http.Request, tokenStr string, claims jws.Claims) (ctxNext context.Context, userID string, err error) {
+	if userID, err = sessionUserID(claims); err != nil {
 		return
 	}
+	ctxNext = withSessionToken(WithSessionClaims(r.Context(), claims), tokenStr)
+	return
+}
+
+// sessionUserID reads the user id from the claims of session token
+func sessionUserID(claims jws.Claims) (userID string, err error) {
+	idRaw := claims.Get("id")
+	if idRaw == nil {
+		err = fmt.Errorf("invalid user id in token (id is nil)")
+		return
+	}
+
+	switch id := idRaw.(type) {
+	case string:
+		userID = id
+	default:
+		err = fmt.Errorf("invalid user id in token (id should be string)")
+	}
+	return
+}
+
+// anyInSlice reports if any of the strings is in the slice
+func anyInSlice(strs, slice []string) bool {
+	for _, str := range strs {
+		if stringInSlice(str, slice) {
+			return true
+		}
+	}
+	return false
 }
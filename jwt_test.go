@@ -2,7 +2,9 @@ package middleauth_test
 
 import (
 	"context"
+	"fmt"
 	"net/http"
+	"net/http/httptest"
 	"testing"
 	"time"
 
@@ -11,6 +13,7 @@ import (
 
 	"gopkg.in/jose.v1/crypto"
 	"gopkg.in/jose.v1/jws"
+	"gopkg.in/jose.v1/jwt"
 )
 
 func TestDecodeTokenStr(t *testing.T) {
@@ -85,6 +88,20 @@ func TestDecodeTokenStr_expired(t *testing.T) {
 	}
 }
 
+func TestDecodeTokenStr_malformed(t *testing.T) {
+	_, err := middleauth.DecodeTokenStr(
+		"abcdef",
+		"not-a-token",
+		crypto.SigningMethodHS256,
+	)
+	if err == nil {
+		t.Fatalf("expected error and got nil")
+	}
+	if want, have := "error parsing token: ", err.Error()[:len("error parsing token: ")]; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+}
+
 func TestEncodeTokenStr(t *testing.T) {
 	key := "tyuiop"
 	claims := jws.Claims{
@@ -160,6 +177,401 @@ func TestJWTSession(t *testing.T) {
 	}
 }
 
+func TestJWTSession_claims(t *testing.T) {
+	jwtKey := "dummy-jwt-key"
+	method := crypto.SigningMethodHS256
+
+	factory := middleauth.JWTSession("dummy-cookie", jwtKey, method,
+		middleauth.WithIssuer("https://auth.foobar.com"),
+		middleauth.WithAudience("https://app.foobar.com"),
+	)
+	confirmedUser := middleauth.User{
+		ID:   "dummy-user",
+		Name: "dummy user",
+	}
+
+	jtis := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		cookie, err := factory(
+			context.TODO(),
+			&http.Cookie{
+				Domain:  "foobar.com",
+				Expires: time.Now().Add(1 * time.Hour),
+			},
+			&confirmedUser,
+		)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err.Error())
+		}
+		token, err := middleauth.DecodeTokenStr(jwtKey, cookie.Value, method)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err.Error())
+		}
+
+		claims := token.Claims()
+		if want, have := "https://auth.foobar.com", claims.Get("iss"); want != have {
+			t.Errorf("expected: %#v, got: %#v", want, have)
+		}
+		if want, have := "dummy-user", claims.Get("sub"); want != have {
+			t.Errorf("expected: %#v, got: %#v", want, have)
+		}
+		if audiences, _ := claims.Audience(); len(audiences) != 1 || audiences[0] != "https://app.foobar.com" {
+			t.Errorf("expected: %#v, got: %#v", []string{"https://app.foobar.com"}, audiences)
+		}
+		if iat, ok := claims.IssuedAt(); !ok || time.Since(iat) > time.Minute {
+			t.Errorf("expected iat of now, got %#v", claims.Get("iat"))
+		}
+		if nbf, ok := claims.NotBefore(); !ok || time.Since(nbf) > time.Minute {
+			t.Errorf("expected nbf of now, got %#v", claims.Get("nbf"))
+		}
+		jti, _ := claims.JWTID()
+		if jti == "" || jtis[jti] {
+			t.Errorf("expected unique jti, got %#v", jti)
+		}
+		jtis[jti] = true
+	}
+
+	// audience defaults to cookie domain
+	cookie, _ := middleauth.JWTSession("dummy-cookie", jwtKey, method)(
+		context.TODO(),
+		&http.Cookie{
+			Domain:  "foobar.com",
+			Expires: time.Now().Add(1 * time.Hour),
+		},
+		&confirmedUser,
+	)
+	token, _ := middleauth.DecodeTokenStr(jwtKey, cookie.Value, method)
+	if audiences, _ := token.Claims().Audience(); len(audiences) != 1 || audiences[0] != "foobar.com" {
+		t.Errorf("expected: %#v, got: %#v", []string{"foobar.com"}, audiences)
+	}
+}
+
+func TestJWTSessionDecoder_validation(t *testing.T) {
+	jwtKey := "dummy-jwt-key"
+	method := crypto.SigningMethodHS256
+
+	encode := func(claims jws.Claims) *http.Request {
+		tokenStr, _ := middleauth.EncodeTokenStr(jwtKey, claims, method)
+		r, _ := http.NewRequest("GET", "/", nil)
+		r.AddCookie(&http.Cookie{Name: "dummy-cookie", Value: tokenStr})
+		return r
+	}
+	newClaims := func(fn func(claims jws.Claims)) jws.Claims {
+		claims := jws.Claims{}
+		claims.Set("id", "dummy-user")
+		claims.SetIssuer("https://auth.foobar.com")
+		claims.SetAudience("https://app.foobar.com")
+		claims.SetIssuedAt(time.Now())
+		claims.SetExpiration(time.Now().Add(time.Hour))
+		if fn != nil {
+			fn(claims)
+		}
+		return claims
+	}
+
+	decoder := middleauth.JWTSessionDecoder("dummy-cookie", jwtKey, method,
+		middleauth.WithIssuer("https://auth.foobar.com"),
+		middleauth.WithAudience("https://app.foobar.com", "https://other.foobar.com"),
+		middleauth.WithClockSkew(30*time.Second),
+	)
+
+	tests := []struct {
+		desc   string
+		claims jws.Claims
+		valid  bool
+	}{
+		{
+			desc:   "valid",
+			claims: newClaims(nil),
+			valid:  true,
+		},
+		{
+			desc: "expired within clock skew",
+			claims: newClaims(func(claims jws.Claims) {
+				claims.SetExpiration(time.Now().Add(-10 * time.Second))
+			}),
+			valid: true,
+		},
+		{
+			desc: "expired",
+			claims: newClaims(func(claims jws.Claims) {
+				claims.SetExpiration(time.Now().Add(-time.Minute))
+			}),
+		},
+		{
+			desc: "no expiration",
+			claims: newClaims(func(claims jws.Claims) {
+				claims.RemoveExpiration()
+			}),
+		},
+		{
+			desc: "not yet valid",
+			claims: newClaims(func(claims jws.Claims) {
+				claims.SetNotBefore(time.Now().Add(time.Minute))
+			}),
+		},
+		{
+			desc: "issued in the future",
+			claims: newClaims(func(claims jws.Claims) {
+				claims.SetIssuedAt(time.Now().Add(time.Minute))
+			}),
+		},
+		{
+			desc: "other issuer",
+			claims: newClaims(func(claims jws.Claims) {
+				claims.SetIssuer("https://evil.com")
+			}),
+		},
+		{
+			desc: "no issuer",
+			claims: newClaims(func(claims jws.Claims) {
+				claims.RemoveIssuer()
+			}),
+		},
+		{
+			desc: "other audience",
+			claims: newClaims(func(claims jws.Claims) {
+				claims.SetAudience("https://evil.com")
+			}),
+		},
+		{
+			desc: "any of the audience",
+			claims: newClaims(func(claims jws.Claims) {
+				claims.SetAudience("https://evil.com", "https://other.foobar.com")
+			}),
+			valid: true,
+		},
+	}
+
+	for _, test := range tests {
+		_, userID, err := decoder(encode(test.claims))
+		if test.valid {
+			if err != nil {
+				t.Errorf("[%s] unexpected error: %s", test.desc, err)
+			} else if want, have := "dummy-user", userID; want != have {
+				t.Errorf("[%s] expected %#v, got %#v", test.desc, want, have)
+			}
+		} else if err == nil {
+			t.Errorf("[%s] expected error, got nil", test.desc)
+		}
+	}
+}
+
+type tenantKey struct{}
+
+func tenantClaim(ctx context.Context, claims jws.Claims, confirmedUser *middleauth.User) error {
+	tenant, _ := ctx.Value(tenantKey{}).(string)
+	if tenant == "" {
+		return fmt.Errorf("no tenant")
+	}
+	claims.Set("tenant", tenant)
+	return nil
+}
+
+func TestJWTSession_enrichers(t *testing.T) {
+	jwtKey := "dummy-jwt-key"
+	method := crypto.SigningMethodHS256
+
+	factory := middleauth.JWTSession("dummy-cookie", jwtKey, method,
+		middleauth.WithClaims(
+			middleauth.AdminClaim,
+			tenantClaim,
+			func(ctx context.Context, claims jws.Claims, confirmedUser *middleauth.User) error {
+				// should not override registered claims
+				claims.Set("id", "evil-user")
+				claims.SetSubject("evil-user")
+				return nil
+			},
+		),
+	)
+	confirmedUser := middleauth.User{
+		ID:      "dummy-user",
+		Name:    "dummy user",
+		IsAdmin: true,
+	}
+
+	ctx := context.WithValue(context.Background(), tenantKey{}, "tenant-1")
+	cookie, err := factory(ctx, &http.Cookie{Expires: time.Now().Add(time.Hour)}, &confirmedUser)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	token, err := middleauth.DecodeTokenStr(jwtKey, cookie.Value, method)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	claims := token.Claims()
+	if want, have := true, claims.Get("is_admin"); want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+	if want, have := "tenant-1", claims.Get("tenant"); want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+	if want, have := "dummy-user", claims.Get("id"); want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+	if want, have := "dummy-user", claims.Get("sub"); want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+
+	// enricher error fails the session
+	if _, err := factory(context.Background(), &http.Cookie{Expires: time.Now().Add(time.Hour)}, &confirmedUser); err == nil {
+		t.Errorf("expected error, got nil")
+	}
+}
+
+func TestSessionMiddleware_claims(t *testing.T) {
+	jwtKey := "dummy-jwt-key"
+	method := crypto.SigningMethodHS256
+
+	factory := middleauth.JWTSession("dummy-cookie", jwtKey, method,
+		middleauth.WithClaims(middleauth.AdminClaim, tenantClaim),
+	)
+	ctx := context.WithValue(context.Background(), tenantKey{}, "tenant-1")
+	cookie, err := factory(ctx, &http.Cookie{Expires: time.Now().Add(time.Hour)}, &middleauth.User{
+		ID:      "dummy-user",
+		Name:    "dummy user",
+		IsAdmin: true,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	var user *middleauth.User
+	var claims jws.Claims
+	handler := middleauth.SessionMiddleware(
+		middleauth.JWTSessionDecoder("dummy-cookie", jwtKey, method),
+		middleauth.UserFromClaims,
+	)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user = middleauth.GetUser(r.Context())
+		claims = middleauth.GetSessionClaims(r.Context())
+	}))
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(cookie)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	if want, have := http.StatusOK, w.Code; want != have {
+		t.Fatalf("expected %#v, got %#v", want, have)
+	}
+	if user == nil {
+		t.Fatalf("expected user, got nil")
+	}
+	if want, have := "dummy-user", user.ID; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+	if want, have := "dummy user", user.Name; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+	if want, have := true, user.IsAdmin; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+	if want, have := "tenant-1", claims.Get("tenant"); want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+}
+
+func TestSessionMiddleware_refresh(t *testing.T) {
+	jwtKey := "dummy-jwt-key"
+	method := crypto.SigningMethodHS256
+	factory := middleauth.SessionExpires(time.Hour)(
+		middleauth.JWTSession("session", jwtKey, method),
+	)
+	handler := middleauth.SessionMiddleware(
+		middleauth.JWTSessionDecoder("session", jwtKey, method),
+		middleauth.UserFromClaims,
+		middleauth.WithSessionRefresh(
+			http.Cookie{Path: "/", HttpOnly: true},
+			factory,
+			0.5,
+			2*time.Hour,
+		),
+	)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	now := time.Now()
+	encode := func(authTime, issued time.Time) string {
+		claims := jws.Claims{}
+		claims.Set("id", "dummy-user")
+		claims.Set("tenant", "tenant-1")
+		claims.SetIssuedAt(issued)
+		claims.SetExpiration(issued.Add(time.Hour))
+		jwt.Claims(claims).SetTime("auth_time", authTime)
+		tokenStr, _ := middleauth.EncodeTokenStr(jwtKey, claims, method)
+		return tokenStr
+	}
+
+	tests := []struct {
+		desc     string
+		token    string
+		refresh  bool
+		expires  time.Time
+		authTime time.Time
+	}{
+		{
+			desc:  "fresh session",
+			token: encode(now, now),
+		},
+		{
+			desc:     "session past half of lifetime",
+			token:    encode(now.Add(-40*time.Minute), now.Add(-40*time.Minute)),
+			refresh:  true,
+			expires:  now.Add(time.Hour),
+			authTime: now.Add(-40 * time.Minute),
+		},
+		{
+			desc:     "refreshed session limited by max lifetime",
+			token:    encode(now.Add(-90*time.Minute), now.Add(-40*time.Minute)),
+			refresh:  true,
+			expires:  now.Add(30 * time.Minute),
+			authTime: now.Add(-90 * time.Minute),
+		},
+		{
+			desc:  "session reached max lifetime",
+			token: encode(now.Add(-2*time.Hour+10*time.Minute), now.Add(-50*time.Minute)),
+		},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.AddCookie(&http.Cookie{Name: "session", Value: test.token})
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		cookies := w.Result().Cookies()
+		if !test.refresh {
+			if want, have := 0, len(cookies); want != have {
+				t.Errorf("[%s] expected %#v, got %#v", test.desc, want, have)
+			}
+			continue
+		}
+		if want, have := 1, len(cookies); want != have {
+			t.Errorf("[%s] expected %#v, got %#v", test.desc, want, have)
+			continue
+		}
+		if want, have := test.expires, cookies[0].Expires; have.Before(want.Add(-time.Second)) || have.After(want.Add(time.Second)) {
+			t.Errorf("[%s] expected expires %s, got %s", test.desc, want, have)
+		}
+		token, err := middleauth.DecodeTokenStr(jwtKey, cookies[0].Value, method)
+		if err != nil {
+			t.Errorf("[%s] unexpected error: %s", test.desc, err.Error())
+			continue
+		}
+		claims := jwt.Claims(token.Claims())
+		if want, have := "tenant-1", claims.Get("tenant"); want != have {
+			t.Errorf("[%s] expected %#v, got %#v", test.desc, want, have)
+		}
+		if authTime, _ := claims.GetTime("auth_time"); authTime.Unix() != test.authTime.Unix() {
+			t.Errorf("[%s] expected auth_time %s, got %s", test.desc, test.authTime, authTime)
+		}
+	}
+}
+
+func TestUserFromClaims_noClaims(t *testing.T) {
+	if _, err := middleauth.UserFromClaims(context.Background(), "dummy-user"); err == nil {
+		t.Errorf("expected error, got nil")
+	}
+}
+
 func TestSessionExpires(t *testing.T) {
 	m := middleauth.SessionExpires(123 * time.Hour)
 	factory := func(ctx context.Context, in *http.Cookie, confirmedUser *middleauth.User) (cookie *http.Cookie, err error) {
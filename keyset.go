@@ -0,0 +1,250 @@
+package middleauth
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"gopkg.in/jose.v1/crypto"
+	"gopkg.in/jose.v1/jws"
+	"gopkg.in/jose.v1/jwt"
+)
+
+// SigningKey is a key to sign or verify JWT with.
+type SigningKey struct {
+
+	// ID is the key id, sent as the "kid" header of
+	// the tokens signed by the key.
+	ID string
+
+	// Method is the signing method of the key.
+	Method crypto.SigningMethod
+
+	// Private is the key to sign tokens with. Nil for
+	// keys that only verify tokens.
+	Private interface{}
+
+	// Public is the key to verify tokens with. For HMAC
+	// keys, it is the same as Private.
+	Public interface{}
+}
+
+// NewHMACKey creates a SigningKey of the HMAC secret with
+// the method, such as crypto.SigningMethodHS256.
+//
+// It may be added to KeySet for the tokens signed by the
+// JWTSession with the same secret to remain valid.
+func NewHMACKey(kid, secret string, method crypto.SigningMethod) SigningKey {
+	return SigningKey{
+		ID:      kid,
+		Method:  method,
+		Private: []byte(secret),
+		Public:  []byte(secret),
+	}
+}
+
+// LoadSigningKey reads the PEM encoded key file into SigningKey.
+// See ParseSigningKey for the supported formats.
+func LoadSigningKey(kid, filename string) (key SigningKey, err error) {
+	keyPEM, err := ioutil.ReadFile(filename)
+	if err != nil {
+		err = fmt.Errorf("failed to read key file: %s", err.Error())
+		return
+	}
+	return ParseSigningKey(kid, keyPEM)
+}
+
+// ParseSigningKey parses the PEM encoded key into SigningKey.
+//
+// RSA, ECDSA (P-256, P-384 and P-521) and Ed25519 keys are
+// supported, either as private key in PKCS #8, PKCS #1 or SEC 1
+// format, or as public key in PKIX format for verification only.
+// The signing method is chosen by the key type: RS256 for RSA,
+// ES256, ES384 or ES512 for ECDSA by the curve, and EdDSA for
+// Ed25519.
+func ParseSigningKey(kid string, keyPEM []byte) (key SigningKey, err error) {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		err = fmt.Errorf("no PEM encoded key found")
+		return
+	}
+
+	var parsed interface{}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		parsed, err = x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		parsed, err = x509.ParsePKIXPublicKey(block.Bytes)
+	default:
+		err = fmt.Errorf("unsupported PEM block type %#v", block.Type)
+		return
+	}
+	if err != nil {
+		err = fmt.Errorf("failed to parse key: %s", err.Error())
+		return
+	}
+
+	key.ID = kid
+	switch k := parsed.(type) {
+	case *rsa.PrivateKey:
+		key.Private, key.Public = k, &k.PublicKey
+	case *rsa.PublicKey:
+		key.Public = k
+	case *ecdsa.PrivateKey:
+		key.Private, key.Public = k, &k.PublicKey
+	case *ecdsa.PublicKey:
+		key.Public = k
+	case ed25519.PrivateKey:
+		key.Private, key.Public = k, k.Public()
+	case ed25519.PublicKey:
+		key.Public = k
+	default:
+		err = fmt.Errorf("unsupported key type %T", parsed)
+		return
+	}
+	key.Method, err = publicKeyMethod(key.Public)
+	return
+}
+
+// publicKeyMethod returns the default signing method of
+// the public key.
+func publicKeyMethod(pub interface{}) (method crypto.SigningMethod, err error) {
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		return crypto.SigningMethodRS256, nil
+	case *ecdsa.PublicKey:
+		switch k.Curve {
+		case elliptic.P256():
+			return SigningMethodES256, nil
+		case elliptic.P384():
+			return SigningMethodES384, nil
+		case elliptic.P521():
+			return SigningMethodES512, nil
+		}
+		return nil, fmt.Errorf("unsupported curve %s", k.Curve.Params().Name)
+	case ed25519.PublicKey:
+		return SigningMethodEdDSA, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %T", pub)
+}
+
+// NewKeySet creates a KeySet that signs tokens with the active
+// key, and verifies tokens with the active key or any of the
+// verification keys.
+func NewKeySet(active SigningKey, verificationKeys ...SigningKey) (ks *KeySet, err error) {
+	if active.Private == nil || active.Method == nil {
+		err = fmt.Errorf("active key %#v cannot sign tokens", active.ID)
+		return
+	}
+	ks = &KeySet{
+		active: active,
+		keys:   verificationKeys,
+	}
+	return
+}
+
+// KeySet is a set of keys to sign and verify JWT. Tokens are
+// signed by the active key with its id in the "kid" header,
+// and verified by the key of the same id.
+//
+// To rotate keys, make the new key active and keep the previous
+// one as a verification key until the tokens signed by it expire.
+// KeySet is safe for concurrent use.
+type KeySet struct {
+	mu     sync.RWMutex
+	active SigningKey
+	keys   []SigningKey
+}
+
+// Rotate sets the given key as the active key. The previous
+// active key is kept as verification key.
+func (ks *KeySet) Rotate(active SigningKey) error {
+	if active.Private == nil || active.Method == nil {
+		return fmt.Errorf("active key %#v cannot sign tokens", active.ID)
+	}
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	ks.keys = append([]SigningKey{ks.active}, ks.keys...)
+	ks.active = active
+	return nil
+}
+
+// Remove removes the verification key of the given id. The
+// tokens signed by it will no longer be valid.
+func (ks *KeySet) Remove(kid string) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	keys := make([]SigningKey, 0, len(ks.keys))
+	for _, key := range ks.keys {
+		if key.ID != kid {
+			keys = append(keys, key)
+		}
+	}
+	ks.keys = keys
+}
+
+// Keys returns the active key followed by the verification keys.
+func (ks *KeySet) Keys() []SigningKey {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	return append([]SigningKey{ks.active}, ks.keys...)
+}
+
+// Sign encodes the claims as a JWT string signed by the active key
+func (ks *KeySet) Sign(claims jws.Claims) (tokenStr string, err error) {
+	ks.mu.RLock()
+	active := ks.active
+	ks.mu.RUnlock()
+	return signJWT(active.Method, active.Private, active.ID, claims)
+}
+
+// Verify verifies the signature of the JWT string with the key of
+// the "kid" header, then validates the time claims. Tokens without
+// "kid" header are verified by all keys of the same algorithm.
+func (ks *KeySet) Verify(tokenStr string) (claims jws.Claims, err error) {
+	if claims, err = ks.verifySignature(tokenStr); err != nil {
+		return
+	}
+	if err = jwt.Claims(claims).Validate(time.Now(), 0, 0); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// verifySignature verifies the signature of the JWT string
+// and returns the claims without validation.
+func (ks *KeySet) verifySignature(tokenStr string) (claims jws.Claims, err error) {
+	token, err := parseCompactJWT(tokenStr)
+	if err != nil {
+		return
+	}
+
+	err = fmt.Errorf("no key found to verify the token (kid=%#v)", token.kid)
+	for _, key := range ks.Keys() {
+		if key.Method == nil || key.Method.Alg() != token.alg {
+			continue
+		}
+		if token.kid != "" && key.ID != token.kid {
+			continue
+		}
+		if err = token.verify(key.Method, key.Public); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return
+	}
+	claims = token.claims
+	return
+}
@@ -0,0 +1,267 @@
+package middleauth_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yookoala/middleauth"
+	"gopkg.in/jose.v1/crypto"
+	"gopkg.in/jose.v1/jws"
+)
+
+// genKeyPEM generates private key PEM of the key type
+func genKeyPEM(t *testing.T, keyType string) []byte {
+	var block *pem.Block
+	switch keyType {
+	case "rsa":
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		block = &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}
+	case "ec":
+		key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		b, _ := x509.MarshalECPrivateKey(key)
+		block = &pem.Block{Type: "EC PRIVATE KEY", Bytes: b}
+	case "ed25519":
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		b, _ := x509.MarshalPKCS8PrivateKey(key)
+		block = &pem.Block{Type: "PRIVATE KEY", Bytes: b}
+	}
+	return pem.EncodeToMemory(block)
+}
+
+// publicKeyPEM encodes the public key of the signing key in PKIX format
+func publicKeyPEM(t *testing.T, key middleauth.SigningKey) []byte {
+	b, err := x509.MarshalPKIXPublicKey(key.Public)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: b})
+}
+
+func sessionClaims(id string, expires time.Time) jws.Claims {
+	claims := jws.Claims{}
+	claims.Set("id", id)
+	claims.SetExpiration(expires)
+	return claims
+}
+
+func TestParseSigningKey(t *testing.T) {
+	tests := []struct {
+		keyType string
+		alg     string
+	}{
+		{keyType: "rsa", alg: "RS256"},
+		{keyType: "ec", alg: "ES384"},
+		{keyType: "ed25519", alg: "EdDSA"},
+	}
+	for _, test := range tests {
+		key, err := middleauth.ParseSigningKey("key-1", genKeyPEM(t, test.keyType))
+		if err != nil {
+			t.Errorf("[%s] unexpected error: %s", test.keyType, err)
+			continue
+		}
+		if want, have := test.alg, key.Method.Alg(); want != have {
+			t.Errorf("[%s] expected %#v, got %#v", test.keyType, want, have)
+		}
+		if key.Private == nil {
+			t.Errorf("[%s] expected private key, got nil", test.keyType)
+		}
+
+		// sign and verify
+		ks, err := middleauth.NewKeySet(key)
+		if err != nil {
+			t.Errorf("[%s] unexpected error: %s", test.keyType, err)
+			continue
+		}
+		tokenStr, err := ks.Sign(sessionClaims("user-1", time.Now().Add(time.Minute)))
+		if err != nil {
+			t.Errorf("[%s] unexpected error: %s", test.keyType, err)
+			continue
+		}
+		header, _ := base64.RawURLEncoding.DecodeString(strings.Split(tokenStr, ".")[0])
+		var headerFields map[string]string
+		json.Unmarshal(header, &headerFields)
+		if want, have := "key-1", headerFields["kid"]; want != have {
+			t.Errorf("[%s] expected %#v, got %#v", test.keyType, want, have)
+		}
+		if want, have := test.alg, headerFields["alg"]; want != have {
+			t.Errorf("[%s] expected %#v, got %#v", test.keyType, want, have)
+		}
+
+		// verify with the public key only
+		pub, err := middleauth.ParseSigningKey("key-1", publicKeyPEM(t, key))
+		if err != nil {
+			t.Errorf("[%s] unexpected error: %s", test.keyType, err)
+			continue
+		}
+		if pub.Private != nil {
+			t.Errorf("[%s] expected no private key, got %#v", test.keyType, pub.Private)
+		}
+		if _, err := middleauth.NewKeySet(pub); err == nil {
+			t.Errorf("[%s] expected error for verification only active key, got nil", test.keyType)
+		}
+		other, _ := middleauth.ParseSigningKey("key-2", genKeyPEM(t, "ec"))
+		verifier, _ := middleauth.NewKeySet(other, pub)
+		claims, err := verifier.Verify(tokenStr)
+		if err != nil {
+			t.Errorf("[%s] unexpected error: %s", test.keyType, err)
+		} else if want, have := "user-1", claims.Get("id"); want != have {
+			t.Errorf("[%s] expected %#v, got %#v", test.keyType, want, have)
+		}
+
+		// tampered token
+		parts := strings.Split(tokenStr, ".")
+		parts[1] = base64.RawURLEncoding.EncodeToString([]byte(`{"id":"admin","exp":9999999999}`))
+		if _, err := verifier.Verify(strings.Join(parts, ".")); err == nil {
+			t.Errorf("[%s] expected error for tampered token, got nil", test.keyType)
+		}
+	}
+
+	if _, err := middleauth.ParseSigningKey("key-1", []byte("not a pem")); err == nil {
+		t.Errorf("expected error, got nil")
+	}
+}
+
+func TestLoadSigningKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "middleauth-keys")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "key.pem")
+	ioutil.WriteFile(filename, genKeyPEM(t, "ed25519"), 0600)
+	key, err := middleauth.LoadSigningKey("key-1", filename)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if want, have := "EdDSA", key.Method.Alg(); want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+	if _, err := middleauth.LoadSigningKey("key-1", filepath.Join(dir, "not-exists.pem")); err == nil {
+		t.Errorf("expected error, got nil")
+	}
+}
+
+func TestKeySet_rotate(t *testing.T) {
+	key1, _ := middleauth.ParseSigningKey("key-1", genKeyPEM(t, "ec"))
+	key2, _ := middleauth.ParseSigningKey("key-2", genKeyPEM(t, "ec"))
+	ks, err := middleauth.NewKeySet(key1)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	token1, _ := ks.Sign(sessionClaims("user-1", time.Now().Add(time.Minute)))
+	if err := ks.Rotate(key2); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	token2, _ := ks.Sign(sessionClaims("user-2", time.Now().Add(time.Minute)))
+
+	// tokens of both keys are valid
+	if _, err := ks.Verify(token1); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if _, err := ks.Verify(token2); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if want, have := 2, len(ks.Keys()); want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+
+	// tokens of removed key are no longer valid
+	ks.Remove("key-1")
+	if _, err := ks.Verify(token1); err == nil {
+		t.Errorf("expected error, got nil")
+	}
+	if _, err := ks.Verify(token2); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
+
+func TestKeySet_expired(t *testing.T) {
+	key, _ := middleauth.ParseSigningKey("key-1", genKeyPEM(t, "ed25519"))
+	ks, _ := middleauth.NewKeySet(key)
+	tokenStr, _ := ks.Sign(sessionClaims("user-1", time.Now().Add(-time.Minute)))
+	if _, err := ks.Verify(tokenStr); err == nil {
+		t.Errorf("expected error, got nil")
+	}
+}
+
+func TestJWTKeySetSession(t *testing.T) {
+	key, _ := middleauth.ParseSigningKey("key-1", genKeyPEM(t, "ec"))
+
+	// tokens of the previous JWTSession stay valid
+	legacy := middleauth.NewHMACKey("", "legacy-secret", crypto.SigningMethodHS256)
+	ks, err := middleauth.NewKeySet(key, legacy)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	tests := []struct {
+		desc    string
+		factory middleauth.CookieFactory
+	}{
+		{
+			desc:    "key set session",
+			factory: middleauth.JWTKeySetSession("session", ks),
+		},
+		{
+			desc:    "legacy session",
+			factory: middleauth.JWTSession("session", "legacy-secret", crypto.SigningMethodHS256),
+		},
+	}
+
+	decoder := middleauth.JWTKeySetSessionDecoder("session", ks)
+	for _, test := range tests {
+		cookie, err := test.factory(context.Background(), &http.Cookie{
+			Expires: time.Now().Add(time.Minute),
+		}, &middleauth.User{ID: "user-1"})
+		if err != nil {
+			t.Errorf("[%s] unexpected error: %s", test.desc, err)
+			continue
+		}
+		r, _ := http.NewRequest("GET", "/", nil)
+		r.AddCookie(cookie)
+		_, userID, err := decoder(r)
+		if err != nil {
+			t.Errorf("[%s] unexpected error: %s", test.desc, err)
+		} else if want, have := "user-1", userID; want != have {
+			t.Errorf("[%s] expected %#v, got %#v", test.desc, want, have)
+		}
+	}
+
+	// token signed by other secret
+	cookie, _ := middleauth.JWTSession("session", "other-secret", crypto.SigningMethodHS256)(
+		context.Background(),
+		&http.Cookie{Expires: time.Now().Add(time.Minute)},
+		&middleauth.User{ID: "user-1"},
+	)
+	r, _ := http.NewRequest("GET", "/", nil)
+	r.AddCookie(cookie)
+	if _, _, err := decoder(r); err == nil {
+		t.Errorf("expected error, got nil")
+	}
+}
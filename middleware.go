@@ -2,16 +2,28 @@ package middleauth
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/go-midway/midway"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/jose.v1/jws"
+	"gopkg.in/jose.v1/jwt"
 )
 
 type contextKey int
 
 const (
 	userKey contextKey = iota
+	loginStateKey
+	oauth2TokenKey
+	appleUserNameKey
+	sessionClaimsKey
+	sessionKey
+	sessionRefreshKey
+	sessionTokenKey
 )
 
 // WithUser add a *User to a given context
@@ -26,42 +38,309 @@ func GetUser(ctx context.Context) (user *User) {
 	return
 }
 
-// SessionDecoder decodes the request into userID
-type SessionDecoder func(r *http.Request) (userID string, err error)
+// WithSessionClaims add the jws.Claims of session token to a given context
+func WithSessionClaims(parent context.Context, claims jws.Claims) context.Context {
+	return context.WithValue(parent, sessionClaimsKey, claims)
+}
+
+// GetSessionClaims gets the jws.Claims of session token, if exists,
+// from a context
+func GetSessionClaims(ctx context.Context) (claims jws.Claims) {
+	claimsRaw := ctx.Value(sessionClaimsKey)
+	claims, _ = claimsRaw.(jws.Claims)
+	return
+}
+
+// WithSession add the *Session of a server-side session to a given context
+func WithSession(parent context.Context, session *Session) context.Context {
+	return context.WithValue(parent, sessionKey, session)
+}
+
+// GetSession gets the *Session, if exists, from a context
+func GetSession(ctx context.Context) (session *Session) {
+	sessionRaw := ctx.Value(sessionKey)
+	session, _ = sessionRaw.(*Session)
+	return
+}
 
-// RetrieveUser retrieves a user by the given user id
+// SessionDecoder decodes the request into userID. The returned
+// context, if not nil, is passed on to RetrieveUser and the inner
+// handler, such as the one with the session claims.
+type SessionDecoder func(r *http.Request) (ctxNext context.Context, userID string, err error)
+
+// UserIDDecoder decodes the request into userID only. It is the
+// SessionDecoder signature of earlier versions of middleauth.
+type UserIDDecoder func(r *http.Request) (userID string, err error)
+
+// SessionDecoderOf adapts a UserIDDecoder into SessionDecoder.
+// The request context is passed on as is.
+func SessionDecoderOf(decode UserIDDecoder) SessionDecoder {
+	return func(r *http.Request) (ctxNext context.Context, userID string, err error) {
+		userID, err = decode(r)
+		return
+	}
+}
+
+// RetrieveUser retrieves a user by the given user id. Returns
+// nil user if the user is not found.
 type RetrieveUser func(ctx context.Context, id string) (*User, error)
 
+// withSessionRefresh marks the context for CookieFactory
+// to refresh the current session in it.
+func withSessionRefresh(parent context.Context) context.Context {
+	return context.WithValue(parent, sessionRefreshKey, true)
+}
+
+// isSessionRefresh tells if the CookieFactory is called
+// to refresh the current session in the context.
+func isSessionRefresh(ctx context.Context) bool {
+	refresh, _ := ctx.Value(sessionRefreshKey).(bool)
+	return refresh
+}
+
+// withSessionToken add the session token string, as read
+// from the request, to a given context
+func withSessionToken(parent context.Context, tokenStr string) context.Context {
+	return context.WithValue(parent, sessionTokenKey, tokenStr)
+}
+
+// isCookieSession tells if the session token in the context
+// is read from a cookie of the request, not from other source
+// such as the Authorization header.
+func isCookieSession(ctx context.Context, r *http.Request) bool {
+	tokenStr, _ := ctx.Value(sessionTokenKey).(string)
+	if tokenStr == "" {
+		return false
+	}
+	for _, cookie := range r.Cookies() {
+		if cookie.Value == tokenStr {
+			return true
+		}
+	}
+	return false
+}
+
+// SessionOption configures SessionMiddleware
+type SessionOption func(opts *sessionOptions)
+
+// sessionOptions contains the SessionMiddleware options
+type sessionOptions struct {
+	refresh        *sessionRefresh
+	invalidSession InvalidSessionHandler
+}
+
+// InvalidSessionHandler handles the request of an invalid session,
+// such as expired or tampered token, or the user of the session is
+// not found. The inner handler of SessionMiddleware is given to
+// continue the request as anonymous.
+//
+// The error is for logging only and should not be sent to clients.
+type InvalidSessionHandler func(w http.ResponseWriter, r *http.Request, inner http.Handler, err error)
+
+// WithInvalidSessionHandler sets the InvalidSessionHandler of
+// SessionMiddleware. Defaults to RejectInvalidSession.
+func WithInvalidSessionHandler(handler InvalidSessionHandler) SessionOption {
+	return func(opts *sessionOptions) {
+		opts.invalidSession = handler
+	}
+}
+
+// RejectInvalidSession implements InvalidSessionHandler. It
+// responds with 400 Bad Request.
+func RejectInvalidSession(w http.ResponseWriter, r *http.Request, inner http.Handler, err error) {
+	w.WriteHeader(http.StatusBadRequest)
+	fmt.Fprint(w, "bad request: invalid session")
+}
+
+// AnonymousInvalidSession creates an InvalidSessionHandler that
+// clears the session cookie, if any, and continues the request as
+// anonymous. The cookie should have the Name, Path and Domain of
+// the session cookie.
+func AnonymousInvalidSession(cookie http.Cookie) InvalidSessionHandler {
+	return func(w http.ResponseWriter, r *http.Request, inner http.Handler, err error) {
+		if _, cookieErr := r.Cookie(cookie.Name); cookieErr == nil {
+			cookie.Value = ""
+			cookie.Expires = time.Unix(0, 0)
+			cookie.MaxAge = -1
+			http.SetCookie(w, &cookie)
+		}
+		inner.ServeHTTP(w, r)
+	}
+}
+
+// ProblemInvalidSession implements InvalidSessionHandler. It
+// responds with 401 Unauthorized in JSON problem details format
+// (RFC 7807) for API clients.
+func ProblemInvalidSession(w http.ResponseWriter, r *http.Request, inner http.Handler, err error) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(http.StatusUnauthorized)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"type":   "about:blank",
+		"title":  http.StatusText(http.StatusUnauthorized),
+		"status": http.StatusUnauthorized,
+		"detail": "invalid session",
+	})
+}
+
+// sessionRefresh contains the options of sliding session
+type sessionRefresh struct {
+	cookie      http.Cookie
+	factory     CookieFactory
+	after       float64
+	maxLifetime time.Duration
+}
+
+// WithSessionRefresh makes SessionMiddleware reissue the session
+// cookie by the CookieFactory once the session is past the given
+// fraction (e.g. 0.5) of its lifetime. The reissued session has the
+// same lifetime and claims as the current one, but never expires
+// later than maxLifetime after the user logged in. Zero maxLifetime
+// means no limit.
+//
+// The cookie is the template of the reissued cookie (e.g. Path,
+// Secure, HttpOnly). Only sessions of JWTSession, JWTKeySetSession
+// and StoreSession can be refreshed. Sessions of token not read from
+// a cookie (e.g. BearerToken) are never refreshed.
+func WithSessionRefresh(cookie http.Cookie, factory CookieFactory, after float64, maxLifetime time.Duration) SessionOption {
+	return func(opts *sessionOptions) {
+		opts.refresh = &sessionRefresh{
+			cookie:      cookie,
+			factory:     factory,
+			after:       after,
+			maxLifetime: maxLifetime,
+		}
+	}
+}
+
+// sessionLifetime reads the issue time, expiration time and the
+// login time of the current session in the context.
+func sessionLifetime(ctx context.Context) (issued, expires, authTime time.Time, ok bool) {
+	if session := GetSession(ctx); session != nil {
+		return session.CreatedAt, session.Expires, session.AuthTime, true
+	}
+	if claims := GetSessionClaims(ctx); claims != nil {
+		if issued, ok = claims.IssuedAt(); !ok {
+			return
+		}
+		if expires, ok = claims.Expiration(); !ok {
+			return
+		}
+		if authTime, ok = jwt.Claims(claims).GetTime("auth_time"); !ok {
+			authTime = issued
+		}
+		return issued, expires, authTime, true
+	}
+	return
+}
+
+// refresh reissues the session cookie of the user if the
+// current session is due to refresh.
+func (refresh *sessionRefresh) refresh(ctx context.Context, w http.ResponseWriter, user *User) {
+	issued, expires, authTime, ok := sessionLifetime(ctx)
+	if !ok {
+		return
+	}
+	now := time.Now()
+	lifetime := expires.Sub(issued)
+	if now.Sub(issued) < time.Duration(float64(lifetime)*refresh.after) {
+		return
+	}
+	newExpires := now.Add(lifetime)
+	if refresh.maxLifetime > 0 && newExpires.After(authTime.Add(refresh.maxLifetime)) {
+		newExpires = authTime.Add(refresh.maxLifetime)
+	}
+	if !newExpires.After(expires) {
+		// reached the max lifetime
+		return
+	}
+
+	cookie := refresh.cookie
+	cookie.Expires = newExpires
+	refreshed, err := refresh.factory(withSessionRefresh(ctx), &cookie, user)
+	if err != nil {
+		// failing to refresh should not fail the request
+		logrus.WithFields(logrus.Fields{
+			"error":   err.Error(),
+			"user.id": user.ID,
+		}).Error("failed to refresh session")
+		return
+	}
+	http.SetCookie(w, refreshed)
+}
+
 // SessionMiddleware retrieves the session user, if any, from
-// the given cookie key and storage access.
-func SessionMiddleware(decodeSession SessionDecoder, retrieveUser RetrieveUser) midway.Middleware {
+// the given cookie key and storage access. See SessionOption
+// for the options.
+//
+// Requests without session token are passed to the inner handler
+// as anonymous. Requests of invalid session, or of a user that is
+// not found, are handled by the InvalidSessionHandler. Requests of
+// session that cannot be checked (see UnavailableError) are
+// responded with 503 Service Unavailable.
+func SessionMiddleware(decodeSession SessionDecoder, retrieveUser RetrieveUser, opts ...SessionOption) midway.Middleware {
+	options := &sessionOptions{
+		invalidSession: RejectInvalidSession,
+	}
+	for _, opt := range opts {
+		opt(options)
+	}
 	return func(inner http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
 			// decode user id from session
-			userID, err := decodeSession(r)
-			if err == http.ErrNoCookie {
+			ctx, userID, err := decodeSession(r)
+			if isNoCredentials(err) {
 				// ignore the middleware logic
 				// and go to the inner handler
 				inner.ServeHTTP(w, r)
 				return
+			} else if isUnavailable(err) {
+				// the session might be valid. keep the cookie
+				// and let the client retry later.
+				logrus.WithFields(logrus.Fields{
+					"error": err.Error(),
+				}).Error("failed to check session")
+				w.WriteHeader(http.StatusServiceUnavailable)
+				fmt.Fprint(w, "service unavailable")
+				return
 			} else if err != nil {
-				w.WriteHeader(http.StatusBadRequest)
-				fmt.Fprintf(w, "bad request: %s", err.Error())
+				logrus.WithFields(logrus.Fields{
+					"error": err.Error(),
+				}).Info("invalid session")
+				options.invalidSession(w, r, inner, err)
 				return
 			}
 
+			if ctx == nil {
+				ctx = r.Context()
+			}
+
 			// get user of the user id
-			user, err := retrieveUser(r.Context(), userID)
+			user, err := retrieveUser(ctx, userID)
 			if err != nil {
-				w.WriteHeader(http.StatusBadRequest)
-				fmt.Fprintf(w, "bad request: %s", err.Error())
+				logrus.WithFields(logrus.Fields{
+					"error":   err.Error(),
+					"user.id": userID,
+				}).Error("failed to retrieve session user")
+				w.WriteHeader(http.StatusInternalServerError)
+				fmt.Fprint(w, "internal server error")
 				return
 			}
+			if user == nil {
+				logrus.WithFields(logrus.Fields{
+					"user.id": userID,
+				}).Info("session user not found")
+				options.invalidSession(w, r, inner, ErrUserNotFound)
+				return
+			}
+
+			if options.refresh != nil && isCookieSession(ctx, r) {
+				options.refresh.refresh(ctx, w, user)
+			}
 
 			// pass the request to inner handler with
 			// the context storing the user.
-			inner.ServeHTTP(w, r.WithContext(WithUser(r.Context(), user)))
+			inner.ServeHTTP(w, r.WithContext(WithUser(ctx, user)))
 		})
 	}
 }
@@ -0,0 +1,278 @@
+package middleauth_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yookoala/middleauth"
+	"gopkg.in/jose.v1/crypto"
+	"gopkg.in/jose.v1/jws"
+)
+
+func TestSessionMiddleware_invalidSession(t *testing.T) {
+	jwtKey := "dummy-jwt-key"
+	method := crypto.SigningMethodHS256
+	encode := func(id string, expires time.Time) string {
+		claims := jws.Claims{}
+		claims.Set("id", id)
+		claims.SetExpiration(expires)
+		tokenStr, _ := middleauth.EncodeTokenStr(jwtKey, claims, method)
+		return tokenStr
+	}
+	retrieveUser := func(ctx context.Context, id string) (*middleauth.User, error) {
+		switch id {
+		case "user-1":
+			return &middleauth.User{ID: id}, nil
+		case "user-error":
+			return nil, fmt.Errorf("some database error")
+		}
+		return nil, nil
+	}
+	inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user := middleauth.GetUser(r.Context()); user != nil {
+			fmt.Fprintf(w, "hello %s", user.ID)
+			return
+		}
+		fmt.Fprint(w, "hello anonymous")
+	})
+
+	tests := []struct {
+		desc    string
+		opts    []middleauth.SessionOption
+		token   string
+		code    int
+		body    string
+		cleared bool
+	}{
+		{
+			desc:  "valid session",
+			token: encode("user-1", time.Now().Add(time.Hour)),
+			code:  http.StatusOK,
+			body:  "hello user-1",
+		},
+		{
+			desc:  "expired session is rejected by default",
+			token: encode("user-1", time.Now().Add(-time.Hour)),
+			code:  http.StatusBadRequest,
+			body:  "bad request: invalid session",
+		},
+		{
+			desc:  "user not found is rejected by default",
+			token: encode("user-deleted", time.Now().Add(time.Hour)),
+			code:  http.StatusBadRequest,
+			body:  "bad request: invalid session",
+		},
+		{
+			desc:  "failing to retrieve user",
+			token: encode("user-error", time.Now().Add(time.Hour)),
+			code:  http.StatusInternalServerError,
+			body:  "internal server error",
+		},
+		{
+			desc: "expired session as anonymous",
+			opts: []middleauth.SessionOption{
+				middleauth.WithInvalidSessionHandler(
+					middleauth.AnonymousInvalidSession(http.Cookie{Name: "session", Path: "/"}),
+				),
+			},
+			token:   encode("user-1", time.Now().Add(-time.Hour)),
+			code:    http.StatusOK,
+			body:    "hello anonymous",
+			cleared: true,
+		},
+		{
+			desc: "tampered session as anonymous",
+			opts: []middleauth.SessionOption{
+				middleauth.WithInvalidSessionHandler(
+					middleauth.AnonymousInvalidSession(http.Cookie{Name: "session", Path: "/"}),
+				),
+			},
+			token:   encode("user-1", time.Now().Add(time.Hour)) + "tampered",
+			code:    http.StatusOK,
+			body:    "hello anonymous",
+			cleared: true,
+		},
+	}
+
+	for _, test := range tests {
+		handler := middleauth.SessionMiddleware(
+			middleauth.JWTSessionDecoder("session", jwtKey, method),
+			retrieveUser,
+			test.opts...,
+		)(inner)
+
+		r := httptest.NewRequest("GET", "/", nil)
+		r.AddCookie(&http.Cookie{Name: "session", Value: test.token})
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		if want, have := test.code, w.Code; want != have {
+			t.Errorf("[%s] expected %#v, got %#v", test.desc, want, have)
+		}
+		if want, have := test.body, w.Body.String(); want != have {
+			t.Errorf("[%s] expected %#v, got %#v", test.desc, want, have)
+		}
+		cookies := w.Result().Cookies()
+		if test.cleared {
+			if len(cookies) != 1 || cookies[0].Name != "session" || cookies[0].MaxAge >= 0 {
+				t.Errorf("[%s] expected session cookie to be cleared, got %#v", test.desc, cookies)
+			}
+		} else if len(cookies) != 0 {
+			t.Errorf("[%s] expected no cookie, got %#v", test.desc, cookies)
+		}
+	}
+}
+
+func TestSessionMiddleware_problemInvalidSession(t *testing.T) {
+	handler := middleauth.SessionMiddleware(
+		middleauth.JWTTokenDecoder(middleauth.BearerToken(), "dummy-jwt-key", crypto.SigningMethodHS256),
+		middleauth.UserFromClaims,
+		middleauth.WithInvalidSessionHandler(middleauth.ProblemInvalidSession),
+	)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unexpected call to inner handler")
+	}))
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", "Bearer invalid-token")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	if want, have := http.StatusUnauthorized, w.Code; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+	if want, have := "application/problem+json", w.Header().Get("Content-Type"); want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+	if strings.Contains(w.Body.String(), "malformed") {
+		t.Errorf("expected internal error not echoed, got %#v", w.Body.String())
+	}
+
+	var problem struct {
+		Status int    `json:"status"`
+		Detail string `json:"detail"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&problem); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if want, have := http.StatusUnauthorized, problem.Status; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+	if want, have := "invalid session", problem.Detail; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+}
+
+// failingSessionStore is a SessionStore of which the
+// storage is not available
+type failingSessionStore struct {
+	middleauth.SessionStore
+}
+
+func (store failingSessionStore) FindSession(ctx context.Context, id string) (*middleauth.Session, error) {
+	return nil, fmt.Errorf("some database error")
+}
+
+func TestSessionMiddleware_unavailable(t *testing.T) {
+	jwks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer jwks.Close()
+
+	key, _ := middleauth.ParseSigningKey("key-1", genKeyPEM(t, "ec"))
+	ks, _ := middleauth.NewKeySet(key)
+	jwtCookie, err := middleauth.JWTKeySetSession("session", ks)(
+		context.Background(),
+		&http.Cookie{Expires: time.Now().Add(time.Hour)},
+		&middleauth.User{ID: "user-1"},
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	tests := []struct {
+		desc   string
+		decode middleauth.SessionDecoder
+		token  string
+	}{
+		{
+			desc:   "session store not available",
+			decode: middleauth.StoreSessionDecoder("session", failingSessionStore{}),
+			token:  "some-session-id",
+		},
+		{
+			desc:   "key set not available",
+			decode: middleauth.JWKSSessionDecoder("session", jwks.URL),
+			token:  jwtCookie.Value,
+		},
+	}
+
+	for _, test := range tests {
+		handler := middleauth.SessionMiddleware(
+			test.decode,
+			func(ctx context.Context, id string) (*middleauth.User, error) {
+				return &middleauth.User{ID: id}, nil
+			},
+			middleauth.WithInvalidSessionHandler(
+				middleauth.AnonymousInvalidSession(http.Cookie{Name: "session", Path: "/"}),
+			),
+		)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			t.Errorf("[%s] unexpected call to inner handler", test.desc)
+		}))
+
+		r := httptest.NewRequest("GET", "/", nil)
+		r.AddCookie(&http.Cookie{Name: "session", Value: test.token})
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		if want, have := http.StatusServiceUnavailable, w.Code; want != have {
+			t.Errorf("[%s] expected %#v, got %#v", test.desc, want, have)
+		}
+		if strings.Contains(w.Body.String(), "database") {
+			t.Errorf("[%s] expected internal error not echoed, got %#v", test.desc, w.Body.String())
+		}
+		if cookies := w.Result().Cookies(); len(cookies) != 0 {
+			t.Errorf("[%s] expected session cookie kept, got %#v", test.desc, cookies)
+		}
+	}
+}
+
+func TestSessionDecoderOf(t *testing.T) {
+	handler := middleauth.SessionMiddleware(
+		middleauth.SessionDecoderOf(func(r *http.Request) (string, error) {
+			if r.Header.Get("X-User") == "" {
+				return "", middleauth.ErrNoCredentials
+			}
+			return r.Header.Get("X-User"), nil
+		}),
+		func(ctx context.Context, id string) (*middleauth.User, error) {
+			return &middleauth.User{ID: id}, nil
+		},
+	)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user := middleauth.GetUser(r.Context()); user != nil {
+			fmt.Fprintf(w, "hello %s", user.ID)
+			return
+		}
+		fmt.Fprint(w, "hello anonymous")
+	}))
+
+	for _, id := range []string{"user-1", ""} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("X-User", id)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		want := "hello user-1"
+		if id == "" {
+			want = "hello anonymous"
+		}
+		if have := w.Body.String(); want != have {
+			t.Errorf("expected %#v, got %#v", want, have)
+		}
+	}
+}
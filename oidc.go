@@ -0,0 +1,371 @@
+package middleauth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/go-restit/lzjson"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
+	"gopkg.in/jose.v1/jws"
+)
+
+// OIDCProvider is a generic OpenID Connect provider configured
+// by the discovery document of its issuer.
+type OIDCProvider struct {
+	Issuer      string
+	AuthURL     string
+	TokenURL    string
+	UserInfoURL string
+	JWKSURL     string
+
+	keys *remoteKeySet
+}
+
+// NewOIDCProvider reads the discovery document of the issuer
+// (i.e. {issuer}/.well-known/openid-configuration) and returns
+// the provider. The *http.Client for the request can be provided
+// in the context as oauth2.HTTPClient.
+func NewOIDCProvider(ctx context.Context, issuer string) (provider *OIDCProvider, err error) {
+	issuer = strings.TrimRight(issuer, "/")
+	req, err := http.NewRequest("GET", issuer+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return
+	}
+	resp, err := contextClient(ctx).Do(req.WithContext(ctx))
+	if err != nil {
+		err = fmt.Errorf("failed to fetch discovery document: %s", err.Error())
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("failed to fetch discovery document: unexpected status %d", resp.StatusCode)
+		return
+	}
+
+	/*
+		// NOTE: JSON structure of normal response body (partial)
+		{
+		  "issuer": "https://issuer.example.com",
+		  "authorization_endpoint": "https://issuer.example.com/auth",
+		  "token_endpoint": "https://issuer.example.com/token",
+		  "userinfo_endpoint": "https://issuer.example.com/userinfo",
+		  "jwks_uri": "https://issuer.example.com/keys"
+		}
+	*/
+	var doc struct {
+		Issuer      string `json:"issuer"`
+		AuthURL     string `json:"authorization_endpoint"`
+		TokenURL    string `json:"token_endpoint"`
+		UserInfoURL string `json:"userinfo_endpoint"`
+		JWKSURL     string `json:"jwks_uri"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		err = fmt.Errorf("failed to decode discovery document: %s", err.Error())
+		return
+	}
+	if want, have := issuer, strings.TrimRight(doc.Issuer, "/"); want != have {
+		err = fmt.Errorf("issuer mismatch: expected %#v, got %#v", want, have)
+		return
+	}
+	if doc.AuthURL == "" || doc.TokenURL == "" || doc.JWKSURL == "" {
+		err = fmt.Errorf("incomplete discovery document of issuer %#v", issuer)
+		return
+	}
+
+	provider = &OIDCProvider{
+		Issuer:      doc.Issuer,
+		AuthURL:     doc.AuthURL,
+		TokenURL:    doc.TokenURL,
+		UserInfoURL: doc.UserInfoURL,
+		JWKSURL:     doc.JWKSURL,
+		keys:        newRemoteKeySet(doc.JWKSURL),
+	}
+	return
+}
+
+// Config provides OAuth2 config for the OpenID Connect login
+func (p *OIDCProvider) Config(provider AuthProvider, redirectURL string) *oauth2.Config {
+	return &oauth2.Config{
+		RedirectURL:  redirectURL,
+		ClientID:     provider.ClientID,
+		ClientSecret: provider.ClientSecret,
+		Scopes: []string{
+			"openid",
+			"email",
+			"profile",
+		},
+		Endpoint: oauth2.Endpoint{
+			AuthURL:  p.AuthURL,
+			TokenURL: p.TokenURL,
+		},
+	}
+}
+
+// VerifyIDToken verifies the signature of the raw ID token with
+// the issuer's JWKS, then checks the iss, aud, exp and (if not empty)
+// the nonce claims.
+func (p *OIDCProvider) VerifyIDToken(ctx context.Context, raw, clientID, nonce string) (claims jws.Claims, err error) {
+	if claims, err = p.keys.verify(ctx, raw); err != nil {
+		return
+	}
+	if iss, _ := claims.Issuer(); iss != p.Issuer {
+		return nil, fmt.Errorf("unexpected issuer %#v", iss)
+	}
+	if err = checkIDTokenClaims(claims, clientID, nonce); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// checkIDTokenClaims checks the audience and nonce of the claims.
+func checkIDTokenClaims(claims jws.Claims, clientID, nonce string) error {
+	audiences, _ := claims.Audience()
+	if !stringInSlice(clientID, audiences) {
+		return fmt.Errorf("token is not issued for client %#v", clientID)
+	}
+	if nonce != "" && claims.Get("nonce") != nonce {
+		return fmt.Errorf("nonce mismatch")
+	}
+	return nil
+}
+
+// verifyLoginIDToken reads the id_token of the OAuth2 token in
+// context and verifies it by the verify function with the nonce of
+// the login state. Failures of the id_token are returned as
+// LoginError of ErrInvalidIDToken.
+func verifyLoginIDToken(
+	ctx context.Context,
+	verify func(ctx context.Context, raw, nonce string) (jws.Claims, error),
+) (claims jws.Claims, err error) {
+	token := GetOAuth2Token(ctx)
+	if token == nil {
+		err = fmt.Errorf("no OAuth2 token found in context")
+		return
+	}
+	raw, _ := token.Extra("id_token").(string)
+	if raw == "" {
+		err = &LoginError{
+			Type:   ErrInvalidIDToken,
+			Action: "read id_token",
+			Err:    fmt.Errorf("id_token not found in token response"),
+		}
+		return
+	}
+
+	var nonce string
+	if state := GetLoginState(ctx); state != nil {
+		nonce = state.Nonce
+	}
+	if claims, err = verify(ctx, raw, nonce); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("failed to verify id_token")
+		if uerr, ok := err.(*UnavailableError); ok {
+			// the provider failed, not the token
+			if perr, ok := uerr.Err.(*ProviderError); ok {
+				return nil, perr
+			}
+			return nil, uerr
+		}
+		err = &LoginError{
+			Type:   ErrInvalidIDToken,
+			Action: "verify id_token",
+			Err:    err,
+		}
+		return nil, err
+	}
+	return
+}
+
+// AuthUserFactory generates an AuthUserDecoder that reads the user
+// identity from the verified ID token of the login. Standard claims
+// are mapped into the UserIdentity. Userinfo endpoint is used if the
+// ID token does not contain the email.
+func (p *OIDCProvider) AuthUserFactory(provider AuthProvider) AuthUserDecoder {
+	return func(ctx context.Context, client *http.Client) (ctxNext context.Context, authIdentity *UserIdentity, err error) {
+
+		claims, err := verifyLoginIDToken(ctx, func(ctx context.Context, raw, nonce string) (jws.Claims, error) {
+			return p.VerifyIDToken(ctx, raw, provider.ClientID, nonce)
+		})
+		if err != nil {
+			return
+		}
+
+		// read into
+		/*
+			// NOTE: JSON structure of ID token claims (partial)
+			{
+			  "iss": "https://issuer.example.com",
+			  "sub": "user-id",
+			  "aud": "client-id",
+			  "exp": 1311281970,
+			  "nonce": "login-nonce",
+			  "name": "user display name",
+			  "email": "email address",
+			  "email_verified": true
+			}
+		*/
+		sub, _ := claims.Subject()
+		authIdentity = &UserIdentity{
+			Type:       "oidc",
+			Provider:   provider.ID,
+			ProviderID: sub,
+		}
+		authIdentity.Name, _ = claims.Get("name").(string)
+		authIdentity.PrimaryEmail, _ = claims.Get("email").(string)
+		authIdentity.Verified = claimBool(claims.Get("email_verified"))
+
+		if authIdentity.PrimaryEmail == "" && p.UserInfoURL != "" {
+			if err = p.readUserInfo(client, authIdentity); err != nil {
+				return
+			}
+		}
+
+		ctxNext = ctx
+		return
+	}
+}
+
+// readUserInfo fills the identity with the claims from userinfo endpoint
+func (p *OIDCProvider) readUserInfo(client *http.Client, authIdentity *UserIdentity) (err error) {
+	result, err := getJSON(client, authIdentity.Provider, p.UserInfoURL)
+	if err != nil {
+		return
+	}
+	if sub := result.Get("sub").String(); sub != authIdentity.ProviderID {
+		err = fmt.Errorf("userinfo subject mismatch")
+		return
+	}
+	if authIdentity.Name == "" {
+		authIdentity.Name = result.Get("name").String()
+	}
+	authIdentity.PrimaryEmail = result.Get("email").String()
+	authIdentity.Verified = nodeBool(result.Get("email_verified"))
+	return
+}
+
+// OIDCProviderType creates a ProviderType for generic OpenID Connect
+// providers. The issuer is read from the provider param "issuer".
+// Discovery of each issuer is done on first use, then cached.
+func OIDCProviderType() ProviderType {
+	var mu sync.Mutex
+	discovered := make(map[string]*OIDCProvider)
+	discover := func(ctx context.Context, provider AuthProvider) (p *OIDCProvider, err error) {
+		issuer := provider.Param("issuer")
+		mu.Lock()
+		p = discovered[issuer]
+		mu.Unlock()
+		if p != nil {
+			return
+		}
+
+		// fetch without holding the lock, so that a slow
+		// issuer does not block the logins of others
+		if p, err = NewOIDCProvider(ctx, issuer); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error":         err.Error(),
+				"provider.id":   provider.ID,
+				"provider.type": provider.TypeID(),
+			}).Error("failed to discover OpenID Connect provider")
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if found := discovered[issuer]; found != nil {
+			return found, nil
+		}
+		discovered[issuer] = p
+		return
+	}
+
+	return ProviderType{
+		Name:   "OpenID Connect",
+		Params: []string{"issuer"},
+		AuthURLFactory: func(setup ProviderSetup) AuthURLFactory {
+			return func(w http.ResponseWriter, r *http.Request) (url string, err error) {
+				p, err := discover(r.Context(), setup.Provider)
+				if err != nil {
+					return
+				}
+				return OAuth2AuthURLFactory(
+					p.Config(setup.Provider, setup.CallbackURL),
+					setup.States,
+					WithPKCE(),
+					WithNonce(),
+				)(w, r)
+			}
+		},
+		CallbackReqDecoder: func(setup ProviderSetup) CallbackReqDecoder {
+			return func(w http.ResponseWriter, r *http.Request) (ctxNext context.Context, client *http.Client, err error) {
+				p, err := discover(r.Context(), setup.Provider)
+				if err != nil {
+					return
+				}
+				return OAuth2CallbackDecoder(
+					p.Config(setup.Provider, setup.CallbackURL),
+					setup.States,
+					WithPKCE(),
+					WithNonce(),
+				)(w, r)
+			}
+		},
+		AuthUserDecoder: func(setup ProviderSetup) AuthUserDecoder {
+			return func(ctx context.Context, client *http.Client) (ctxNext context.Context, authIdentity *UserIdentity, err error) {
+				p, err := discover(ctx, setup.Provider)
+				if err != nil {
+					return
+				}
+				return p.AuthUserFactory(setup.Provider)(ctx, client)
+			}
+		},
+		OAuth2Config: func(ctx context.Context, provider AuthProvider) (conf *oauth2.Config, err error) {
+			p, err := discover(ctx, provider)
+			if err != nil {
+				return
+			}
+			return p.Config(provider, ""), nil
+		},
+	}
+}
+
+// WithNonce enables the OpenID Connect nonce in the OAuth2 login
+// flow. A random nonce is generated for each login attempt, kept with
+// the login state and sent to the provider on redirect.
+func WithNonce() OAuth2Option {
+	return func(flow *oauth2Flow) {
+		flow.nonce = true
+	}
+}
+
+// claimBool reads boolean claim that might be encoded as string
+func claimBool(value interface{}) bool {
+	switch v := value.(type) {
+	case bool:
+		return v
+	case string:
+		return v == "true"
+	}
+	return false
+}
+
+// nodeBool reads boolean JSON value that might be encoded as string
+func nodeBool(node lzjson.Node) bool {
+	if node.Type() == lzjson.TypeString {
+		return node.String() == "true"
+	}
+	return node.Bool()
+}
+
+func stringInSlice(str string, slice []string) bool {
+	for _, item := range slice {
+		if item == str {
+			return true
+		}
+	}
+	return false
+}
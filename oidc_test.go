@@ -0,0 +1,379 @@
+package middleauth_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yookoala/middleauth"
+	"gopkg.in/jose.v1/crypto"
+	"gopkg.in/jose.v1/jws"
+)
+
+// testOIDCIssuer is a local OpenID Connect issuer for testing
+type testOIDCIssuer struct {
+	*httptest.Server
+	key   *rsa.PrivateKey
+	nonce string
+}
+
+func newTestOIDCIssuer(t *testing.T) (issuer *testOIDCIssuer) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	issuer = &testOIDCIssuer{key: key}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 issuer.URL,
+			"authorization_endpoint": issuer.URL + "/auth",
+			"token_endpoint":         issuer.URL + "/token",
+			"userinfo_endpoint":      issuer.URL + "/userinfo",
+			"jwks_uri":               issuer.URL + "/keys",
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(middleauth.JSONWebKeySet{
+			Keys: []middleauth.JSONWebKey{
+				{
+					KeyType:   "RSA",
+					KeyID:     "dummy-key",
+					Use:       "sig",
+					Algorithm: "RS256",
+					N:         base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+					E:         base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+				},
+			},
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"access_token": "dummy-access-token",
+			"token_type":   "bearer",
+			"id_token": issuer.sign(t, "dummy-key", issuer.key, jws.Claims{
+				"iss":            issuer.URL,
+				"sub":            "dummy-subject",
+				"aud":            "dummy-client",
+				"exp":            time.Now().Add(time.Minute).Unix(),
+				"nonce":          issuer.nonce,
+				"name":           "dummy user",
+				"email":          "dummy@foobar.com",
+				"email_verified": true,
+			}),
+		})
+	})
+	issuer.Server = httptest.NewServer(mux)
+	return
+}
+
+func (issuer *testOIDCIssuer) sign(t *testing.T, kid string, key *rsa.PrivateKey, claims jws.Claims) string {
+	token := jws.NewJWT(claims, crypto.SigningMethodRS256)
+	token.(jws.JWS).Protected().Set("kid", kid)
+	b, err := token.Serialize(key)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	return string(b)
+}
+
+func TestOIDCProvider(t *testing.T) {
+	issuer := newTestOIDCIssuer(t)
+	defer issuer.Close()
+
+	p, err := middleauth.NewOIDCProvider(context.Background(), issuer.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if want, have := issuer.URL+"/auth", p.AuthURL; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+
+	provider := middleauth.AuthProvider{
+		ID:           "dummy-oidc",
+		ClientID:     "dummy-client",
+		ClientSecret: "dummy-secret",
+	}
+	conf := p.Config(provider, "http://foobar.com/callback")
+	states := middleauth.NewCookieStateStore("dummy-state", "dummy-key")
+
+	// login redirect
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "http://foobar.com/login", nil)
+	rawurl, err := middleauth.OAuth2AuthURLFactory(conf, states, middleauth.WithNonce())(w, r)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	parsed, _ := url.Parse(rawurl)
+	if want, have := "openid email profile", parsed.Query().Get("scope"); want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+	if issuer.nonce = parsed.Query().Get("nonce"); issuer.nonce == "" {
+		t.Errorf("expected nonce, got empty string")
+	}
+
+	// callback
+	r, _ = http.NewRequest("GET", "http://foobar.com/callback?code=dummy-code&state="+url.QueryEscape(parsed.Query().Get("state")), nil)
+	for _, cookie := range w.Result().Cookies() {
+		r.AddCookie(cookie)
+	}
+	ctx, client, err := middleauth.OAuth2CallbackDecoder(conf, states, middleauth.WithNonce())(httptest.NewRecorder(), r)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	_, identity, err := p.AuthUserFactory(provider)(ctx, client)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if want, have := "dummy-oidc", identity.Provider; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+	if want, have := "dummy-subject", identity.ProviderID; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+	if want, have := "dummy user", identity.Name; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+	if want, have := "dummy@foobar.com", identity.PrimaryEmail; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+	if want, have := true, identity.Verified; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+}
+
+func TestOIDCProvider_VerifyIDToken(t *testing.T) {
+	issuer := newTestOIDCIssuer(t)
+	defer issuer.Close()
+
+	p, err := middleauth.NewOIDCProvider(context.Background(), issuer.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	otherKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	claims := func(modify func(jws.Claims)) jws.Claims {
+		c := jws.Claims{
+			"iss":   issuer.URL,
+			"sub":   "dummy-subject",
+			"aud":   "dummy-client",
+			"exp":   time.Now().Add(time.Minute).Unix(),
+			"nonce": "dummy-nonce",
+		}
+		if modify != nil {
+			modify(c)
+		}
+		return c
+	}
+
+	tests := []struct {
+		desc  string
+		raw   string
+		valid bool
+	}{
+		{
+			desc:  "valid token",
+			raw:   issuer.sign(t, "dummy-key", issuer.key, claims(nil)),
+			valid: true,
+		},
+		{
+			desc: "wrong issuer",
+			raw: issuer.sign(t, "dummy-key", issuer.key, claims(func(c jws.Claims) {
+				c.Set("iss", "https://evil.com")
+			})),
+		},
+		{
+			desc: "wrong audience",
+			raw: issuer.sign(t, "dummy-key", issuer.key, claims(func(c jws.Claims) {
+				c.Set("aud", "other-client")
+			})),
+		},
+		{
+			desc: "wrong nonce",
+			raw: issuer.sign(t, "dummy-key", issuer.key, claims(func(c jws.Claims) {
+				c.Set("nonce", "other-nonce")
+			})),
+		},
+		{
+			desc: "expired",
+			raw: issuer.sign(t, "dummy-key", issuer.key, claims(func(c jws.Claims) {
+				c.Set("exp", time.Now().Add(-time.Minute).Unix())
+			})),
+		},
+		{
+			desc: "no expiration",
+			raw: issuer.sign(t, "dummy-key", issuer.key, claims(func(c jws.Claims) {
+				c.Del("exp")
+			})),
+		},
+		{
+			desc: "signed by other key",
+			raw:  issuer.sign(t, "dummy-key", otherKey, claims(nil)),
+		},
+		{
+			desc: "unknown key id",
+			raw:  issuer.sign(t, "unknown-key", issuer.key, claims(nil)),
+		},
+		{
+			desc: "malformed token",
+			raw:  "not-a-token",
+		},
+	}
+
+	for _, test := range tests {
+		_, err := p.VerifyIDToken(context.Background(), test.raw, "dummy-client", "dummy-nonce")
+		if test.valid && err != nil {
+			t.Errorf("[%s] unexpected error: %s", test.desc, err)
+		} else if !test.valid && err == nil {
+			t.Errorf("[%s] expected error, got nil", test.desc)
+		}
+	}
+}
+
+func TestOIDCProvider_VerifyIDToken_ES256(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	var ts *httptest.Server
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 ts.URL,
+			"authorization_endpoint": ts.URL + "/auth",
+			"token_endpoint":         ts.URL + "/token",
+			"jwks_uri":               ts.URL + "/keys",
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(middleauth.JSONWebKeySet{
+			Keys: []middleauth.JSONWebKey{
+				{
+					KeyType:   "EC",
+					KeyID:     "ec-key",
+					Use:       "sig",
+					Algorithm: "ES256",
+					Curve:     "P-256",
+					X:         base64.RawURLEncoding.EncodeToString(key.X.Bytes()),
+					Y:         base64.RawURLEncoding.EncodeToString(key.Y.Bytes()),
+				},
+			},
+		})
+	})
+	ts = httptest.NewServer(mux)
+	defer ts.Close()
+
+	p, err := middleauth.NewOIDCProvider(context.Background(), ts.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// sign the ID token with the R || S signature of RFC 7518
+	// section 3.4, independent of the signing methods tested.
+	header, _ := json.Marshal(map[string]string{"alg": "ES256", "kid": "ec-key", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss":   ts.URL,
+		"sub":   "dummy-subject",
+		"aud":   "dummy-client",
+		"exp":   time.Now().Add(time.Minute).Unix(),
+		"nonce": "dummy-nonce",
+	})
+	signingInput := base64.RawURLEncoding.EncodeToString(header) +
+		"." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signingInput))
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	sig := make([]byte, 64)
+	rb, sb := r.Bytes(), s.Bytes()
+	copy(sig[32-len(rb):32], rb)
+	copy(sig[64-len(sb):], sb)
+	raw := signingInput + "." + base64.RawURLEncoding.EncodeToString(sig)
+
+	idClaims, err := p.VerifyIDToken(context.Background(), raw, "dummy-client", "dummy-nonce")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if want, have := "dummy-subject", idClaims.Get("sub"); want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+
+	// tampered signature
+	tampered := strings.TrimSuffix(raw, raw[len(raw)-4:]) + "AAAA"
+	if _, err := p.VerifyIDToken(context.Background(), tampered, "dummy-client", "dummy-nonce"); err == nil {
+		t.Errorf("expected error, got nil")
+	}
+}
+
+func TestNewOIDCProvider_issuerMismatch(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 "https://evil.com",
+			"authorization_endpoint": "https://evil.com/auth",
+			"token_endpoint":         "https://evil.com/token",
+			"jwks_uri":               "https://evil.com/keys",
+		})
+	}))
+	defer ts.Close()
+
+	if _, err := middleauth.NewOIDCProvider(context.Background(), ts.URL); err == nil {
+		t.Errorf("expected error, got nil")
+	}
+}
+
+func TestOIDCProviderType_slowIssuer(t *testing.T) {
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer slow.Close()
+	defer close(release)
+
+	issuer := newTestOIDCIssuer(t)
+	defer issuer.Close()
+
+	providerType := middleauth.OIDCProviderType()
+	go providerType.OAuth2Config(context.Background(), middleauth.AuthProvider{
+		ID:     "slow-oidc",
+		Params: map[string]string{"issuer": slow.URL},
+	})
+
+	// discovery of other issuer is not blocked by the slow one
+	done := make(chan error, 1)
+	go func() {
+		_, err := providerType.OAuth2Config(context.Background(), middleauth.AuthProvider{
+			ID:     "dummy-oidc",
+			Params: map[string]string{"issuer": issuer.URL},
+		})
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("discovery blocked by the slow issuer")
+	}
+}
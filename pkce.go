@@ -0,0 +1,49 @@
+package middleauth
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+
+	"golang.org/x/oauth2"
+)
+
+// WithPKCE enables Proof Key for Code Exchange (RFC 7636) in
+// the OAuth2 login flow. A code verifier is generated for each
+// login attempt and kept with the login state. The S256 code
+// challenge is sent to the provider on redirect, and the verifier
+// is replayed on code exchange.
+//
+// With this option, OAuth2CallbackDecoder will reject any callback
+// without a code verifier in the login state.
+func WithPKCE() OAuth2Option {
+	return func(flow *oauth2Flow) {
+		flow.pkce = true
+	}
+}
+
+// newCodeVerifier generates a random code verifier of 43 characters
+// (from 32 random bytes), which is the minimal length in RFC 7636.
+func newCodeVerifier() (string, error) {
+	return randomString(32)
+}
+
+// codeChallenge generates the S256 code challenge of a verifier
+func codeChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// codeChallengeOptions returns the auth URL parameters
+// for the code challenge of the verifier
+func codeChallengeOptions(verifier string) []oauth2.AuthCodeOption {
+	return []oauth2.AuthCodeOption{
+		oauth2.SetAuthURLParam("code_challenge", codeChallenge(verifier)),
+		oauth2.SetAuthURLParam("code_challenge_method", "S256"),
+	}
+}
+
+// codeVerifierOption returns the token exchange parameter
+// for the code verifier
+func codeVerifierOption(verifier string) oauth2.AuthCodeOption {
+	return oauth2.SetAuthURLParam("code_verifier", verifier)
+}
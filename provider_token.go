@@ -0,0 +1,182 @@
+package middleauth
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
+)
+
+// ProviderToken stores the OAuth2 token of a UserIdentity
+// for API calls to the provider on behalf of the user.
+//
+// The tokens are stored as is. Storage implementations should
+// be protected accordingly.
+type ProviderToken struct {
+	UserID       string    `json:"user_id" gorm:"type:varchar(36);index"`
+	Provider     string    `json:"provider" gorm:"type:varchar(255);primary_key"`
+	ProviderID   string    `json:"provider_id" gorm:"type:varchar(255);primary_key"`
+	AccessToken  string    `json:"-" gorm:"type:text"`
+	TokenType    string    `json:"token_type" gorm:"type:varchar(255)"`
+	RefreshToken string    `json:"-" gorm:"type:text"`
+	Expiry       time.Time `json:"expiry"`
+
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// OAuth2Token returns the *oauth2.Token of the provider token
+func (token ProviderToken) OAuth2Token() *oauth2.Token {
+	return &oauth2.Token{
+		AccessToken:  token.AccessToken,
+		TokenType:    token.TokenType,
+		RefreshToken: token.RefreshToken,
+		Expiry:       token.Expiry,
+	}
+}
+
+// setOAuth2Token updates the provider token with the *oauth2.Token.
+// The refresh token is kept if the new token does not have one.
+func (token *ProviderToken) setOAuth2Token(oauth2Token *oauth2.Token) {
+	token.AccessToken = oauth2Token.AccessToken
+	token.TokenType = oauth2Token.TokenType
+	token.Expiry = oauth2Token.Expiry
+	if oauth2Token.RefreshToken != "" {
+		token.RefreshToken = oauth2Token.RefreshToken
+	}
+}
+
+// ProviderTokenStore stores the ProviderToken of user identities
+type ProviderTokenStore interface {
+
+	// SaveToken creates or updates the token of the
+	// identity (Provider, ProviderID).
+	SaveToken(ctx context.Context, token *ProviderToken) error
+
+	// FindToken finds the token of the user for the provider id.
+	// If the user has several identities of the provider, the most
+	// recently updated token is returned. Returns nil token if
+	// there is none.
+	FindToken(ctx context.Context, userID, provider string) (token *ProviderToken, err error)
+}
+
+// SaveProviderToken generates a decorator of UserStorageCallback that
+// saves the OAuth2 token of the login, if any, to the store after
+// the user is confirmed. The token is saved under the Provider of
+// the identity, which is the id of the login provider.
+//
+// Some providers (e.g. Google) only issue refresh token on the first
+// consent. The previous refresh token is kept in such case.
+func SaveProviderToken(store ProviderTokenStore) func(inner UserStorageCallback) UserStorageCallback {
+	return func(inner UserStorageCallback) UserStorageCallback {
+		return func(ctx context.Context, authIdentity *UserIdentity) (ctxNext context.Context, confirmedUser *User, err error) {
+			if ctxNext, confirmedUser, err = inner(ctx, authIdentity); err != nil {
+				return
+			}
+			oauth2Token := GetOAuth2Token(ctx)
+			if oauth2Token == nil {
+				return
+			}
+
+			token, findErr := store.FindToken(ctx, confirmedUser.ID, authIdentity.Provider)
+			if findErr != nil || token == nil || token.ProviderID != authIdentity.ProviderID {
+				token = &ProviderToken{}
+			}
+			token.UserID = confirmedUser.ID
+			token.Provider = authIdentity.Provider
+			token.ProviderID = authIdentity.ProviderID
+			token.setOAuth2Token(oauth2Token)
+
+			// failing to save token should not fail the login
+			if saveErr := store.SaveToken(ctx, token); saveErr != nil {
+				logrus.WithFields(logrus.Fields{
+					"error":       saveErr.Error(),
+					"user.id":     confirmedUser.ID,
+					"provider.id": authIdentity.Provider,
+				}).Error("failed to save provider token")
+			}
+			return
+		}
+	}
+}
+
+// ClientForUser returns an *http.Client for API calls to the provider
+// on behalf of the user, with the token in the context's
+// ProviderTokenStore. The provider type is found in the context's
+// Registry (or DefaultRegistry if nil).
+func (ctx Context) ClientForUser(parent context.Context, userID string, provider AuthProvider) (client *http.Client, err error) {
+	if ctx.ProviderTokenStore == nil {
+		err = fmt.Errorf("no ProviderTokenStore in context")
+		return
+	}
+	return ctx.registry().ClientForUser(parent, ctx.ProviderTokenStore, userID, provider)
+}
+
+// ClientForUser returns an *http.Client for API calls to the provider
+// on behalf of the user, with the token in the store. The token is
+// refreshed automatically when expired, and the refreshed token is
+// saved back to the store.
+func (reg *ProviderRegistry) ClientForUser(ctx context.Context, store ProviderTokenStore, userID string, provider AuthProvider) (client *http.Client, err error) {
+	providerType, ok := reg.Find(provider.TypeID())
+	if !ok || providerType.OAuth2Config == nil {
+		err = fmt.Errorf("provider %#v does not support OAuth2 API client", provider.ID)
+		return
+	}
+	token, err := store.FindToken(ctx, userID, provider.ID)
+	if err != nil {
+		return
+	}
+	if token == nil {
+		err = fmt.Errorf("no token of provider %#v found for user %#v", provider.ID, userID)
+		return
+	}
+	conf, err := providerType.OAuth2Config(ctx, provider)
+	if err != nil {
+		return
+	}
+
+	tokenSource := &savingTokenSource{
+		ctx:   ctx,
+		src:   conf.TokenSource(ctx, token.OAuth2Token()),
+		store: store,
+		token: token,
+	}
+	client = oauth2.NewClient(ctx, oauth2.ReuseTokenSource(token.OAuth2Token(), tokenSource))
+	return
+}
+
+// savingTokenSource saves the refreshed token to the store
+type savingTokenSource struct {
+	ctx   context.Context
+	src   oauth2.TokenSource
+	store ProviderTokenStore
+
+	mu    sync.Mutex
+	token *ProviderToken
+}
+
+// Token implements oauth2.TokenSource
+func (ts *savingTokenSource) Token() (oauth2Token *oauth2.Token, err error) {
+	if oauth2Token, err = ts.src.Token(); err != nil {
+		return
+	}
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if oauth2Token.AccessToken == ts.token.AccessToken {
+		return
+	}
+	ts.token.setOAuth2Token(oauth2Token)
+	if saveErr := ts.store.SaveToken(ts.ctx, ts.token); saveErr != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":       saveErr.Error(),
+			"user.id":     ts.token.UserID,
+			"provider.id": ts.token.Provider,
+		}).Error("failed to save refreshed provider token")
+	}
+	return
+}
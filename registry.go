@@ -0,0 +1,228 @@
+package middleauth
+
+import (
+	"context"
+	"net/http"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
+)
+
+// ProviderSetup contains the information for a ProviderType
+// to build the login flow of a provider.
+type ProviderSetup struct {
+
+	// Provider is the provider to build login flow for.
+	Provider AuthProvider
+
+	// Context is the handler context.
+	Context *Context
+
+	// CallbackURL is the full URL of the provider's callback endpoint.
+	CallbackURL string
+
+	// States stores the login state for OAuth2 login flow.
+	States StateStore
+
+	// Tokens stores the request token for OAuth1.0a login flow.
+	Tokens TokenStore
+}
+
+// ProviderType bundles the builders of the login flow
+// for a type of AuthProvider.
+type ProviderType struct {
+
+	// Name is the default human readable name of
+	// providers of this type.
+	Name string
+
+	// Params are the names of provider specific parameters.
+	// EnvProviders reads them from environment variables
+	// OAUTH2_{ID}_{PARAM} into AuthProvider.Params.
+	Params []string
+
+	// AuthURLFactory builds the AuthURLFactory of a provider.
+	AuthURLFactory func(setup ProviderSetup) AuthURLFactory
+
+	// CallbackReqDecoder builds the CallbackReqDecoder of a provider.
+	CallbackReqDecoder func(setup ProviderSetup) CallbackReqDecoder
+
+	// AuthUserDecoder builds the AuthUserDecoder of a provider.
+	AuthUserDecoder func(setup ProviderSetup) AuthUserDecoder
+
+	// OAuth2Config provides the OAuth2 config of a provider for API
+	// calls after login, such as in ClientForUser. Nil for providers
+	// that are not OAuth2.
+	OAuth2Config func(ctx context.Context, provider AuthProvider) (*oauth2.Config, error)
+}
+
+// staticOAuth2Config adapts an OAuth2 config builder
+// into ProviderType.OAuth2Config
+func staticOAuth2Config(
+	getConfig func(provider AuthProvider, redirectURL string) *oauth2.Config,
+) func(ctx context.Context, provider AuthProvider) (*oauth2.Config, error) {
+	return func(ctx context.Context, provider AuthProvider) (*oauth2.Config, error) {
+		return getConfig(provider, ""), nil
+	}
+}
+
+// OAuth2ProviderType creates a ProviderType for a simple OAuth2 provider
+// with the given config builder and AuthUserDecoder builder.
+func OAuth2ProviderType(
+	name string,
+	getConfig func(provider AuthProvider, redirectURL string) *oauth2.Config,
+	getAuthUser func(provider AuthProvider) AuthUserDecoder,
+	opts ...OAuth2Option,
+) ProviderType {
+	return ProviderType{
+		Name: name,
+		AuthURLFactory: func(setup ProviderSetup) AuthURLFactory {
+			return OAuth2AuthURLFactory(
+				getConfig(setup.Provider, setup.CallbackURL),
+				setup.States,
+				opts...,
+			)
+		},
+		CallbackReqDecoder: func(setup ProviderSetup) CallbackReqDecoder {
+			return OAuth2CallbackDecoder(
+				getConfig(setup.Provider, setup.CallbackURL),
+				setup.States,
+				opts...,
+			)
+		},
+		AuthUserDecoder: func(setup ProviderSetup) AuthUserDecoder {
+			return getAuthUser(setup.Provider)
+		},
+		OAuth2Config: staticOAuth2Config(getConfig),
+	}
+}
+
+// providerAuthUser adapts a user identity reader of a provider type
+// into the AuthUserDecoder builder of OAuth2ProviderType. The identity
+// and errors found are attributed to the id of the provider, so that
+// identities and tokens of providers of the same type (e.g. "github"
+// and "github-enterprise") are apart.
+func providerAuthUser(
+	getAuthUser func(ctx context.Context, client *http.Client, providerID string) (context.Context, *UserIdentity, error),
+) func(provider AuthProvider) AuthUserDecoder {
+	return func(provider AuthProvider) AuthUserDecoder {
+		return func(ctx context.Context, client *http.Client) (context.Context, *UserIdentity, error) {
+			return getAuthUser(ctx, client, provider.ID)
+		}
+	}
+}
+
+// NewProviderRegistry creates an empty ProviderRegistry
+func NewProviderRegistry() *ProviderRegistry {
+	return &ProviderRegistry{
+		types: make(map[string]ProviderType),
+	}
+}
+
+// ProviderRegistry contains ProviderType of the given type id.
+type ProviderRegistry struct {
+	mu    sync.RWMutex
+	ids   []string
+	types map[string]ProviderType
+}
+
+// Register adds or replaces the ProviderType of the type id
+func (reg *ProviderRegistry) Register(id string, providerType ProviderType) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	if _, ok := reg.types[id]; !ok {
+		reg.ids = append(reg.ids, id)
+	}
+	reg.types[id] = providerType
+}
+
+// Find finds the ProviderType of the type id
+func (reg *ProviderRegistry) Find(id string) (providerType ProviderType, ok bool) {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	providerType, ok = reg.types[id]
+	return
+}
+
+// IDs returns the registered type ids in order of registration
+func (reg *ProviderRegistry) IDs() (ids []string) {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	ids = make([]string, len(reg.ids))
+	copy(ids, reg.ids)
+	return
+}
+
+// Providers returns the providers with registered type. Providers
+// without Name will be named after the default of their type.
+func (reg *ProviderRegistry) Providers(providers []AuthProvider) (supported []AuthProvider) {
+	supported = make([]AuthProvider, 0, len(providers))
+	for _, provider := range providers {
+		providerType, ok := reg.Find(provider.TypeID())
+		if !ok {
+			logrus.WithFields(logrus.Fields{
+				"provider.id":   provider.ID,
+				"provider.type": provider.TypeID(),
+			}).Warn("provider type not registered")
+			continue
+		}
+		if provider.Name == "" {
+			provider.Name = providerType.Name
+		}
+		supported = append(supported, provider)
+	}
+	return
+}
+
+// DefaultRegistry is the default ProviderRegistry with all
+// the built-in provider types registered.
+var DefaultRegistry = NewProviderRegistry()
+
+// RegisterProvider adds or replaces the ProviderType of
+// the type id in DefaultRegistry.
+func RegisterProvider(id string, providerType ProviderType) {
+	DefaultRegistry.Register(id, providerType)
+}
+
+func init() {
+	RegisterProvider("google", GoogleProviderType())
+	RegisterProvider("facebook", OAuth2ProviderType(
+		"Facebook",
+		FacebookConfig,
+		providerAuthUser(facebookAuthUser),
+		WithPKCE(),
+	))
+	RegisterProvider("twitter", ProviderType{
+		Name: "Twitter",
+		AuthURLFactory: func(setup ProviderSetup) AuthURLFactory {
+			return OAuth1aAuthURLFactory(
+				TwitterConsumer(setup.Provider),
+				setup.CallbackURL,
+				setup.Tokens,
+				setup.States,
+			)
+		},
+		CallbackReqDecoder: func(setup ProviderSetup) CallbackReqDecoder {
+			return OAuth1aCallbackDecoder(
+				TwitterConsumer(setup.Provider),
+				setup.Tokens,
+				setup.States,
+			)
+		},
+		AuthUserDecoder: func(setup ProviderSetup) AuthUserDecoder {
+			return providerAuthUser(twitterAuthUser)(setup.Provider)
+		},
+	})
+	RegisterProvider("github", OAuth2ProviderType(
+		"Github",
+		GithubConfig,
+		providerAuthUser(githubAuthUser),
+		WithPKCE(),
+	))
+	RegisterProvider("gitlab", GitlabProviderType())
+	RegisterProvider("microsoft", MicrosoftProviderType())
+	RegisterProvider("apple", AppleProviderType())
+	RegisterProvider("oidc", OIDCProviderType())
+	RegisterProvider("oauth2", GenericProviderType())
+}
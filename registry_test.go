@@ -0,0 +1,246 @@
+package middleauth_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/yookoala/middleauth"
+)
+
+func dummyProviderType(calls map[string]string) middleauth.ProviderType {
+	return middleauth.ProviderType{
+		Name:   "Dummy",
+		Params: []string{"base_url"},
+		AuthURLFactory: func(setup middleauth.ProviderSetup) middleauth.AuthURLFactory {
+			return func(w http.ResponseWriter, r *http.Request) (string, error) {
+				calls["auth"] = setup.Provider.ID
+				return setup.Provider.Param("base_url") + "/auth", nil
+			}
+		},
+		CallbackReqDecoder: func(setup middleauth.ProviderSetup) middleauth.CallbackReqDecoder {
+			return func(w http.ResponseWriter, r *http.Request) (context.Context, *http.Client, error) {
+				calls["callback"] = setup.CallbackURL
+				return r.Context(), nil, nil
+			}
+		},
+		AuthUserDecoder: func(setup middleauth.ProviderSetup) middleauth.AuthUserDecoder {
+			return func(ctx context.Context, client *http.Client) (context.Context, *middleauth.UserIdentity, error) {
+				calls["authUser"] = setup.Provider.ID
+				return ctx, &middleauth.UserIdentity{
+					Provider:   setup.Provider.ID,
+					ProviderID: "dummy-id",
+				}, nil
+			}
+		},
+	}
+}
+
+func TestProviderRegistry(t *testing.T) {
+	reg := middleauth.NewProviderRegistry()
+	reg.Register("hello", middleauth.ProviderType{Name: "Hello"})
+	reg.Register("world", middleauth.ProviderType{Name: "World"})
+	reg.Register("hello", middleauth.ProviderType{Name: "Hello Again"})
+
+	if want, have := []string{"hello", "world"}, reg.IDs(); len(want) != len(have) || want[0] != have[0] || want[1] != have[1] {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+	if providerType, ok := reg.Find("hello"); !ok {
+		t.Errorf("expected to find \"hello\"")
+	} else if want, have := "Hello Again", providerType.Name; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+
+	providers := reg.Providers([]middleauth.AuthProvider{
+		{ID: "hello"},
+		{ID: "foo"},
+		{ID: "my-world", Type: "world", Name: "My World"},
+	})
+	if want, have := 2, len(providers); want != have {
+		t.Fatalf("expected %d providers, got %d", want, have)
+	}
+	if want, have := "Hello Again", providers[0].Name; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+	if want, have := "My World", providers[1].Name; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+}
+
+func TestProviderRegistry_EnvProviders(t *testing.T) {
+	reg := middleauth.NewProviderRegistry()
+	reg.Register("dummy", dummyProviderType(nil))
+
+	env := map[string]string{
+		"OAUTH2_DUMMY_CLIENT_ID":     "dummy-client",
+		"OAUTH2_DUMMY_CLIENT_SECRET": "dummy-secret",
+		"OAUTH2_DUMMY_BASE_URL":      "https://dummy.com",
+	}
+	providers := reg.EnvProviders(func(key string) string {
+		return env[key]
+	})
+	if want, have := 1, len(providers); want != have {
+		t.Fatalf("expected %d providers, got %d", want, have)
+	}
+	if want, have := "Dummy", providers[0].Name; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+	if want, have := "dummy-client", providers[0].ClientID; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+	if want, have := "https://dummy.com", providers[0].Param("base_url"); want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+}
+
+func TestOAuth2ProviderType(t *testing.T) {
+	providerType := middleauth.OAuth2ProviderType(
+		"Dummy",
+		middleauth.GenericConfig,
+		func(provider middleauth.AuthProvider) middleauth.AuthUserDecoder {
+			return func(ctx context.Context, client *http.Client) (context.Context, *middleauth.UserIdentity, error) {
+				return ctx, &middleauth.UserIdentity{
+					Provider:   provider.ID,
+					ProviderID: provider.Param("user_id"),
+				}, nil
+			}
+		},
+	)
+
+	for _, provider := range []middleauth.AuthProvider{
+		{ID: "dummy-1", Params: map[string]string{"user_id": "user-1"}},
+		{ID: "dummy-2", Params: map[string]string{"user_id": "user-2"}},
+	} {
+		decoder := providerType.AuthUserDecoder(middleauth.ProviderSetup{Provider: provider})
+		_, identity, err := decoder(context.Background(), nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if want, have := provider.ID, identity.Provider; want != have {
+			t.Errorf("expected %#v, got %#v", want, have)
+		}
+		if want, have := provider.Param("user_id"), identity.ProviderID; want != have {
+			t.Errorf("expected %#v, got %#v", want, have)
+		}
+	}
+}
+
+func TestLoginHandler_registry(t *testing.T) {
+	calls := make(map[string]string)
+	reg := middleauth.NewProviderRegistry()
+	reg.Register("dummy", dummyProviderType(calls))
+
+	ctx, _ := middleauth.NewContext("http://foobar.com")
+	ctx.LoginPath = "/login/oauth2"
+	ctx.ErrPath = "/error"
+	ctx.Registry = reg
+
+	handler := middleauth.LoginHandler(
+		func(ctx context.Context, authIdentity *middleauth.UserIdentity) (context.Context, *middleauth.User, error) {
+			return ctx, &middleauth.User{ID: "dummy-user"}, nil
+		},
+		func(ctx context.Context, in *http.Cookie, confirmedUser *middleauth.User) (*http.Cookie, error) {
+			in.Value = confirmedUser.ID
+			return in, nil
+		},
+		[]middleauth.AuthProvider{
+			{
+				ID:     "my-dummy",
+				Type:   "dummy",
+				Params: map[string]string{"base_url": "https://dummy.com"},
+			},
+			{
+				ID: "google",
+			},
+		},
+		ctx,
+	)
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "http://foobar.com/login/oauth2/my-dummy", nil)
+	handler.ServeHTTP(w, r)
+	if want, have := "https://dummy.com/auth", w.Header().Get("Location"); want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+	if want, have := "my-dummy", calls["auth"]; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("GET", "http://foobar.com/login/oauth2/my-dummy/callback", nil)
+	handler.ServeHTTP(w, r)
+	if want, have := "http://foobar.com/login/oauth2/my-dummy/callback", calls["callback"]; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+	if want, have := "my-dummy", calls["authUser"]; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+
+	// google is not registered in the custom registry
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("GET", "http://foobar.com/login/oauth2/google", nil)
+	handler.ServeHTTP(w, r)
+	if want, have := http.StatusNotFound, w.Code; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+}
+
+func TestLoginHandler_stateCookiePerProvider(t *testing.T) {
+	ctx, _ := middleauth.NewContext("http://foobar.com")
+	ctx.CookieName = "dummy-session"
+	ctx.LoginPath = "/login/oauth2"
+	ctx.ErrPath = "/error"
+	ctx.StateStore = middleauth.NewCookieStateStore("dummy-state", "dummy-key")
+
+	handler := middleauth.LoginHandler(
+		nil,
+		nil,
+		[]middleauth.AuthProvider{
+			{ID: "google", ClientID: "dummy-client"},
+			{ID: "google-work", Type: "google", ClientID: "dummy-client"},
+		},
+		ctx,
+	)
+
+	for _, providerID := range []string{"google", "google-work"} {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", "http://foobar.com/login/oauth2/"+providerID, nil)
+		handler.ServeHTTP(w, r)
+		cookies := w.Result().Cookies()
+		if want, have := 1, len(cookies); want != have {
+			t.Fatalf("[%s] expected %d cookie, got %d", providerID, want, have)
+		}
+		if want, have := "dummy-state-"+providerID, cookies[0].Name; want != have {
+			t.Errorf("[%s] expected %#v, got %#v", providerID, want, have)
+		}
+	}
+}
+
+func TestProviderRegistry_providerID(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"error": "invalid_token"}`))
+	}))
+	defer ts.Close()
+	target, _ := url.Parse(ts.URL)
+	client := &http.Client{Transport: rewriteTransport{target}}
+
+	// built-in types of custom provider id
+	for _, typeID := range []string{"google", "github", "facebook", "twitter"} {
+		providerType, ok := middleauth.DefaultRegistry.Find(typeID)
+		if !ok {
+			t.Errorf("[%s] provider type not found", typeID)
+			continue
+		}
+		provider := middleauth.AuthProvider{ID: "my-" + typeID, Type: typeID}
+		getAuthUser := providerType.AuthUserDecoder(middleauth.ProviderSetup{Provider: provider})
+		_, _, err := getAuthUser(context.Background(), client)
+		if perr, ok := err.(*middleauth.ProviderError); !ok {
+			t.Errorf("[%s] expected *middleauth.ProviderError, got %#v", typeID, err)
+		} else if want, have := provider.ID, perr.Provider; want != have {
+			t.Errorf("[%s] expected %#v, got %#v", typeID, want, have)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package middleauth
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/go-restit/lzjson"
+	"github.com/sirupsen/logrus"
+)
+
+// providerResponseLimit is the maximum size of provider API
+// response body to read.
+const providerResponseLimit = 1 << 20
+
+// providerErrorBodyLimit is the maximum length of
+// response body excerpt in ProviderError.
+const providerErrorBodyLimit = 512
+
+// ProviderError is the error of an unexpected response,
+// such as non-2xx status or malformed JSON, from the API
+// of a login provider.
+type ProviderError struct {
+
+	// Provider is the id of the provider.
+	Provider string
+
+	// URL is the API endpoint requested.
+	URL string
+
+	// StatusCode is the HTTP status code of the response.
+	StatusCode int
+
+	// Body is the excerpt of the response body.
+	Body string
+
+	// Err is the error in reading or decoding the
+	// response body, if any.
+	Err error
+}
+
+// Error implements error interface
+func (err *ProviderError) Error() string {
+	if err.Err != nil {
+		return fmt.Sprintf("provider %s: error reading response of %s (status %d): %s",
+			err.Provider, err.URL, err.StatusCode, err.Err.Error())
+	}
+	return fmt.Sprintf("provider %s: unexpected response of %s (status %d): %s",
+		err.Provider, err.URL, err.StatusCode, err.Body)
+}
+
+// OAuth2Error is the error response of the authorization
+// endpoint of a login provider, sent to the callback as the
+// "error", "error_description" and "error_uri" parameters
+// (RFC 6749 section 4.1.2.1).
+type OAuth2Error struct {
+
+	// Code is the error code, such as "access_denied".
+	Code string
+
+	// Description is the human-readable description
+	// of the error, if any.
+	Description string
+
+	// URI is the URI of the web page with information
+	// about the error, if any.
+	URI string
+}
+
+// Error implements error interface
+func (err *OAuth2Error) Error() string {
+	if err.Description == "" {
+		return "oauth2 error: " + err.Code
+	}
+	return "oauth2 error: " + err.Code + ": " + err.Description
+}
+
+// getJSON requests the provider API with the client. Returns
+// ProviderError if the response is not 2xx or is not valid JSON.
+func getJSON(client *http.Client, provider, url string) (result lzjson.Node, err error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":       err.Error(),
+			"provider.id": provider,
+			"url":         url,
+		}).Error("failed to request provider API")
+		return
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, providerResponseLimit))
+	perr := &ProviderError{
+		Provider:   provider,
+		URL:        url,
+		StatusCode: resp.StatusCode,
+		Body:       bodyExcerpt(b),
+	}
+	switch {
+	case err != nil:
+		perr.Err = err
+	case resp.StatusCode < 200 || resp.StatusCode >= 300:
+	case !json.Valid(b):
+		perr.Err = fmt.Errorf("malformed JSON")
+	default:
+		result = lzjson.Decode(bytes.NewReader(b))
+		return
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"error":       perr.Error(),
+		"provider.id": provider,
+		"url":         url,
+		"status":      resp.StatusCode,
+	}).Error("unexpected response from provider API")
+	err = perr
+	return
+}
+
+// bodyExcerpt returns the beginning of the response body
+func bodyExcerpt(b []byte) string {
+	if len(b) > providerErrorBodyLimit {
+		return string(b[:providerErrorBodyLimit]) + "..."
+	}
+	return string(b)
+}
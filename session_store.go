@@ -0,0 +1,260 @@
+package middleauth
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultSessionExpires is the lifetime of a stored session
+// if the cookie has no expiration time.
+const DefaultSessionExpires = 24 * time.Hour
+
+// SessionRefreshGrace is the time a stored session remains valid
+// after being refreshed, for the concurrent requests still
+// carrying the cookie of it.
+const SessionRefreshGrace = 30 * time.Second
+
+// Session is a server-side login session of a user. The cookie
+// of the session only holds the opaque session ID, so the session
+// can be revoked any time by deleting it from the SessionStore.
+type Session struct {
+	ID        string    `json:"id" gorm:"type:varchar(255);primary_key"`
+	UserID    string    `json:"user_id" gorm:"type:varchar(36);index"`
+	Expires   time.Time `json:"expires" gorm:"index"`
+	AuthTime  time.Time `json:"auth_time"` // time of the user login
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// SessionStore stores the server-side sessions.
+//
+// Implementations must be safe for concurrent use.
+type SessionStore interface {
+
+	// CreateSession stores a new session.
+	CreateSession(ctx context.Context, session *Session) error
+
+	// FindSession finds the session of the id. Returns nil
+	// session if it is not found or is expired.
+	FindSession(ctx context.Context, id string) (session *Session, err error)
+
+	// ListSessions lists the unexpired sessions of the user,
+	// for the user or admin to choose the session to revoke.
+	ListSessions(ctx context.Context, userID string) (sessions []Session, err error)
+
+	// ExpireSession shortens the expiration time of the session
+	// of the id to the given time, if it expires later than that.
+	ExpireSession(ctx context.Context, id string, expires time.Time) error
+
+	// DeleteSession revokes the session of the id.
+	DeleteSession(ctx context.Context, id string) error
+
+	// DeleteUserSessions revokes all sessions of the user
+	// (i.e. log out all devices).
+	DeleteUserSessions(ctx context.Context, userID string) error
+}
+
+// StoreSession produces a CookieFactory that creates a session of
+// the user in the store. The cookie holds only the session ID.
+//
+// The session expires with the cookie, or after DefaultSessionExpires
+// if the cookie has no expiration time. When refreshed by
+// SessionMiddleware, the current session is replaced by the new one
+// and expires after SessionRefreshGrace.
+func StoreSession(cookieName string, store SessionStore) CookieFactory {
+	return func(ctx context.Context, in *http.Cookie, confirmedUser *User) (cookie *http.Cookie, err error) {
+
+		cookie = in
+		cookie.Name = cookieName
+
+		id, err := randomString(32)
+		if err != nil {
+			return
+		}
+		now := time.Now()
+		session := &Session{
+			ID:        id,
+			UserID:    confirmedUser.ID,
+			Expires:   cookie.Expires,
+			AuthTime:  now,
+			CreatedAt: now,
+		}
+		if session.Expires.IsZero() {
+			session.Expires = now.Add(DefaultSessionExpires)
+		}
+
+		// refreshed session replaces the current one
+		var old *Session
+		if isSessionRefresh(ctx) {
+			old = GetSession(ctx)
+		}
+		if old != nil {
+			session.AuthTime = old.AuthTime
+		}
+		if err = store.CreateSession(ctx, session); err != nil {
+			err = fmt.Errorf("failed to create session: %s", err.Error())
+			return
+		}
+		if old != nil {
+			// concurrent requests might still carry the current
+			// cookie, so keep the session for a grace period
+			if err = store.ExpireSession(ctx, old.ID, now.Add(SessionRefreshGrace)); err != nil {
+				err = fmt.Errorf("failed to replace session: %s", err.Error())
+				return
+			}
+		}
+		cookie.Value = id
+		return
+	}
+}
+
+// StoreSessionDecoder return a SessionDecoder that finds the session
+// of the cookie in the store and return the user of it. The session
+// is added to the request context (see GetSession).
+func StoreSessionDecoder(cookieName string, store SessionStore) SessionDecoder {
+	return StoreTokenDecoder(CookieToken(cookieName), store)
+}
+
+// StoreTokenDecoder return a SessionDecoder that finds the session of
+// the session id read from the request (e.g. BearerToken) in the store
+// and return the user of it.
+func StoreTokenDecoder(sessionToken SessionToken, store SessionStore) SessionDecoder {
+	return func(r *http.Request) (ctxNext context.Context, userID string, err error) {
+
+		id, err := sessionToken(r)
+		if err != nil {
+			return
+		}
+
+		session, err := store.FindSession(r.Context(), id)
+		if err != nil {
+			err = &UnavailableError{Action: "find session", Err: err}
+			return
+		}
+		if session == nil {
+			err = fmt.Errorf("session not found or expired")
+			return
+		}
+		ctxNext = withSessionToken(WithSession(r.Context(), session), id)
+		userID = session.UserID
+		return
+	}
+}
+
+// NewMemorySessionStore creates an in-memory SessionStore. Expired
+// sessions are swept lazily on CreateSession.
+//
+// The sessions are kept in memory. They cannot be shared among
+// multiple instances and are lost on restart.
+func NewMemorySessionStore() *MemorySessionStore {
+	return &MemorySessionStore{
+		sessions: make(map[string]Session, 1024),
+	}
+}
+
+// MemorySessionStore stores sessions to a map of the session id
+type MemorySessionStore struct {
+	mu        sync.Mutex
+	sessions  map[string]Session
+	lastSweep time.Time
+}
+
+// CreateSession implements SessionStore
+func (store *MemorySessionStore) CreateSession(ctx context.Context, session *Session) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(store.lastSweep) >= time.Minute {
+		store.sweep(now)
+	}
+	if _, ok := store.sessions[session.ID]; ok {
+		return fmt.Errorf("session %#v already exists", session.ID)
+	}
+	store.sessions[session.ID] = *session
+	return nil
+}
+
+// FindSession implements SessionStore
+func (store *MemorySessionStore) FindSession(ctx context.Context, id string) (session *Session, err error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	stored, ok := store.sessions[id]
+	if !ok || !time.Now().Before(stored.Expires) {
+		return
+	}
+	session = &stored
+	return
+}
+
+// ListSessions implements SessionStore. The sessions are
+// sorted by creation time.
+func (store *MemorySessionStore) ListSessions(ctx context.Context, userID string) (sessions []Session, err error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	now := time.Now()
+	for _, stored := range store.sessions {
+		if stored.UserID == userID && now.Before(stored.Expires) {
+			sessions = append(sessions, stored)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].CreatedAt.Before(sessions[j].CreatedAt)
+	})
+	return
+}
+
+// ExpireSession implements SessionStore
+func (store *MemorySessionStore) ExpireSession(ctx context.Context, id string, expires time.Time) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if stored, ok := store.sessions[id]; ok && stored.Expires.After(expires) {
+		stored.Expires = expires
+		store.sessions[id] = stored
+	}
+	return nil
+}
+
+// DeleteSession implements SessionStore
+func (store *MemorySessionStore) DeleteSession(ctx context.Context, id string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	delete(store.sessions, id)
+	return nil
+}
+
+// DeleteUserSessions implements SessionStore
+func (store *MemorySessionStore) DeleteUserSessions(ctx context.Context, userID string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	for id, stored := range store.sessions {
+		if stored.UserID == userID {
+			delete(store.sessions, id)
+		}
+	}
+	return nil
+}
+
+// Len returns the number of sessions in the store,
+// including expired ones that are not yet swept.
+func (store *MemorySessionStore) Len() int {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	return len(store.sessions)
+}
+
+// sweep removes all expired sessions. Must be called
+// with the lock held.
+func (store *MemorySessionStore) sweep(now time.Time) {
+	for id, stored := range store.sessions {
+		if !now.Before(stored.Expires) {
+			delete(store.sessions, id)
+		}
+	}
+	store.lastSweep = now
+}
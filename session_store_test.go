@@ -0,0 +1,244 @@
+package middleauth_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/yookoala/middleauth"
+)
+
+func TestMemorySessionStore(t *testing.T) {
+	ctx := context.Background()
+	store := middleauth.NewMemorySessionStore()
+	now := time.Now()
+	sessions := []middleauth.Session{
+		{ID: "session-1", UserID: "user-1", Expires: now.Add(time.Hour), CreatedAt: now},
+		{ID: "session-2", UserID: "user-1", Expires: now.Add(time.Hour), CreatedAt: now.Add(time.Second)},
+		{ID: "session-3", UserID: "user-2", Expires: now.Add(time.Hour), CreatedAt: now},
+		{ID: "session-4", UserID: "user-1", Expires: now.Add(-time.Second), CreatedAt: now},
+	}
+	for i := range sessions {
+		if err := store.CreateSession(ctx, &sessions[i]); err != nil {
+			t.Fatalf("unexpected error: %s", err.Error())
+		}
+	}
+	if err := store.CreateSession(ctx, &sessions[0]); err == nil {
+		t.Errorf("expected error creating duplicated session, got nil")
+	}
+
+	if session, _ := store.FindSession(ctx, "session-1"); session == nil {
+		t.Errorf("expected session, got nil")
+	} else if want, have := "user-1", session.UserID; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+	if session, _ := store.FindSession(ctx, "session-4"); session != nil {
+		t.Errorf("expected expired session to be nil, got %#v", session)
+	}
+
+	list, _ := store.ListSessions(ctx, "user-1")
+	if want, have := 2, len(list); want != have {
+		t.Fatalf("expected %#v, got %#v", want, have)
+	}
+	if want, have := "session-1", list[0].ID; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+
+	// revoke single session
+	store.DeleteSession(ctx, "session-1")
+	if session, _ := store.FindSession(ctx, "session-1"); session != nil {
+		t.Errorf("expected nil, got %#v", session)
+	}
+
+	// revoke all sessions of user
+	store.DeleteUserSessions(ctx, "user-1")
+	if session, _ := store.FindSession(ctx, "session-2"); session != nil {
+		t.Errorf("expected nil, got %#v", session)
+	}
+	if session, _ := store.FindSession(ctx, "session-3"); session == nil {
+		t.Errorf("expected session of other user to remain, got nil")
+	}
+}
+
+func TestStoreSession(t *testing.T) {
+	store := middleauth.NewMemorySessionStore()
+	factory := middleauth.StoreSession("session", store)
+	decoder := middleauth.StoreSessionDecoder("session", store)
+
+	cookie, err := factory(
+		context.Background(),
+		&http.Cookie{Expires: time.Now().Add(time.Hour)},
+		&middleauth.User{ID: "user-1"},
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(cookie)
+	ctx, userID, err := decoder(r)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if want, have := "user-1", userID; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+	if session := middleauth.GetSession(ctx); session == nil {
+		t.Errorf("expected session in context, got nil")
+	} else if want, have := cookie.Value, session.ID; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+
+	// revoked session should be rejected immediately
+	store.DeleteUserSessions(context.Background(), "user-1")
+	if _, _, err := decoder(r); err == nil {
+		t.Errorf("expected error, got nil")
+	}
+}
+
+func TestLogoutHandler_sessionStore(t *testing.T) {
+	store := middleauth.NewMemorySessionStore()
+	cookie, err := middleauth.StoreSession("session", store)(
+		context.Background(),
+		&http.Cookie{Expires: time.Now().Add(time.Hour)},
+		&middleauth.User{ID: "user-1"},
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+
+	ctx, _ := middleauth.NewContext("https://foobar.com")
+	ctx.CookieName = "session"
+	ctx.SessionStore = store
+
+	r := httptest.NewRequest("GET", "/logout", nil)
+	r.AddCookie(cookie)
+	w := httptest.NewRecorder()
+	middleauth.LogoutHandler(ctx).ServeHTTP(w, r)
+
+	if want, have := http.StatusTemporaryRedirect, w.Code; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+	if session, _ := store.FindSession(context.Background(), cookie.Value); session != nil {
+		t.Errorf("expected session to be revoked, got %#v", session)
+	}
+}
+
+func TestStoreSession_refresh(t *testing.T) {
+	store := middleauth.NewMemorySessionStore()
+	factory := middleauth.StoreSession("session", store)
+
+	now := time.Now()
+	store.CreateSession(context.Background(), &middleauth.Session{
+		ID:        "session-1",
+		UserID:    "user-1",
+		Expires:   now.Add(20 * time.Minute),
+		AuthTime:  now.Add(-40 * time.Minute),
+		CreatedAt: now.Add(-40 * time.Minute),
+	})
+
+	handler := middleauth.SessionMiddleware(
+		middleauth.StoreSessionDecoder("session", store),
+		func(ctx context.Context, id string) (*middleauth.User, error) {
+			return &middleauth.User{ID: id}, nil
+		},
+		middleauth.WithSessionRefresh(http.Cookie{Path: "/"}, factory, 0.5, 0),
+	)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(&http.Cookie{Name: "session", Value: "session-1"})
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	cookies := w.Result().Cookies()
+	if want, have := 1, len(cookies); want != have {
+		t.Fatalf("expected %#v, got %#v", want, have)
+	}
+
+	// the current session is replaced, and
+	// expires after the grace period
+	if session, _ := store.FindSession(context.Background(), "session-1"); session == nil {
+		t.Errorf("expected session in grace period, got nil")
+	} else if want, have := time.Now().Add(middleauth.SessionRefreshGrace), session.Expires; have.After(want) {
+		t.Errorf("expected expires before %s, got %s", want, have)
+	}
+	session, _ := store.FindSession(context.Background(), cookies[0].Value)
+	if session == nil {
+		t.Fatalf("expected session, got nil")
+	}
+	if want, have := now.Add(-40*time.Minute), session.AuthTime; !want.Equal(have) {
+		t.Errorf("expected %s, got %s", want, have)
+	}
+	if want, have := now.Add(time.Hour), session.Expires; have.Before(want.Add(-time.Second)) {
+		t.Errorf("expected expires after %s, got %s", want, have)
+	}
+}
+
+func TestStoreSession_refreshConcurrent(t *testing.T) {
+	store := middleauth.NewMemorySessionStore()
+	factory := middleauth.StoreSession("session", store)
+
+	now := time.Now()
+	store.CreateSession(context.Background(), &middleauth.Session{
+		ID:        "session-1",
+		UserID:    "user-1",
+		Expires:   now.Add(20 * time.Minute),
+		AuthTime:  now.Add(-40 * time.Minute),
+		CreatedAt: now.Add(-40 * time.Minute),
+	})
+
+	handler := middleauth.SessionMiddleware(
+		middleauth.ChainSessionDecoders(
+			middleauth.StoreTokenDecoder(middleauth.BearerToken(), store),
+			middleauth.StoreSessionDecoder("session", store),
+		),
+		func(ctx context.Context, id string) (*middleauth.User, error) {
+			return &middleauth.User{ID: id}, nil
+		},
+		middleauth.WithSessionRefresh(http.Cookie{Path: "/"}, factory, 0.5, 0),
+	)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user := middleauth.GetUser(r.Context()); user != nil {
+			fmt.Fprintf(w, "hello %s", user.ID)
+		}
+	}))
+
+	// requests with the current cookie all pass,
+	// even if the session is refreshed by another
+	var wg sync.WaitGroup
+	recorders := make([]*httptest.ResponseRecorder, 2)
+	for i := range recorders {
+		recorders[i] = httptest.NewRecorder()
+		wg.Add(1)
+		go func(w http.ResponseWriter) {
+			defer wg.Done()
+			r := httptest.NewRequest("GET", "/", nil)
+			r.AddCookie(&http.Cookie{Name: "session", Value: "session-1"})
+			handler.ServeHTTP(w, r)
+		}(recorders[i])
+	}
+	wg.Wait()
+	for i, w := range recorders {
+		if want, have := http.StatusOK, w.Code; want != have {
+			t.Errorf("[%d] expected %#v, got %#v", i, want, have)
+		}
+		if want, have := "hello user-1", w.Body.String(); want != have {
+			t.Errorf("[%d] expected %#v, got %#v", i, want, have)
+		}
+	}
+
+	// sessions of bearer token are not refreshed into cookie
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", "Bearer session-1")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if want, have := "hello user-1", w.Body.String(); want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+	if cookies := w.Result().Cookies(); len(cookies) != 0 {
+		t.Errorf("expected no cookie, got %#v", cookies)
+	}
+}
@@ -0,0 +1,112 @@
+package middleauth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// ErrNoCredentials is returned by SessionToken and SessionDecoder when
+// the request has no session token. SessionMiddleware treats such
+// request, as with http.ErrNoCookie, as anonymous.
+var ErrNoCredentials = errors.New("no credentials")
+
+// isNoCredentials tells if the error means the request
+// has no session token
+func isNoCredentials(err error) bool {
+	return err == ErrNoCredentials || err == http.ErrNoCookie
+}
+
+// UnavailableError is returned by SessionDecoder when the session
+// cannot be checked for failure of the infrastructure, such as the
+// SessionStore or the JSON Web Key Set server. The session might be
+// valid, so SessionMiddleware responds with 503 Service Unavailable
+// instead of handling it as an invalid session.
+type UnavailableError struct {
+
+	// Action is the action failed, such as "find session".
+	Action string
+
+	// Err is the underlying error.
+	Err error
+}
+
+// Error implements error interface
+func (err *UnavailableError) Error() string {
+	return "failed to " + err.Action + ": " + err.Err.Error()
+}
+
+// isUnavailable tells if the error is an UnavailableError
+func isUnavailable(err error) bool {
+	_, ok := err.(*UnavailableError)
+	return ok
+}
+
+// SessionToken reads the session token string from the request.
+// Returns ErrNoCredentials (or http.ErrNoCookie) if there is none.
+type SessionToken func(r *http.Request) (tokenStr string, err error)
+
+// CookieToken reads the session token from the cookie of the name.
+// Returns http.ErrNoCookie if the cookie is not found.
+func CookieToken(cookieName string) SessionToken {
+	return func(r *http.Request) (tokenStr string, err error) {
+		cookie, err := r.Cookie(cookieName)
+		if err != nil {
+			return
+		}
+		tokenStr = cookie.Value
+		return
+	}
+}
+
+// BearerToken reads the session token from the "Authorization"
+// header of the Bearer scheme (RFC 6750). Requests without the
+// header, or of other schemes, have no credentials.
+func BearerToken() SessionToken {
+	return func(r *http.Request) (tokenStr string, err error) {
+		auth := r.Header.Get("Authorization")
+		if len(auth) < 7 || !strings.EqualFold(auth[:7], "Bearer ") {
+			err = ErrNoCredentials
+			return
+		}
+		if tokenStr = strings.TrimSpace(auth[7:]); tokenStr == "" {
+			err = fmt.Errorf("empty bearer token")
+		}
+		return
+	}
+}
+
+// QueryToken reads the session token from the query parameter
+// of the name.
+//
+// Tokens in URL may be leaked by logs or the Referer header.
+// Only use it when the client cannot send the other ones
+// (e.g. WebSocket or EventSource in browser).
+func QueryToken(param string) SessionToken {
+	return func(r *http.Request) (tokenStr string, err error) {
+		if tokenStr = r.URL.Query().Get(param); tokenStr == "" {
+			err = ErrNoCredentials
+		}
+		return
+	}
+}
+
+// ChainSessionDecoders combines the decoders into one that tries them
+// in the given order (e.g. header, then cookie, then query parameter).
+//
+// The first decoder that finds a session token decides the result.
+// If the token is invalid, the error is returned without trying the
+// rest. Returns ErrNoCredentials if none of them finds a token.
+func ChainSessionDecoders(decoders ...SessionDecoder) SessionDecoder {
+	return func(r *http.Request) (ctxNext context.Context, userID string, err error) {
+		for _, decode := range decoders {
+			ctxNext, userID, err = decode(r)
+			if !isNoCredentials(err) {
+				return
+			}
+		}
+		return nil, "", ErrNoCredentials
+	}
+}
@@ -0,0 +1,148 @@
+package middleauth_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/yookoala/middleauth"
+	"gopkg.in/jose.v1/crypto"
+	"gopkg.in/jose.v1/jws"
+)
+
+func TestBearerToken(t *testing.T) {
+	tests := []struct {
+		desc   string
+		header string
+		token  string
+		err    error
+	}{
+		{desc: "no header", err: middleauth.ErrNoCredentials},
+		{desc: "other scheme", header: "Basic dXNlcjpwYXNz", err: middleauth.ErrNoCredentials},
+		{desc: "bearer", header: "Bearer some-token", token: "some-token"},
+		{desc: "case insensitive scheme", header: "bearer some-token", token: "some-token"},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		if test.header != "" {
+			r.Header.Set("Authorization", test.header)
+		}
+		token, err := middleauth.BearerToken()(r)
+		if want, have := test.err, err; want != have {
+			t.Errorf("[%s] expected %#v, got %#v", test.desc, want, have)
+		}
+		if want, have := test.token, token; want != have {
+			t.Errorf("[%s] expected %#v, got %#v", test.desc, want, have)
+		}
+	}
+
+	// empty token is invalid credentials
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", "Bearer ")
+	if _, err := middleauth.BearerToken()(r); err == nil || err == middleauth.ErrNoCredentials {
+		t.Errorf("expected invalid token error, got %#v", err)
+	}
+}
+
+func TestChainSessionDecoders(t *testing.T) {
+	jwtKey := "dummy-jwt-key"
+	method := crypto.SigningMethodHS256
+	encode := func(id string) string {
+		claims := jws.Claims{}
+		claims.Set("id", id)
+		claims.SetExpiration(time.Now().Add(time.Hour))
+		tokenStr, _ := middleauth.EncodeTokenStr(jwtKey, claims, method)
+		return tokenStr
+	}
+
+	decoder := middleauth.ChainSessionDecoders(
+		middleauth.JWTTokenDecoder(middleauth.BearerToken(), jwtKey, method),
+		middleauth.JWTSessionDecoder("session", jwtKey, method),
+		middleauth.JWTTokenDecoder(middleauth.QueryToken("access_token"), jwtKey, method),
+	)
+
+	tests := []struct {
+		desc    string
+		request func() *http.Request
+		userID  string
+		err     bool
+	}{
+		{
+			desc: "header before cookie",
+			request: func() *http.Request {
+				r := httptest.NewRequest("GET", "/?access_token="+encode("query-user"), nil)
+				r.Header.Set("Authorization", "Bearer "+encode("header-user"))
+				r.AddCookie(&http.Cookie{Name: "session", Value: encode("cookie-user")})
+				return r
+			},
+			userID: "header-user",
+		},
+		{
+			desc: "cookie before query",
+			request: func() *http.Request {
+				r := httptest.NewRequest("GET", "/?access_token="+encode("query-user"), nil)
+				r.AddCookie(&http.Cookie{Name: "session", Value: encode("cookie-user")})
+				return r
+			},
+			userID: "cookie-user",
+		},
+		{
+			desc: "query",
+			request: func() *http.Request {
+				return httptest.NewRequest("GET", "/?access_token="+encode("query-user"), nil)
+			},
+			userID: "query-user",
+		},
+		{
+			desc: "invalid header does not fall back",
+			request: func() *http.Request {
+				r := httptest.NewRequest("GET", "/", nil)
+				r.Header.Set("Authorization", "Bearer invalid-token")
+				r.AddCookie(&http.Cookie{Name: "session", Value: encode("cookie-user")})
+				return r
+			},
+			err: true,
+		},
+	}
+
+	for _, test := range tests {
+		_, userID, err := decoder(test.request())
+		if test.err {
+			if err == nil {
+				t.Errorf("[%s] expected error, got nil", test.desc)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("[%s] unexpected error: %s", test.desc, err.Error())
+		} else if want, have := test.userID, userID; want != have {
+			t.Errorf("[%s] expected %#v, got %#v", test.desc, want, have)
+		}
+	}
+
+	// no credentials
+	if _, _, err := decoder(httptest.NewRequest("GET", "/", nil)); err != middleauth.ErrNoCredentials {
+		t.Errorf("expected ErrNoCredentials, got %#v", err)
+	}
+}
+
+func TestSessionMiddleware_noCredentials(t *testing.T) {
+	handler := middleauth.SessionMiddleware(
+		middleauth.ChainSessionDecoders(
+			middleauth.JWTTokenDecoder(middleauth.BearerToken(), "dummy-jwt-key", crypto.SigningMethodHS256),
+			middleauth.JWTSessionDecoder("session", "dummy-jwt-key", crypto.SigningMethodHS256),
+		),
+		middleauth.UserFromClaims,
+	)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user := middleauth.GetUser(r.Context()); user != nil {
+			t.Errorf("expected no user, got %#v", user)
+		}
+	}))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if want, have := http.StatusOK, w.Code; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+}
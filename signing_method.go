@@ -0,0 +1,223 @@
+package middleauth
+
+import (
+	gocrypto "crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"gopkg.in/jose.v1/crypto"
+	"gopkg.in/jose.v1/jws"
+)
+
+// JWS signing methods of ECDSA. The signature is the concatenation
+// of R and S as specified in RFC 7518 section 3.4, which is expected
+// by other JWT implementations.
+//
+// The ECDSA signing methods of gopkg.in/jose.v1/crypto produce ASN.1
+// encoded signatures instead, and should not be used for tokens
+// to be verified by another party.
+var (
+	SigningMethodES256 crypto.SigningMethod = &ecdsaSigningMethod{"ES256", gocrypto.SHA256, 32}
+	SigningMethodES384 crypto.SigningMethod = &ecdsaSigningMethod{"ES384", gocrypto.SHA384, 48}
+	SigningMethodES512 crypto.SigningMethod = &ecdsaSigningMethod{"ES512", gocrypto.SHA512, 66}
+)
+
+// SigningMethodEdDSA is the JWS signing method of Ed25519 keys
+// (RFC 8037).
+var SigningMethodEdDSA crypto.SigningMethod = &ed25519SigningMethod{}
+
+// ecdsaSigningMethod implements crypto.SigningMethod for ECDSA
+type ecdsaSigningMethod struct {
+	name    string
+	hash    gocrypto.Hash
+	keySize int
+}
+
+// Alg implements crypto.SigningMethod
+func (m *ecdsaSigningMethod) Alg() string { return m.name }
+
+// Hasher implements crypto.SigningMethod
+func (m *ecdsaSigningMethod) Hasher() gocrypto.Hash { return m.hash }
+
+// Sign implements crypto.SigningMethod. The key must be
+// an *ecdsa.PrivateKey.
+func (m *ecdsaSigningMethod) Sign(raw []byte, key interface{}) (crypto.Signature, error) {
+	ecdsaKey, ok := key.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, crypto.ErrInvalidKey
+	}
+	r, s, err := ecdsa.Sign(rand.Reader, ecdsaKey, m.sum(raw))
+	if err != nil {
+		return nil, err
+	}
+	sig := append(paddedBytes(r, m.keySize), paddedBytes(s, m.keySize)...)
+	return crypto.Signature(sig), nil
+}
+
+// Verify implements crypto.SigningMethod. The key must be
+// an *ecdsa.PublicKey.
+func (m *ecdsaSigningMethod) Verify(raw []byte, sig crypto.Signature, key interface{}) error {
+	ecdsaKey, ok := key.(*ecdsa.PublicKey)
+	if !ok {
+		return crypto.ErrInvalidKey
+	}
+	if len(sig) != 2*m.keySize {
+		return crypto.ErrECDSAVerification
+	}
+	r := new(big.Int).SetBytes(sig[:m.keySize])
+	s := new(big.Int).SetBytes(sig[m.keySize:])
+	if !ecdsa.Verify(ecdsaKey, m.sum(raw), r, s) {
+		return crypto.ErrECDSAVerification
+	}
+	return nil
+}
+
+func (m *ecdsaSigningMethod) sum(b []byte) []byte {
+	h := m.hash.New()
+	h.Write(b)
+	return h.Sum(nil)
+}
+
+// paddedBytes returns the big-endian bytes of n, left padded
+// with zeros to the given size.
+func paddedBytes(n *big.Int, size int) []byte {
+	b := n.Bytes()
+	if len(b) >= size {
+		return b
+	}
+	padded := make([]byte, size)
+	copy(padded[size-len(b):], b)
+	return padded
+}
+
+// ed25519SigningMethod implements crypto.SigningMethod for Ed25519
+type ed25519SigningMethod struct{}
+
+// Alg implements crypto.SigningMethod
+func (m *ed25519SigningMethod) Alg() string { return "EdDSA" }
+
+// Hasher implements crypto.SigningMethod. Ed25519 hashes
+// the message internally.
+func (m *ed25519SigningMethod) Hasher() gocrypto.Hash { return 0 }
+
+// Sign implements crypto.SigningMethod. The key must be
+// an ed25519.PrivateKey.
+func (m *ed25519SigningMethod) Sign(raw []byte, key interface{}) (crypto.Signature, error) {
+	edKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, crypto.ErrInvalidKey
+	}
+	return crypto.Signature(ed25519.Sign(edKey, raw)), nil
+}
+
+// Verify implements crypto.SigningMethod. The key must be
+// an ed25519.PublicKey.
+func (m *ed25519SigningMethod) Verify(raw []byte, sig crypto.Signature, key interface{}) error {
+	edKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return crypto.ErrInvalidKey
+	}
+	if !ed25519.Verify(edKey, raw, sig) {
+		return crypto.ErrSignatureInvalid
+	}
+	return nil
+}
+
+// signJWT signs the claims with the key in JWS compact
+// serialization, with the kid header if not empty.
+func signJWT(method crypto.SigningMethod, key interface{}, kid string, claims jws.Claims) (tokenStr string, err error) {
+	header := map[string]string{
+		"alg": method.Alg(),
+		"typ": "JWT",
+	}
+	if kid != "" {
+		header["kid"] = kid
+	}
+	headerJSON, err := json.Marshal(header)
+	if err != nil {
+		return
+	}
+	claimsJSON, err := json.Marshal(map[string]interface{}(claims))
+	if err != nil {
+		return
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(headerJSON) +
+		"." + base64.RawURLEncoding.EncodeToString(claimsJSON)
+	sig, err := method.Sign([]byte(signingInput), key)
+	if err != nil {
+		err = fmt.Errorf("failed to sign token: %s", err.Error())
+		return
+	}
+	tokenStr = signingInput + "." + base64.RawURLEncoding.EncodeToString(sig)
+	return
+}
+
+// compactJWT is a parsed JWT in JWS compact serialization
+type compactJWT struct {
+	alg          string
+	kid          string
+	claims       jws.Claims
+	signingInput []byte
+	signature    []byte
+}
+
+// parseCompactJWT parses the JWT string without verification
+func parseCompactJWT(tokenStr string) (token *compactJWT, err error) {
+	parts := strings.Split(tokenStr, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed token: expected 3 parts, got %d", len(parts))
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err == nil {
+		err = json.Unmarshal(headerJSON, &header)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("malformed token header: %s", err.Error())
+	}
+
+	// jws.Claims unmarshals base64 encoded JSON. decode
+	// the claims as plain map instead.
+	var claims map[string]interface{}
+	claimsJSON, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err == nil {
+		err = json.Unmarshal(claimsJSON, &claims)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("malformed token claims: %s", err.Error())
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token signature: %s", err.Error())
+	}
+
+	token = &compactJWT{
+		alg:          header.Alg,
+		kid:          header.Kid,
+		claims:       jws.Claims(claims),
+		signingInput: []byte(parts[0] + "." + parts[1]),
+		signature:    signature,
+	}
+	return
+}
+
+// verify verifies the signature of the token with the key.
+// The algorithm of the token must match the method.
+func (token *compactJWT) verify(method crypto.SigningMethod, key interface{}) error {
+	if token.alg != method.Alg() {
+		return fmt.Errorf("unexpected signing algorithm %#v", token.alg)
+	}
+	return method.Verify(token.signingInput, crypto.Signature(token.signature), key)
+}
@@ -0,0 +1,238 @@
+package middleauth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"time"
+
+	"gopkg.in/jose.v1/crypto"
+	"gopkg.in/jose.v1/jws"
+)
+
+// LoginState stores information of a login attempt in between
+// the redirect to the provider and the callback from it.
+type LoginState struct {
+
+	// State is the random value sent to the provider
+	// as the OAuth2 "state" parameter.
+	State string
+
+	// CodeVerifier is the PKCE code verifier of the login
+	// attempt, if PKCE is enabled.
+	CodeVerifier string
+
+	// Nonce is the OpenID Connect nonce of the login
+	// attempt, if nonce is enabled.
+	Nonce string
+
+	// ReturnTo is the URL the user requested to return to
+	// after login. It is not validated until used.
+	ReturnTo string
+
+	// Expires is the time the login state expires.
+	Expires time.Time
+}
+
+// Verify checks if the given state value matches the login state
+func (state *LoginState) Verify(value string) bool {
+	if state == nil || state.State == "" || value == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(state.State), []byte(value)) == 1
+}
+
+// NewLoginState creates a LoginState with random state value
+// for the given login request. The "next" or "return_to" query
+// parameter of the request is kept as ReturnTo.
+func NewLoginState(r *http.Request) (state *LoginState, err error) {
+	value, err := randomString(32)
+	if err != nil {
+		return
+	}
+	state = &LoginState{
+		State:    value,
+		ReturnTo: ReturnToParam(r),
+		Expires:  time.Now().Add(DefaultLoginStateExpires),
+	}
+	return
+}
+
+// maxReturnToLength is the maximum length of return-to
+// URL to keep in the login state.
+const maxReturnToLength = 2048
+
+// ReturnToParam reads the "next" or "return_to" query
+// parameter of the request.
+func ReturnToParam(r *http.Request) (returnTo string) {
+	query := r.URL.Query()
+	if returnTo = query.Get("next"); returnTo == "" {
+		returnTo = query.Get("return_to")
+	}
+	if len(returnTo) > maxReturnToLength {
+		returnTo = ""
+	}
+	return
+}
+
+// DefaultLoginStateExpires is the default period a login
+// attempt is allowed to take.
+const DefaultLoginStateExpires = 10 * time.Minute
+
+// WithLoginState add a *LoginState to a given context
+func WithLoginState(parent context.Context, state *LoginState) context.Context {
+	return context.WithValue(parent, loginStateKey, state)
+}
+
+// GetLoginState gets a *LoginState, if exists, from a context
+func GetLoginState(ctx context.Context) (state *LoginState) {
+	stateRaw := ctx.Value(loginStateKey)
+	state, _ = stateRaw.(*LoginState)
+	return
+}
+
+// StateStore is the interface for storage facility of LoginState.
+// Implementations should bind the state to the browser so that
+// a callback request from another browser cannot use it.
+type StateStore interface {
+
+	// Save binds the login state to the browser of the request.
+	Save(w http.ResponseWriter, r *http.Request, state *LoginState) error
+
+	// Load retrieves the login state bound to the browser
+	// of the request. Returns nil state if there is none.
+	Load(r *http.Request) (state *LoginState, err error)
+
+	// Clear removes the login state bound to the browser of
+	// the request, so that the state cannot be used again.
+	Clear(w http.ResponseWriter, r *http.Request) error
+}
+
+// NewCookieStateStore creates a StateStore that stores LoginState
+// in a short-lived cookie signed with the given key.
+func NewCookieStateStore(cookieName, key string) *CookieStateStore {
+	return &CookieStateStore{
+		CookieName: cookieName,
+		Key:        key,
+		Path:       "/",
+	}
+}
+
+// CookieStateStore stores LoginState in a signed cookie
+type CookieStateStore struct {
+
+	// CookieName is the name of the state cookie.
+	CookieName string
+
+	// Key is the secret key to sign the cookie value with.
+	Key string
+
+	// Path is the path of the state cookie.
+	Path string
+
+	// Secure marks the state cookie as secure (https only).
+	Secure bool
+
+	// SameSite is the SameSite attribute of the state cookie.
+	// Callbacks of form_post response mode are cross-site POST
+	// requests, which requires http.SameSiteNoneMode and Secure.
+	SameSite http.SameSite
+}
+
+// Save implements StateStore
+func (store *CookieStateStore) Save(w http.ResponseWriter, r *http.Request, state *LoginState) (err error) {
+	claims := jws.Claims{}
+	claims.Set("state", state.State)
+	if state.CodeVerifier != "" {
+		claims.Set("verifier", state.CodeVerifier)
+	}
+	if state.Nonce != "" {
+		claims.Set("nonce", state.Nonce)
+	}
+	if state.ReturnTo != "" {
+		claims.Set("return_to", state.ReturnTo)
+	}
+	claims.SetExpiration(state.Expires)
+
+	value, err := EncodeTokenStr(store.Key, claims, crypto.SigningMethodHS256)
+	if err != nil {
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     store.CookieName,
+		Value:    value,
+		Path:     store.Path,
+		Expires:  state.Expires,
+		HttpOnly: true,
+		Secure:   store.Secure,
+		SameSite: store.SameSite,
+	})
+	return
+}
+
+// Load implements StateStore
+func (store *CookieStateStore) Load(r *http.Request) (state *LoginState, err error) {
+	cookie, err := r.Cookie(store.CookieName)
+	if err == http.ErrNoCookie {
+		err = nil
+		return
+	} else if err != nil {
+		return
+	}
+
+	token, err := jws.ParseJWT([]byte(cookie.Value))
+	if err != nil {
+		err = fmt.Errorf("error parsing login state: %s", err.Error())
+		return
+	}
+	if err = token.Validate([]byte(store.Key), crypto.SigningMethodHS256); err != nil {
+		err = fmt.Errorf("error validating login state: %s", err.Error())
+		return
+	}
+
+	claims := token.Claims()
+	state = &LoginState{}
+	state.State, _ = claims.Get("state").(string)
+	state.CodeVerifier, _ = claims.Get("verifier").(string)
+	state.Nonce, _ = claims.Get("nonce").(string)
+	state.ReturnTo, _ = claims.Get("return_to").(string)
+	state.Expires, _ = claims.Expiration()
+	return
+}
+
+// Clear implements StateStore
+func (store *CookieStateStore) Clear(w http.ResponseWriter, r *http.Request) error {
+	http.SetCookie(w, &http.Cookie{
+		Name:     store.CookieName,
+		Path:     store.Path,
+		Expires:  time.Unix(0, 0),
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   store.Secure,
+		SameSite: store.SameSite,
+	})
+	return nil
+}
+
+// forProvider returns a copy of the store with the cookie name
+// keyed by the provider id, so that login attempts to different
+// providers in the same browser do not overwrite each other.
+func (store *CookieStateStore) forProvider(providerID string) *CookieStateStore {
+	copied := *store
+	copied.CookieName = store.CookieName + "-" + providerID
+	return &copied
+}
+
+// randomString generates a base64 encoded random string
+// of n random bytes.
+func randomString(n int) (str string, err error) {
+	b := make([]byte, n)
+	if _, err = rand.Read(b); err != nil {
+		return
+	}
+	str = base64.RawURLEncoding.EncodeToString(b)
+	return
+}
@@ -0,0 +1,91 @@
+package middleauth_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/yookoala/middleauth"
+)
+
+func TestCookieStateStore(t *testing.T) {
+	store := middleauth.NewCookieStateStore("dummy-state", "dummy-key")
+
+	r, _ := http.NewRequest("GET", "http://foobar.com/login?next=%2Fhello%3Ffoo%3Dbar", nil)
+	state, err := middleauth.NewLoginState(r)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if want, have := "/hello?foo=bar", state.ReturnTo; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+
+	w := httptest.NewRecorder()
+	if err := store.Save(w, r, state); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	cookies := w.Result().Cookies()
+	if want, have := 1, len(cookies); want != have {
+		t.Fatalf("expected %d cookie, got %d", want, have)
+	}
+	if want, have := "dummy-state", cookies[0].Name; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+	if !cookies[0].HttpOnly {
+		t.Errorf("expected state cookie to be HttpOnly")
+	}
+
+	r, _ = http.NewRequest("GET", "http://foobar.com/callback", nil)
+	r.AddCookie(cookies[0])
+	loaded, err := store.Load(r)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !loaded.Verify(state.State) {
+		t.Errorf("expected loaded state to verify %#v", state.State)
+	}
+	if loaded.Verify("") {
+		t.Errorf("expected loaded state not to verify empty string")
+	}
+	if want, have := state.ReturnTo, loaded.ReturnTo; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+
+	// state cookie signed by another key
+	r, _ = http.NewRequest("GET", "http://foobar.com/callback", nil)
+	r.AddCookie(cookies[0])
+	if _, err := middleauth.NewCookieStateStore("dummy-state", "other-key").Load(r); err == nil {
+		t.Errorf("expected error, got nil")
+	}
+
+	// no state cookie
+	r, _ = http.NewRequest("GET", "http://foobar.com/callback", nil)
+	if loaded, err := store.Load(r); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	} else if loaded != nil {
+		t.Errorf("expected nil, got %#v", loaded)
+	}
+}
+
+func TestCookieStateStore_expired(t *testing.T) {
+	store := middleauth.NewCookieStateStore("dummy-state", "dummy-key")
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "http://foobar.com/login", nil)
+	store.Save(w, r, &middleauth.LoginState{
+		State:   "dummy-state-value",
+		Expires: time.Now().Add(-time.Minute),
+	})
+
+	r, _ = http.NewRequest("GET", "http://foobar.com/callback", nil)
+	for _, cookie := range w.Result().Cookies() {
+		// simulate browser that still send the cookie
+		cookie.Expires = time.Time{}
+		r.AddCookie(cookie)
+	}
+	if _, err := store.Load(r); err == nil {
+		t.Errorf("expected error, got nil")
+	}
+}
@@ -0,0 +1,38 @@
+package gormstorage
+
+import (
+	"context"
+
+	"github.com/jinzhu/gorm"
+	"github.com/yookoala/middleauth"
+)
+
+// ProviderTokenStore creates a middleauth.ProviderTokenStore
+// implementation by the given db.
+func ProviderTokenStore(db *gorm.DB) middleauth.ProviderTokenStore {
+	return &providerTokenStore{db: db}
+}
+
+// providerTokenStore implements middleauth.ProviderTokenStore
+type providerTokenStore struct {
+	db *gorm.DB
+}
+
+// SaveToken implements middleauth.ProviderTokenStore
+func (store *providerTokenStore) SaveToken(ctx context.Context, token *middleauth.ProviderToken) error {
+	return store.db.Save(token).Error
+}
+
+// FindToken implements middleauth.ProviderTokenStore
+func (store *providerTokenStore) FindToken(ctx context.Context, userID, provider string) (token *middleauth.ProviderToken, err error) {
+	tokens := []middleauth.ProviderToken{}
+	err = store.db.Order("updated_at desc").Order("provider_id").
+		Find(&tokens, "user_id = ? and provider = ?", userID, provider).Error
+	if err != nil {
+		return
+	}
+	if len(tokens) > 0 {
+		token = &tokens[0]
+	}
+	return
+}
@@ -0,0 +1,190 @@
+package gormstorage_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+	"github.com/yookoala/middleauth"
+	gormstorage "github.com/yookoala/middleauth/storage/gorm"
+	"golang.org/x/oauth2"
+)
+
+func TestSaveProviderToken(t *testing.T) {
+	db, err := gorm.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	defer db.Close()
+	gormstorage.AutoMigrate(db)
+
+	store := gormstorage.ProviderTokenStore(db)
+	callback := middleauth.SaveProviderToken(store)(
+		middleauth.TrustAllAuth(gormstorage.UserStorageCallback(db)),
+	)
+	identity := middleauth.UserIdentity{
+		Name:         "dummy user",
+		PrimaryEmail: "dummy@foobar.com",
+		Provider:     "dummy-provider",
+		ProviderID:   randID(),
+	}
+
+	// first login with refresh token
+	ctx := middleauth.WithOAuth2Token(context.Background(), &oauth2.Token{
+		AccessToken:  "access-token-1",
+		TokenType:    "Bearer",
+		RefreshToken: "refresh-token-1",
+		Expiry:       time.Now().Add(time.Hour),
+	})
+	_, user, err := callback(ctx, &identity)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	token, err := store.FindToken(context.Background(), user.ID, "dummy-provider")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	} else if token == nil {
+		t.Fatalf("expected token, got nil")
+	}
+	if want, have := "access-token-1", token.AccessToken; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+	if want, have := identity.ProviderID, token.ProviderID; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+
+	// second login without refresh token
+	ctx = middleauth.WithOAuth2Token(context.Background(), &oauth2.Token{
+		AccessToken: "access-token-2",
+		TokenType:   "Bearer",
+		Expiry:      time.Now().Add(time.Hour),
+	})
+	if _, _, err = callback(ctx, &identity); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	token, _ = store.FindToken(context.Background(), user.ID, "dummy-provider")
+	if want, have := "access-token-2", token.AccessToken; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+	if want, have := "refresh-token-1", token.RefreshToken; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+
+	// latest token among identities of the same provider
+	time.Sleep(10 * time.Millisecond)
+	other := identity
+	other.ProviderID = randID()
+	ctx = middleauth.WithOAuth2Token(context.Background(), &oauth2.Token{
+		AccessToken: "access-token-3",
+		TokenType:   "Bearer",
+		Expiry:      time.Now().Add(time.Hour),
+	})
+	if _, _, err = callback(ctx, &other); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	token, _ = store.FindToken(context.Background(), user.ID, "dummy-provider")
+	if want, have := other.ProviderID, token.ProviderID; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+
+	// no token of other user
+	if token, err := store.FindToken(context.Background(), "other-user", "dummy-provider"); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	} else if token != nil {
+		t.Errorf("expected nil, got %#v", token)
+	}
+}
+
+func TestClientForUser(t *testing.T) {
+	db, err := gorm.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	defer db.Close()
+	gormstorage.AutoMigrate(db)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if want, have := "refresh-token", r.FormValue("refresh_token"); want != have {
+			t.Errorf("expected %#v, got %#v", want, have)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "refreshed-access-token",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+		})
+	})
+	mux.HandleFunc("/api", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("Authorization")))
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	reg := middleauth.NewProviderRegistry()
+	reg.Register("dummy", middleauth.ProviderType{
+		OAuth2Config: func(ctx context.Context, provider middleauth.AuthProvider) (*oauth2.Config, error) {
+			return &oauth2.Config{
+				ClientID:     provider.ClientID,
+				ClientSecret: provider.ClientSecret,
+				Endpoint: oauth2.Endpoint{
+					TokenURL: ts.URL + "/token",
+				},
+			}, nil
+		},
+	})
+
+	store := gormstorage.ProviderTokenStore(db)
+	store.SaveToken(context.Background(), &middleauth.ProviderToken{
+		UserID:       "dummy-user",
+		Provider:     "dummy",
+		ProviderID:   "dummy-provider-id",
+		AccessToken:  "expired-access-token",
+		TokenType:    "Bearer",
+		RefreshToken: "refresh-token",
+		Expiry:       time.Now().Add(-time.Hour),
+	})
+
+	provider := middleauth.AuthProvider{
+		ID:           "dummy",
+		ClientID:     "dummy-client",
+		ClientSecret: "dummy-secret",
+	}
+	handlerCtx := &middleauth.Context{
+		Registry:           reg,
+		ProviderTokenStore: store,
+	}
+	client, err := handlerCtx.ClientForUser(context.Background(), "dummy-user", provider)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	resp, err := client.Get(ts.URL + "/api")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer resp.Body.Close()
+	var auth [64]byte
+	n, _ := resp.Body.Read(auth[:])
+	if want, have := "Bearer refreshed-access-token", string(auth[:n]); want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+
+	// refreshed token saved
+	token, _ := store.FindToken(context.Background(), "dummy-user", "dummy")
+	if want, have := "refreshed-access-token", token.AccessToken; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+	if want, have := "refresh-token", token.RefreshToken; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+
+	// user without token
+	if _, err := handlerCtx.ClientForUser(context.Background(), "other-user", provider); err == nil {
+		t.Errorf("expected error, got nil")
+	}
+}
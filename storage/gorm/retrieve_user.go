@@ -8,13 +8,11 @@ import (
 )
 
 // RetrieveUser create a middleauth.RetrieveUser implementation
-// by the given db.
+// by the given db. Returns nil user if the user is not found.
 func RetrieveUser(db *gorm.DB) middleauth.RetrieveUser {
 	return func(ctx context.Context, id string) (user *middleauth.User, err error) {
 		users := []middleauth.User{}
-		db.First(&users, "id = ?", id)
-		if len(users) < 1 {
-			err = db.Error
+		if err = db.First(&users, "id = ?", id).Error; err != nil || len(users) < 1 {
 			return
 		}
 
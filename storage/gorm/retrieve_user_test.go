@@ -0,0 +1,41 @@
+package gormstorage_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+	"github.com/yookoala/middleauth"
+	gormstorage "github.com/yookoala/middleauth/storage/gorm"
+)
+
+func TestRetrieveUser(t *testing.T) {
+	db, err := gorm.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	defer db.Close()
+	gormstorage.AutoMigrate(db)
+
+	db.Create(&middleauth.User{ID: "user-1", Name: "dummy user", PrimaryEmail: "user-1@foobar.com"})
+	retrieveUser := gormstorage.RetrieveUser(db)
+
+	user, err := retrieveUser(context.Background(), "user-1")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if user == nil {
+		t.Fatalf("expected user, got nil")
+	}
+	if want, have := "dummy user", user.Name; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+
+	// user not found
+	if user, err := retrieveUser(context.Background(), "user-unknown"); err != nil {
+		t.Errorf("unexpected error: %s", err.Error())
+	} else if user != nil {
+		t.Errorf("expected nil, got %#v", user)
+	}
+}
@@ -0,0 +1,69 @@
+package gormstorage
+
+import (
+	"context"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/sirupsen/logrus"
+	"github.com/yookoala/middleauth"
+)
+
+// SessionStore creates a middleauth.SessionStore implementation
+// by the given db. Sessions can be shared, and revoked, among all
+// instances sharing the db. Expired sessions are swept lazily on
+// CreateSession.
+func SessionStore(db *gorm.DB) middleauth.SessionStore {
+	return &sessionStore{db: db}
+}
+
+// sessionStore implements middleauth.SessionStore
+type sessionStore struct {
+	db *gorm.DB
+}
+
+// CreateSession implements middleauth.SessionStore
+func (store *sessionStore) CreateSession(ctx context.Context, session *middleauth.Session) error {
+	if err := store.db.Delete(middleauth.Session{}, "expires <= ?", time.Now()).Error; err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("failed to sweep expired sessions")
+	}
+	return store.db.Create(session).Error
+}
+
+// FindSession implements middleauth.SessionStore
+func (store *sessionStore) FindSession(ctx context.Context, id string) (session *middleauth.Session, err error) {
+	sessions := []middleauth.Session{}
+	if err = store.db.Find(&sessions, "id = ? and expires > ?", id, time.Now()).Error; err != nil {
+		return
+	}
+	if len(sessions) > 0 {
+		session = &sessions[0]
+	}
+	return
+}
+
+// ListSessions implements middleauth.SessionStore
+func (store *sessionStore) ListSessions(ctx context.Context, userID string) (sessions []middleauth.Session, err error) {
+	err = store.db.Order("created_at").
+		Find(&sessions, "user_id = ? and expires > ?", userID, time.Now()).Error
+	return
+}
+
+// ExpireSession implements middleauth.SessionStore
+func (store *sessionStore) ExpireSession(ctx context.Context, id string, expires time.Time) error {
+	return store.db.Model(middleauth.Session{}).
+		Where("id = ? and expires > ?", id, expires).
+		Update("expires", expires).Error
+}
+
+// DeleteSession implements middleauth.SessionStore
+func (store *sessionStore) DeleteSession(ctx context.Context, id string) error {
+	return store.db.Delete(middleauth.Session{}, "id = ?", id).Error
+}
+
+// DeleteUserSessions implements middleauth.SessionStore
+func (store *sessionStore) DeleteUserSessions(ctx context.Context, userID string) error {
+	return store.db.Delete(middleauth.Session{}, "user_id = ?", userID).Error
+}
@@ -0,0 +1,93 @@
+package gormstorage_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+	"github.com/yookoala/middleauth"
+	gormstorage "github.com/yookoala/middleauth/storage/gorm"
+)
+
+func TestSessionStore(t *testing.T) {
+	db, err := gorm.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	defer db.Close()
+	gormstorage.AutoMigrate(db)
+
+	ctx := context.Background()
+	store := gormstorage.SessionStore(db)
+	now := time.Now()
+	sessions := []middleauth.Session{
+		{ID: "session-1", UserID: "user-1", Expires: now.Add(time.Hour), CreatedAt: now},
+		{ID: "session-2", UserID: "user-1", Expires: now.Add(time.Hour), CreatedAt: now.Add(time.Second)},
+		{ID: "session-3", UserID: "user-2", Expires: now.Add(time.Hour), CreatedAt: now},
+		{ID: "session-4", UserID: "user-1", Expires: now.Add(-time.Second), CreatedAt: now},
+	}
+	for i := range sessions {
+		if err := store.CreateSession(ctx, &sessions[i]); err != nil {
+			t.Fatalf("unexpected error: %s", err.Error())
+		}
+	}
+
+	if session, err := store.FindSession(ctx, "session-1"); err != nil {
+		t.Errorf("unexpected error: %s", err.Error())
+	} else if session == nil {
+		t.Errorf("expected session, got nil")
+	} else if want, have := "user-1", session.UserID; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+	if session, _ := store.FindSession(ctx, "session-4"); session != nil {
+		t.Errorf("expected expired session to be nil, got %#v", session)
+	}
+
+	list, err := store.ListSessions(ctx, "user-1")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if want, have := 2, len(list); want != have {
+		t.Fatalf("expected %#v, got %#v", want, have)
+	}
+	if want, have := "session-1", list[0].ID; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+
+	// shorten the expiration of session
+	if err := store.ExpireSession(ctx, "session-2", now.Add(-time.Second)); err != nil {
+		t.Errorf("unexpected error: %s", err.Error())
+	}
+	if session, _ := store.FindSession(ctx, "session-2"); session != nil {
+		t.Errorf("expected expired session to be nil, got %#v", session)
+	}
+	if err := store.ExpireSession(ctx, "session-3", now.Add(2*time.Hour)); err != nil {
+		t.Errorf("unexpected error: %s", err.Error())
+	}
+	if session, _ := store.FindSession(ctx, "session-3"); session == nil {
+		t.Errorf("expected session, got nil")
+	} else if want, have := now.Add(time.Hour), session.Expires; !want.Equal(have) {
+		t.Errorf("expected expiration not extended (%s), got %s", want, have)
+	}
+
+	// revoke single session
+	if err := store.DeleteSession(ctx, "session-1"); err != nil {
+		t.Errorf("unexpected error: %s", err.Error())
+	}
+	if session, _ := store.FindSession(ctx, "session-1"); session != nil {
+		t.Errorf("expected nil, got %#v", session)
+	}
+
+	// revoke all sessions of user
+	if err := store.DeleteUserSessions(ctx, "user-1"); err != nil {
+		t.Errorf("unexpected error: %s", err.Error())
+	}
+	if session, _ := store.FindSession(ctx, "session-2"); session != nil {
+		t.Errorf("expected nil, got %#v", session)
+	}
+	if session, _ := store.FindSession(ctx, "session-3"); session == nil {
+		t.Errorf("expected session of other user to remain, got nil")
+	}
+}
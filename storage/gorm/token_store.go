@@ -0,0 +1,85 @@
+package gormstorage
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/mrjones/oauth"
+	"github.com/sirupsen/logrus"
+	"github.com/yookoala/middleauth"
+)
+
+// RequestToken stores OAuth1.0a request token in between
+// the login redirect and the provider callback.
+type RequestToken struct {
+	Token   string    `gorm:"type:varchar(255);primary_key"`
+	Secret  string    `gorm:"type:varchar(255)"`
+	Expires time.Time `gorm:"index"`
+}
+
+// TokenStore creates a middleauth.TokenStore implementation by
+// the given db. Request tokens are kept for the given ttl, so
+// OAuth1.0a login flows can be finished by any instance sharing
+// the db. Expired tokens are swept lazily on Save.
+func TokenStore(db *gorm.DB, ttl time.Duration) middleauth.TokenStore {
+	return &tokenStore{db: db, ttl: ttl}
+}
+
+// tokenStore implements middleauth.TokenStore
+type tokenStore struct {
+	db  *gorm.DB
+	ttl time.Duration
+}
+
+// Save implements middleauth.TokenStore
+func (store *tokenStore) Save(token *oauth.RequestToken) {
+	now := time.Now()
+	if err := store.db.Delete(RequestToken{}, "expires <= ?", now).Error; err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("failed to sweep expired request tokens")
+	}
+	err := store.db.Create(&RequestToken{
+		Token:   token.Token,
+		Secret:  token.Secret,
+		Expires: now.Add(store.ttl),
+	}).Error
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("failed to save request token")
+	}
+}
+
+// Consume implements middleauth.TokenStore
+func (store *tokenStore) Consume(tokenKey string) (token *oauth.RequestToken) {
+	if tokenKey == "" {
+		return
+	}
+	var stored RequestToken
+	if res := store.db.First(&stored, "token = ?", tokenKey); res.Error != nil {
+		if !res.RecordNotFound() {
+			logrus.WithFields(logrus.Fields{
+				"error": res.Error.Error(),
+			}).Error("failed to find request token")
+		}
+		return
+	}
+
+	// only the one who deleted the row may use the token
+	res := store.db.Delete(RequestToken{}, "token = ?", tokenKey)
+	if res.Error != nil {
+		logrus.WithFields(logrus.Fields{
+			"error": res.Error.Error(),
+		}).Error("failed to consume request token")
+		return
+	}
+	if res.RowsAffected != 1 || !time.Now().Before(stored.Expires) {
+		return
+	}
+	token = &oauth.RequestToken{
+		Token:  stored.Token,
+		Secret: stored.Secret,
+	}
+	return
+}
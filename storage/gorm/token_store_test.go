@@ -0,0 +1,70 @@
+package gormstorage_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+	"github.com/mrjones/oauth"
+	gormstorage "github.com/yookoala/middleauth/storage/gorm"
+)
+
+func TestTokenStore(t *testing.T) {
+	db, err := gorm.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	defer db.Close()
+	gormstorage.AutoMigrate(db)
+
+	// stores of different instances sharing the db
+	store1 := gormstorage.TokenStore(db, time.Minute)
+	store2 := gormstorage.TokenStore(db, time.Minute)
+
+	store1.Save(&oauth.RequestToken{Token: "token-1", Secret: "secret-1"})
+	token := store2.Consume("token-1")
+	if token == nil {
+		t.Fatalf("expected token, got nil")
+	}
+	if want, have := "token-1", token.Token; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+	if want, have := "secret-1", token.Secret; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+
+	// token can only be consumed once
+	if token := store1.Consume("token-1"); token != nil {
+		t.Errorf("expected nil, got %#v", token)
+	}
+	if token := store1.Consume("token-unknown"); token != nil {
+		t.Errorf("expected nil, got %#v", token)
+	}
+}
+
+func TestTokenStore_expires(t *testing.T) {
+	db, err := gorm.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	defer db.Close()
+	gormstorage.AutoMigrate(db)
+
+	store := gormstorage.TokenStore(db, 10*time.Millisecond)
+	store.Save(&oauth.RequestToken{Token: "token-1", Secret: "secret-1"})
+	store.Save(&oauth.RequestToken{Token: "token-2", Secret: "secret-2"})
+	time.Sleep(20 * time.Millisecond)
+
+	if token := store.Consume("token-1"); token != nil {
+		t.Errorf("expected nil, got %#v", token)
+	}
+
+	// expired tokens are swept on save
+	store.Save(&oauth.RequestToken{Token: "token-3", Secret: "secret-3"})
+	var count int
+	db.Model(&gormstorage.RequestToken{}).Count(&count)
+	if want, have := 1, count; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+}
@@ -15,6 +15,9 @@ func AutoMigrate(db *gorm.DB) *gorm.DB {
 		middleauth.User{},
 		middleauth.UserEmail{},
 		middleauth.UserIdentity{},
+		middleauth.ProviderToken{},
+		RequestToken{},
+		middleauth.Session{},
 	)
 }
 
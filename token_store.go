@@ -0,0 +1,109 @@
+package middleauth
+
+import (
+	"sync"
+	"time"
+
+	"github.com/mrjones/oauth"
+)
+
+// DefaultRequestTokenExpires is the default period an OAuth1.0a
+// request token is kept in the TokenStore for the callback.
+const DefaultRequestTokenExpires = 10 * time.Minute
+
+// TokenStore is the interface for token storage facility
+// for temporary token storage and mapping in OAuth1.0a
+//
+// Implementations must be safe for concurrent use. A token
+// may only be consumed once.
+type TokenStore interface {
+	Save(token *oauth.RequestToken)
+	Consume(tokenKey string) (token *oauth.RequestToken)
+}
+
+// NewTokenStore creates a simple local implementation of token store
+// that keeps request tokens for DefaultRequestTokenExpires.
+//
+// The tokens are kept in memory. OAuth1.0a login flows cannot be
+// shared among multiple instances with it.
+func NewTokenStore() TokenStore {
+	return NewMemoryTokenStore(DefaultRequestTokenExpires)
+}
+
+// NewMemoryTokenStore creates an in-memory TokenStore that keeps
+// request tokens for the given ttl. Expired tokens are swept
+// lazily on Save.
+func NewMemoryTokenStore(ttl time.Duration) *MemoryTokenStore {
+	return &MemoryTokenStore{
+		TTL:    ttl,
+		tokens: make(map[string]memoryToken, 1024),
+	}
+}
+
+// MemoryTokenStore stores OAuth1.0a request token
+// temporarily to a map of the token field
+type MemoryTokenStore struct {
+	TTL time.Duration
+
+	mu        sync.Mutex
+	tokens    map[string]memoryToken
+	lastSweep time.Time
+}
+
+// memoryToken is a request token with expiration time
+type memoryToken struct {
+	token   *oauth.RequestToken
+	expires time.Time
+}
+
+// Save stores a copy of token in a map by token key
+func (store *MemoryTokenStore) Save(token *oauth.RequestToken) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(store.lastSweep) >= store.TTL {
+		store.sweep(now)
+	}
+	store.tokens[token.Token] = memoryToken{
+		token:   token,
+		expires: now.Add(store.TTL),
+	}
+}
+
+// Consume remove a token, if exists, from the token store
+// and return the just removed token. Expired token will
+// not be returned.
+func (store *MemoryTokenStore) Consume(tokenKey string) (token *oauth.RequestToken) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	stored, ok := store.tokens[tokenKey]
+	if !ok {
+		return
+	}
+	delete(store.tokens, tokenKey)
+	if time.Now().Before(stored.expires) {
+		token = stored.token
+	}
+	return
+}
+
+// Len returns the number of tokens in the store,
+// including expired ones that are not yet swept.
+func (store *MemoryTokenStore) Len() int {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	return len(store.tokens)
+}
+
+// sweep removes all expired tokens. Must be called
+// with the lock held.
+func (store *MemoryTokenStore) sweep(now time.Time) {
+	for key, stored := range store.tokens {
+		if !now.Before(stored.expires) {
+			delete(store.tokens, key)
+		}
+	}
+	store.lastSweep = now
+}
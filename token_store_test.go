@@ -0,0 +1,86 @@
+package middleauth_test
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mrjones/oauth"
+	"github.com/yookoala/middleauth"
+)
+
+func TestMemoryTokenStore(t *testing.T) {
+	store := middleauth.NewMemoryTokenStore(time.Minute)
+	store.Save(&oauth.RequestToken{Token: "token-1", Secret: "secret-1"})
+
+	if token := store.Consume("token-unknown"); token != nil {
+		t.Errorf("expected nil, got %#v", token)
+	}
+
+	token := store.Consume("token-1")
+	if token == nil {
+		t.Fatalf("expected token, got nil")
+	}
+	if want, have := "secret-1", token.Secret; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+
+	// token can only be consumed once
+	if token := store.Consume("token-1"); token != nil {
+		t.Errorf("expected nil, got %#v", token)
+	}
+}
+
+func TestMemoryTokenStore_expires(t *testing.T) {
+	store := middleauth.NewMemoryTokenStore(10 * time.Millisecond)
+	store.Save(&oauth.RequestToken{Token: "token-1", Secret: "secret-1"})
+	store.Save(&oauth.RequestToken{Token: "token-2", Secret: "secret-2"})
+	time.Sleep(20 * time.Millisecond)
+
+	if token := store.Consume("token-1"); token != nil {
+		t.Errorf("expected nil, got %#v", token)
+	}
+
+	// expired tokens are swept on save
+	store.Save(&oauth.RequestToken{Token: "token-3", Secret: "secret-3"})
+	if want, have := 1, store.Len(); want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+	if token := store.Consume("token-3"); token == nil {
+		t.Errorf("expected token, got nil")
+	}
+}
+
+func TestMemoryTokenStore_concurrent(t *testing.T) {
+	store := middleauth.NewMemoryTokenStore(time.Minute)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			store.Save(&oauth.RequestToken{Token: fmt.Sprintf("token-%d", i)})
+		}(i)
+	}
+	wg.Wait()
+
+	var consumed int32
+	for i := 0; i < 50; i++ {
+		wg.Add(2)
+		for j := 0; j < 2; j++ {
+			go func(i int) {
+				defer wg.Done()
+				if store.Consume(fmt.Sprintf("token-%d", i)) != nil {
+					atomic.AddInt32(&consumed, 1)
+				}
+			}(i)
+		}
+	}
+	wg.Wait()
+
+	if want, have := int32(50), consumed; want != have {
+		t.Errorf("expected %#v, got %#v", want, have)
+	}
+}
@@ -66,6 +66,16 @@ func (err LoginErrorType) String() string {
 		return "user primary email is not verified"
 	case ErrUserIdentityNotVerified:
 		return "identity is not verified"
+	case ErrInvalidState:
+		return "invalid login state"
+	case ErrInvalidIDToken:
+		return "invalid id token"
+	case ErrOrganizationNotAllowed:
+		return "organization not allowed"
+	case ErrHostedDomainNotAllowed:
+		return "hosted domain not allowed"
+	case ErrAccessDenied:
+		return "access denied"
 	}
 	return "unknown error"
 }
@@ -106,6 +116,28 @@ const (
 	// with OAuth2 provider but has not yet verified
 	// the linking through primary e-mail.
 	ErrUserIdentityNotVerified
+
+	// ErrInvalidState happens if the login callback is missing
+	// the state parameter, or the state does not match the one
+	// bound to the browser.
+	ErrInvalidState
+
+	// ErrInvalidIDToken happens if the OpenID Connect ID token
+	// is missing or failed the verification.
+	ErrInvalidIDToken
+
+	// ErrOrganizationNotAllowed happens if the login user
+	// does not belong to the organizations allowed, such as
+	// the tenant of Microsoft login.
+	ErrOrganizationNotAllowed
+
+	// ErrHostedDomainNotAllowed happens if the login user
+	// is not an account of the Google Workspace domains allowed.
+	ErrHostedDomainNotAllowed
+
+	// ErrAccessDenied happens if the user declined the
+	// authorization at the provider.
+	ErrAccessDenied
 )
 
 // LoginError is a class of errors occurs in login
@@ -156,9 +188,9 @@ func (err LoginError) GoString() string {
 
 // TrustAllAuth automatically set all new UserIdentity as Verified.
 //
-// By default, all UserIdentity generated will have Verified
-// set to false. Also the newly created User will inherit
-// the Verified flag.
+// By default, the UserIdentity generated will have Verified set
+// by the provider's own verification signal of the primary email.
+// Also the newly created User will inherit the Verified flag.
 //
 // Thus changing the UserIdentity input to inner UserStorageCallback
 // will make the newly created User.Verified == true.
@@ -168,3 +200,17 @@ func TrustAllAuth(inner UserStorageCallback) UserStorageCallback {
 		return inner(ctx, authIdentity)
 	}
 }
+
+// TrustProviders generates a decorator of UserStorageCallback that
+// set the UserIdentity of the given provider ids as Verified. The
+// UserIdentity of other providers are left as verified by provider.
+func TrustProviders(providerIDs ...string) func(inner UserStorageCallback) UserStorageCallback {
+	return func(inner UserStorageCallback) UserStorageCallback {
+		return func(ctx context.Context, authIdentity *UserIdentity) (ctxNext context.Context, confirmedUser *User, err error) {
+			if stringInSlice(authIdentity.Provider, providerIDs) {
+				authIdentity.Verified = true
+			}
+			return inner(ctx, authIdentity)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package middleauth_test
 
 import (
+	"context"
 	"fmt"
 	"testing"
 
@@ -90,3 +91,36 @@ func TestLoginError(t *testing.T) {
 	}
 
 }
+
+func TestTrustProviders(t *testing.T) {
+	var verified bool
+	inner := middleauth.UserStorageCallback(func(ctx context.Context, authIdentity *middleauth.UserIdentity) (ctxNext context.Context, confirmedUser *middleauth.User, err error) {
+		verified = authIdentity.Verified
+		return ctx, &middleauth.User{}, nil
+	})
+	callback := middleauth.TrustProviders("corp", "github")(inner)
+
+	tests := []struct {
+		identity middleauth.UserIdentity
+		verified bool
+	}{
+		{
+			identity: middleauth.UserIdentity{Provider: "corp"},
+			verified: true,
+		},
+		{
+			identity: middleauth.UserIdentity{Provider: "facebook"},
+			verified: false,
+		},
+		{
+			identity: middleauth.UserIdentity{Provider: "google", Verified: true},
+			verified: true,
+		},
+	}
+	for _, test := range tests {
+		callback(context.Background(), &test.identity)
+		if want, have := test.verified, verified; want != have {
+			t.Errorf("[%s] expected %#v, got %#v", test.identity.Provider, want, have)
+		}
+	}
+}